@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
+	"log"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/echo"
 	"github.com/labstack/echo/v4"
 
-	"github.com/scraymondjr/appointment/datastore/neo4j"
+	"github.com/scraymondjr/appointment/datastore/backend"
 	"github.com/scraymondjr/appointment/http"
+	"github.com/scraymondjr/appointment/internal"
 )
 
 // Create resources once in init so lambda instance will re-use the values for subsequent requests.
@@ -17,8 +19,22 @@ import (
 var e *echo.Echo
 
 func init() {
-	store := neo4j.New()
-	e = http.Echo(store)
+	config, err := backend.Load(nil)
+	if err != nil {
+		log.Fatalf("problem loading datastore config: %v", err)
+	}
+	survey, err := backend.LoadSurvey(config)
+	if err != nil {
+		log.Fatalf("problem loading survey: %v", err)
+	}
+	store, err := backend.Open(config)
+	if err != nil {
+		log.Fatalf("problem opening datastore: %v", err)
+	}
+	if err := internal.PublishSurvey(store, survey); err != nil {
+		log.Fatalf("problem publishing survey: %v", err)
+	}
+	e = http.Echo(store, survey)
 }
 
 func main() {
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/c-bata/go-prompt"
 	"github.com/spf13/cobra"
@@ -15,26 +17,28 @@ import (
 	"github.com/scraymondjr/appointment/internal"
 )
 
-func PatientCommand(s datastore.Store) *cobra.Command {
+func PatientCommand(s datastore.Store, survey *internal.Survey) *cobra.Command {
 	return &cobra.Command{
 		Use: "patient patient_id",
 		Run: func(_ *cobra.Command, args []string) {
 			patientID := args[0]
-			runPatientPrompts(patientID, s)
+			runPatientPrompts(patientID, s, *survey)
 		},
 		Args: cobra.ExactArgs(1),
 	}
 }
 
-func runPatientPrompts(patientID string, store datastore.Store) {
+func runPatientPrompts(patientID string, store datastore.Store, survey internal.Survey) {
 	defer handleExit()
-	p := &Prompt{PatientID: patientID, Store: store}
+	p := &Prompt{PatientID: patientID, Store: store, Survey: survey}
 	p.Run()
 }
 
 type Prompt struct {
 	PatientID string
 	Store     datastore.Store
+	// Survey is the survey patients answer when giving feedback.
+	Survey internal.Survey
 
 	feedback *feedbackSurvey
 }
@@ -48,10 +52,12 @@ func (p *Prompt) Run() {
 		prompt.OptionLivePrefix(func() (prefix string, useLivePrefix bool) {
 			if p.feedback != nil {
 				switch {
-				case p.feedback.Recommend == 0:
-					return fmt.Sprintf("(1 - 10): "), true
-				case p.feedback.Explained == nil:
-					return fmt.Sprintf("(Yes/No): "), true
+				case p.feedback.choosingDiagnosis():
+					return fmt.Sprintf("(1 - %d): ", len(p.feedback.Appointment.Diagnoses)), true
+				case p.feedback.question() != nil:
+					if prefix := answerPrefix(*p.feedback.question()); prefix != "" {
+						return prefix, true
+					}
 				}
 			}
 			return "", false
@@ -82,9 +88,69 @@ func (p *Prompt) execute(in string) {
 }
 
 type feedbackSurvey struct {
+	Survey      internal.Survey
 	Appointment *internal.Appointment
+	Patient     *internal.Patient
 	Doctor      *internal.Doctor
 	internal.Feedback
+
+	// next is the index of the question of the survey to answer next, skipping those not asked given the
+	// answers so far
+	next int
+}
+
+// question returns the question to answer next, or nil if the patient is choosing a diagnosis or has answered
+// every question.
+func (f *feedbackSurvey) question() *internal.Question {
+	if f.choosingDiagnosis() || f.next >= len(f.Survey.Questions) {
+		return nil
+	}
+	return &f.Survey.Questions[f.next]
+}
+
+// failingQuestion returns the index of the first question asked given the answers whose answer it does not take,
+// with the error of Question.Check, or a nil error if there is none.
+func (f *feedbackSurvey) failingQuestion() (int, error) {
+	for i, q := range f.Survey.Questions {
+		if !q.Asked(f.Answers) {
+			continue
+		}
+		if err := q.Check(f.Answers[q.ID]); err != nil {
+			return i, err
+		}
+	}
+	return 0, nil
+}
+
+// context returns the context the questions of the survey are worded with.
+func (f *feedbackSurvey) context() internal.SurveyContext {
+	var diagnosis *internal.Diagnosis
+	if f.Feedback.Diagnosis != nil {
+		diagnosis = f.Appointment.FindDiagnosis(f.Feedback.Diagnosis.ResourceID)
+	}
+	return internal.NewSurveyContext(f.Patient, f.Doctor, diagnosis)
+}
+
+// answerPrefix returns the prompt prefix showing the answers the question takes, or "" for free text.
+func answerPrefix(q internal.Question) string {
+	switch q.Type {
+	case internal.QuestionScale:
+		return fmt.Sprintf("(%d - %d): ", q.Min, q.Max)
+	case internal.QuestionYesNo:
+		return "(Yes/No): "
+	case internal.QuestionChoice:
+		return fmt.Sprintf("(1 - %d): ", len(q.Options))
+	case internal.QuestionMultiChoice:
+		return fmt.Sprintf("(1 - %d, comma-separated): ", len(q.Options))
+	default:
+		return ""
+	}
+}
+
+// choosingDiagnosis returns whether the patient has yet to pick which of several diagnoses, none of them
+// primary, the feedback is about.
+func (f *feedbackSurvey) choosingDiagnosis() bool {
+	return f.Feedback.Diagnosis == nil && len(f.Appointment.Diagnoses) > 1
 }
 
 func (p *Prompt) startFeedback(appointmentID string) {
@@ -99,18 +165,64 @@ func (p *Prompt) startFeedback(appointmentID string) {
 		fmt.Printf("appointment %s not found for patient, cannot complete feedback\n", appointmentID)
 		return
 	}
+	if !appointment.Ended(time.Now()) {
+		fmt.Printf("appointment %s has not ended yet, feedback can be given once it has\n", appointmentID)
+		return
+	}
 
 	patient, _ := p.Store.GetPatient(p.PatientID)
 	doctor, _ := p.Store.GetDoctor(appointment.Actor.ResourceID)
 
 	p.feedback = &feedbackSurvey{
+		Survey:      p.Survey,
 		Appointment: appointment,
+		Patient:     patient,
 		Doctor:      doctor,
+		Feedback: internal.Feedback{
+			Author:        &internal.Reference{ResourceID: p.PatientID, ResourceType: "Patient"},
+			Channel:       internal.FeedbackChannelCLI,
+			Survey:        p.Survey.ID,
+			SurveyVersion: p.Survey.Version,
+		},
+	}
+	if diagnosis := appointment.PrimaryDiagnosis(); diagnosis != nil {
+		p.feedback.Feedback.Diagnosis = &internal.Reference{
+			ResourceID:   diagnosis.ID(),
+			ResourceType: "Diagnosis",
+		}
 	}
 
 	// display first prompt
 
-	fmt.Printf("\nHi %s, on a scale of 1-10, would you recommend Dr %s to a friend or family member? 1 = Would not recommend, 10 = Would strongly recommend\n\n", patient.Name[0].Given[0], doctor.Name[0].Family)
+	if p.feedback.choosingDiagnosis() {
+		fmt.Printf("\nHi %s, you received several diagnoses at this appointment. Which one would you like to give feedback about?\n\n", p.feedback.context().Patient)
+		for i, diagnosis := range appointment.Diagnoses {
+			fmt.Printf("%d. %s\n", i+1, diagnosis.Name())
+		}
+		fmt.Println()
+		return
+	}
+	p.askQuestion()
+}
+
+// askQuestion prints the question to answer next, with its options if it has any.
+func (p *Prompt) askQuestion() {
+	q := p.feedback.question()
+	text, err := q.Prompt(p.feedback.context())
+	if err != nil {
+		fmt.Println("problem wording question: " + err.Error())
+	}
+	fmt.Printf("\n%s\n\n", text)
+	for i, option := range q.Options {
+		label := option.Label
+		if label == "" {
+			label = option.Value
+		}
+		fmt.Printf("%d. %s\n", i+1, label)
+	}
+	if len(q.Options) > 0 {
+		fmt.Println()
+	}
 }
 
 func (p *Prompt) viewFeedback(appointmentID string) {
@@ -124,11 +236,31 @@ func (p *Prompt) viewFeedback(appointmentID string) {
 		return
 	}
 
-	appointment, _ := p.Store.GetAppointment(appointmentID)
+	appointment, err := p.Store.GetAppointment(appointmentID)
+	if err != nil {
+		fmt.Println("problem reading appointment: " + err.Error())
+		return
+	}
+	if appointment == nil {
+		fmt.Printf("appointment %s not found for patient, cannot show feedback\n", appointmentID)
+		return
+	}
+	patient, _ := p.Store.GetPatient(p.PatientID)
 	doctor, _ := p.Store.GetDoctor(appointment.Actor.ResourceID)
 
+	// show the answers with the questions of the survey version they answered
+	survey, err := internal.LookupSurvey(p.Store, feedback.Survey, feedback.SurveyVersion)
+	if err != nil {
+		fmt.Printf("Problem getting survey %s version %d: %v\n", feedback.Survey, feedback.SurveyVersion, err)
+	}
+	if survey == nil {
+		survey = &p.Survey
+	}
+
 	printSubmittedFeedback(feedbackSurvey{
+		Survey:      *survey,
 		Appointment: appointment,
+		Patient:     patient,
 		Doctor:      doctor,
 		Feedback:    *feedback,
 	})
@@ -137,50 +269,93 @@ func (p *Prompt) viewFeedback(appointmentID string) {
 // feedbackPrompt handles prompting when user is providing feedback.
 func (p *Prompt) feedbackPrompt(in string) {
 	switch {
-	case p.feedback.Recommend == 0:
-		parsedRating, err := strconv.Atoi(in)
-		if err != nil {
-			fmt.Printf("Sorry, your response %s was not understood. Please try again.\n", in)
+	case p.feedback.choosingDiagnosis():
+		choice, err := strconv.Atoi(in)
+		if err != nil || choice < 1 || choice > len(p.feedback.Appointment.Diagnoses) {
+			fmt.Printf("Please enter a value between 1-%d.\n", len(p.feedback.Appointment.Diagnoses))
 			return
 		}
-		if parsedRating < 1 || parsedRating > 10 {
-			fmt.Printf("Please enter a value between 1-10.\n")
-			return
+		p.feedback.Feedback.Diagnosis = &internal.Reference{
+			ResourceID:   p.feedback.Appointment.Diagnoses[choice-1].ID(),
+			ResourceType: "Diagnosis",
 		}
-		p.feedback.Recommend = parsedRating
-
-		fmt.Printf("\nThank you. You were diagnosed with %s. Did Dr %s explain how to manage this diagnosis in a way you could understand?\n\n", p.feedback.Appointment.Diagnosis.Name, p.feedback.Doctor.Name[0].Family)
-	case p.feedback.Explained == nil:
-		yesNo, _ := strconv.ParseBool(in)
-		p.feedback.Explained = &yesNo
 
-		fmt.Printf("\nWe appreciate the feedback, one last question: how do you feel about being diagnosed with %s?\n\n", p.feedback.Appointment.Diagnosis.Name)
+		p.askQuestion()
 	default:
-		p.feedback.Feeling = &in
+		q := p.feedback.question()
+		answer, err := q.ParseAnswer(in)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if !answer.IsZero() {
+			if p.feedback.Answers == nil {
+				p.feedback.Answers = map[string]internal.Answer{}
+			}
+			p.feedback.Answers[q.ID] = answer
+		}
+		p.feedback.next = p.feedback.Survey.NextQuestion(p.feedback.next+1, p.feedback.Answers)
+		if p.feedback.question() != nil {
+			p.askQuestion()
+			return
+		}
 
-		if err := p.Store.SavePatientFeedback(p.feedback.Appointment.ID(), p.feedback.Feedback); err != nil {
+		// the answers are checked as the API checks them, so branches skipped by the survey stay unanswered; a
+		// question whose answer fails is asked again, keeping the other answers
+		if err := p.feedback.Survey.Check(p.feedback.Feedback); err != nil {
+			if i, err := p.feedback.failingQuestion(); err != nil {
+				fmt.Println("Problem with your answer: " + err.Error())
+				delete(p.feedback.Answers, p.feedback.Survey.Questions[i].ID)
+				p.feedback.next = i
+				p.askQuestion()
+				return
+			}
+			fmt.Println("Problem checking patient feedback: " + err.Error())
+			p.feedback = nil
+			return
+		}
+		saved, err := p.Store.SavePatientFeedback(p.feedback.Appointment.ID(), p.feedback.Feedback)
+		if err != nil {
 			fmt.Println("Problem saving patient feedback: " + err.Error())
 			return
 		}
+		p.feedback.Feedback = *saved
 
 		fmt.Printf("Thanks again! Here’s what we heard:\n\n")
 		printSubmittedFeedback(*p.feedback)
 
 		p.feedback = nil
 	}
-
-	return
 }
 
+// printSubmittedFeedback prints each answer with the label of its question. Answers to a survey version other than
+// the given one are printed by question id.
 func printSubmittedFeedback(feedback feedbackSurvey) {
-	yesNo := "Yes"
-	if !*feedback.Explained {
-		yesNo = "No"
+	if !feedback.Survey.AnsweredBy(feedback.Feedback) {
+		ids := make([]string, 0, len(feedback.Answers))
+		for id := range feedback.Answers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		fmt.Printf("Your answers to survey %s version %d:\n", feedback.Feedback.Survey, feedback.Feedback.SurveyVersion)
+		for _, id := range ids {
+			fmt.Printf("%s: %s\n", id, internal.Question{}.FormatAnswer(feedback.Answers[id]))
+		}
+		return
 	}
 
-	fmt.Printf("Your recommendation of Dr %s (1 - 10): %v\n", feedback.Doctor.Name[0].Family, feedback.Recommend)
-	fmt.Printf("Dr %s explained your diagnosis of %s to you: %s\n", feedback.Doctor.Name[0].Family, feedback.Appointment.Diagnosis.Name, yesNo)
-	fmt.Printf("Your feelings about your diagnosis: %s\n", *feedback.Feeling)
+	ctx := feedback.context()
+	for _, q := range feedback.Survey.Questions {
+		answer, ok := feedback.Answers[q.ID]
+		if !ok {
+			continue
+		}
+		label, err := q.AnswerLabel(ctx)
+		if err != nil {
+			label = q.ID
+		}
+		fmt.Printf("%s: %s\n", label, q.FormatAnswer(answer))
+	}
 }
 
 // patientDetails prints informatino about the patient.
@@ -191,7 +366,9 @@ func (p *Prompt) patientDetails() {
 		return
 	}
 
-	json.NewEncoder(os.Stdin).Encode(patient)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(patient)
 }
 
 // appointments prints the appointments for the patient.
@@ -202,12 +379,20 @@ func (p *Prompt) appointments() {
 		return
 	}
 
+	now := time.Now()
 	for _, appointment := range appointments {
-		feedbackMsg := "Feedback survey available!"
-		if appointment.Feedback != nil {
-			feedbackMsg = "Feedback submitted"
+		var feedbackMsg string
+		switch {
+		case appointment.Feedback != nil:
+			feedbackMsg = " - Feedback submitted"
+		case appointment.Ended(now):
+			feedbackMsg = " - Feedback survey available!"
 		}
-		fmt.Printf("appointment %s (%s) - %s\n", appointment.ID(), appointment.Status, feedbackMsg)
+		when := "unscheduled"
+		if appointment.Period.Start != nil {
+			when = appointment.Period.Start.Local().Format("Mon Jan 2 2006 15:04")
+		}
+		fmt.Printf("appointment %s on %s (%s)%s\n", appointment.ID(), when, appointment.Status, feedbackMsg)
 	}
 }
 
@@ -226,10 +411,11 @@ func (p *Prompt) completer() func(in prompt.Document) []prompt.Suggest {
 				return []prompt.Suggest{}
 			}
 
-			prompts := make([]prompt.Suggest, len(appointments))
-			for i := range appointments {
-				if appointments[i].Feedback == nil {
-					prompts[i] = prompt.Suggest{Text: appointments[i].ID()}
+			var prompts []prompt.Suggest
+			now := time.Now()
+			for _, appointment := range appointments {
+				if appointment.Feedback == nil && appointment.Ended(now) {
+					prompts = append(prompts, prompt.Suggest{Text: appointment.ID()})
 				}
 			}
 			return prompts
@@ -265,10 +451,10 @@ func (p *Prompt) completer() func(in prompt.Document) []prompt.Suggest {
 }
 
 var suggestions = []prompt.Suggest{
-	{"me", "Display info about me"},
-	{"appointments", "List appointments"},
-	{"givefeedback", "Provide feedback about a completed appointment"},
-	{"viewfeedback", "View submitted feedback about an appointment"},
+	{Text: "me", Description: "Display info about me"},
+	{Text: "appointments", Description: "List appointments"},
+	{Text: "givefeedback", Description: "Provide feedback about a completed appointment"},
+	{Text: "viewfeedback", Description: "View submitted feedback about an appointment"},
 }
 
 // hack to fix terminal prompt being disabled after exiting
@@ -1,7 +1,13 @@
 package commander
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -10,15 +16,54 @@ import (
 )
 
 func IngestCommand(writer internal.ResourceWriter) *cobra.Command {
-	return &cobra.Command{
-		Use: "ingest json_file_path",
+	var (
+		opts       internal.IngestOptions
+		output     string
+		progress   bool
+		references string
+	)
+	cmd := &cobra.Command{
+		Use:   "ingest json_file_path",
+		Short: "Ingest JSON or NDJSON resources from a file, or from stdin if the path is -",
 		RunE: func(_ *cobra.Command, args []string) error {
-			f, err := os.Open(args[0])
-			if err != nil {
-				return errors.Wrap(err, "problem opening file at "+args[0])
+			if output != "table" && output != "json" {
+				return errors.Errorf("unknown output format %q: expected table or json", output)
+			}
+			switch references {
+			case "off":
+				opts.References = internal.ReferencesUnchecked
+			case "lenient":
+				opts.References = internal.ReferencesLenient
+			case "strict":
+				opts.References = internal.ReferencesStrict
+			default:
+				return errors.Errorf("unknown references mode %q: expected off, lenient or strict", references)
+			}
+
+			f := os.Stdin
+			if args[0] != "-" {
+				var err error
+				f, err = os.Open(args[0])
+				if err != nil {
+					return errors.Wrap(err, "problem opening file at "+args[0])
+				}
+				defer f.Close()
+			}
+
+			printer := progressPrinter{w: os.Stderr}
+			if progress {
+				opts.Progress = printer.update
 			}
-			defer f.Close()
-			if err := internal.Ingest(f, writer); err != nil {
+			report, err := internal.IngestWithReport(f, writer, opts)
+			if progress {
+				printer.done()
+			}
+			if report != nil {
+				if err := printReport(os.Stdout, *report, output); err != nil {
+					return errors.Wrap(err, "problem printing ingest report")
+				}
+			}
+			if err != nil {
 				return errors.Wrap(err, "problem ingesting file "+args[0])
 			}
 
@@ -26,4 +71,53 @@ func IngestCommand(writer internal.ResourceWriter) *cobra.Command {
 		},
 		Args: cobra.ExactArgs(1),
 	}
+	cmd.Flags().BoolVar(&opts.ContinueOnError, "continue-on-error", false, "keep ingesting remaining resources after one fails")
+	cmd.Flags().StringVarP(&output, "output", "o", "table", "format of the ingest report: table or json")
+	cmd.Flags().IntVar(&opts.Workers, "workers", 1, "number of resources written concurrently")
+	cmd.Flags().BoolVar(&progress, "progress", false, "print progress to stderr while ingesting")
+	cmd.Flags().StringVar(&references, "references", "lenient", "validation of references to other resources: off, lenient (warn) or strict (fail)")
+	return cmd
+}
+
+// progressPrinter overwrites a line of ingest progress on w, at most every progressInterval.
+type progressPrinter struct {
+	w       io.Writer
+	printed time.Time
+	latest  internal.IngestProgress
+}
+
+const progressInterval = 250 * time.Millisecond
+
+func (p *progressPrinter) update(progress internal.IngestProgress) {
+	p.latest = progress
+	if time.Since(p.printed) >= progressInterval {
+		p.print()
+	}
+}
+
+// done prints the final progress and ends the line.
+func (p *progressPrinter) done() {
+	p.print()
+	fmt.Fprintln(p.w)
+}
+
+func (p *progressPrinter) print() {
+	p.printed = time.Now()
+	fmt.Fprintf(p.w, "\rdecoded %d, written %d, failed %d", p.latest.Decoded, p.latest.Written, p.latest.Failed)
+}
+
+func printReport(w io.Writer, report internal.IngestReport, output string) error {
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tTYPE\tID\tOUTCOME\tERROR\tWARNINGS")
+	for _, entry := range report.Entries {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", entry.Index, entry.ResourceType, entry.ID, entry.Outcome, entry.Error,
+			strings.Join(entry.Warnings, "; "))
+	}
+	return tw.Flush()
 }
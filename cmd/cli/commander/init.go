@@ -3,18 +3,52 @@ package commander
 import (
 	"github.com/spf13/cobra"
 
-	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/datastore/backend"
 	"github.com/scraymondjr/appointment/internal"
 )
 
-func Root(store interface {
-	datastore.Store
-	internal.ResourceWriter
-}) *cobra.Command {
-	var root cobra.Command
+// Root returns the root command. The datastore configured by the config file, environment and persistent
+// flags is opened before, and closed after, running any subcommand; the configured survey is loaded and
+// published to it before.
+func Root() *cobra.Command {
+	store := &openedStore{}
+	survey := &internal.Survey{}
+
+	root := cobra.Command{
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			config, err := backend.Load(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			if *survey, err = backend.LoadSurvey(config); err != nil {
+				return err
+			}
+			s, err := backend.Open(config)
+			if err != nil {
+				return err
+			}
+			store.Store = s
+			if err := internal.PublishSurvey(s, *survey); err != nil {
+				s.Close()
+				return err
+			}
+			return nil
+		},
+		PersistentPostRunE: func(*cobra.Command, []string) error {
+			return store.Close()
+		},
+	}
+	backend.AddFlags(root.PersistentFlags())
 	root.AddCommand(
-		PatientCommand(store),
+		PatientCommand(store, survey),
 		IngestCommand(store),
 	)
 	return &root
 }
+
+// openedStore is handed to subcommands when they are created and is set to the opened datastore before they
+// run.
+type openedStore struct {
+	backend.Store
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/scraymondjr/appointment/cmd/cli/commander"
-	"github.com/scraymondjr/appointment/datastore/neo4j"
 )
 
 func main() {
-	store := neo4j.New()
-	cmd := commander.Root(store)
+	cmd := commander.Root()
 	if err := cmd.Execute(); err != nil {
-		panic(err)
+		// error already printed by cobra
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,109 @@
+// Package backend opens the datastore selected by configuration for the CLI and API entry points.
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/datastore/neo4j"
+	"github.com/scraymondjr/appointment/datastore/sqlite"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+// Names of the available datastores.
+const (
+	Neo4j  = "neo4j"
+	SQLite = "sqlite"
+	Memory = "memory"
+)
+
+// Store is an opened datastore, readable and transactionally writable, that must be closed after use.
+type Store interface {
+	datastore.Store
+	internal.TransactionalWriter
+	internal.ResourceLookup
+	internal.IdentifierLookup
+	io.Closer
+}
+
+// Config selects and configures the datastore to open.
+type Config struct {
+	// Datastore is the name of the datastore to open: neo4j, sqlite or memory.
+	Datastore string
+	// SQLitePath is the path to the database file of the sqlite datastore.
+	SQLitePath string
+	// Neo4j configures the connection of the neo4j datastore.
+	Neo4j neo4j.Config
+	// SurveyPath is the path to the JSON, or, if its extension is .yaml or .yml, YAML definition of the feedback
+	// survey, or "" for the default survey.
+	SurveyPath string
+}
+
+// DefaultConfig returns the Config used for settings not set by a config file, the environment or flags.
+func DefaultConfig() Config {
+	return Config{
+		Datastore:  Neo4j,
+		SQLitePath: "appointment.db",
+		Neo4j:      neo4j.DefaultConfig(),
+	}
+}
+
+// LoadSurvey returns the feedback survey read from c.SurveyPath, or the default survey if it is not set. A YAML
+// definition is read as the JSON it is equivalent to, see internal.ReadSurvey.
+func LoadSurvey(c Config) (internal.Survey, error) {
+	if c.SurveyPath == "" {
+		return internal.DefaultSurvey()
+	}
+	data, err := ioutil.ReadFile(c.SurveyPath)
+	if err != nil {
+		return internal.Survey{}, errors.Wrap(err, "problem opening survey "+c.SurveyPath)
+	}
+	switch strings.ToLower(filepath.Ext(c.SurveyPath)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return internal.Survey{}, errors.Wrap(err, "problem reading survey "+c.SurveyPath)
+		}
+	}
+	survey, err := internal.ReadSurvey(bytes.NewReader(data))
+	return survey, errors.Wrap(err, "problem reading survey "+c.SurveyPath)
+}
+
+// yamlToJSON returns the YAML document as JSON. Returns an error if a mapping has a key that is not a string.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, errors.Wrap(err, "problem decoding YAML")
+	}
+	data, err := json.Marshal(document)
+	return data, errors.Wrap(err, "problem converting YAML")
+}
+
+// Open opens the datastore selected by c.
+func Open(c Config) (Store, error) {
+	switch c.Datastore {
+	case Neo4j:
+		store, err := neo4j.New(c.Neo4j)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case SQLite:
+		store, err := sqlite.New(c.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case Memory:
+		return datastore.NewMemStore(), nil
+	default:
+		return nil, errors.Errorf("unknown datastore %q: expected %s, %s or %s", c.Datastore, Neo4j, SQLite, Memory)
+	}
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// Load returns the Config built from DefaultConfig, overridden in turn by the config file, the environment and
+// the flags explicitly set in flags. flags may be nil.
+//
+// The config file is read from the path given by the --config flag or the APPOINTMENT_CONFIG environment
+// variable. It is a JSON object with the keys datastore, sqlitePath, survey and neo4j, the latter an object with the keys
+// uri, username, password, bearerToken, database, maxConnectionPoolSize, connectionTimeout (e.g. "5s") and
+// caCertFile.
+func Load(flags *pflag.FlagSet) (Config, error) {
+	c := DefaultConfig()
+
+	path := os.Getenv("APPOINTMENT_CONFIG")
+	if flags != nil {
+		if f := flags.Lookup("config"); f != nil && f.Changed {
+			path = f.Value.String()
+		}
+	}
+	if path != "" {
+		if err := loadFile(path, &c); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := loadEnv(&c); err != nil {
+		return Config{}, err
+	}
+
+	if flags != nil {
+		// re-apply the flags the user set onto the loaded config, leaving the rest at the loaded values
+		bound := pflag.NewFlagSet("", pflag.ContinueOnError)
+		addFlags(bound, &c)
+		var err error
+		flags.Visit(func(f *pflag.Flag) {
+			if bound.Lookup(f.Name) != nil && err == nil {
+				err = bound.Set(f.Name, f.Value.String())
+			}
+		})
+		if err != nil {
+			return Config{}, errors.Wrap(err, "problem applying flags")
+		}
+	}
+
+	return c, nil
+}
+
+// AddFlags adds the flags read by Load to flags.
+func AddFlags(flags *pflag.FlagSet) {
+	defaults := DefaultConfig()
+	flags.String("config", "", "path to a JSON config file (env APPOINTMENT_CONFIG)")
+	addFlags(flags, &defaults)
+}
+
+func addFlags(flags *pflag.FlagSet, c *Config) {
+	flags.StringVar(&c.Datastore, "datastore", c.Datastore, "datastore to use: neo4j, sqlite or memory (env DATASTORE)")
+	flags.StringVar(&c.SQLitePath, "sqlite-path", c.SQLitePath, "path to the sqlite database file (env SQLITE_PATH)")
+	flags.StringVar(&c.SurveyPath, "survey", c.SurveyPath, "path to the JSON or YAML definition of the feedback survey (env SURVEY_PATH)")
+	flags.StringVar(&c.Neo4j.URI, "neo4j-uri", c.Neo4j.URI, "neo4j server URI (env NEO4J_TARGET)")
+	flags.StringVar(&c.Neo4j.Username, "neo4j-username", c.Neo4j.Username, "neo4j basic auth username (env NEO4J_USERNAME)")
+	flags.StringVar(&c.Neo4j.Password, "neo4j-password", c.Neo4j.Password, "neo4j basic auth password (env NEO4J_PASSWORD)")
+	flags.StringVar(&c.Neo4j.BearerToken, "neo4j-bearer-token", c.Neo4j.BearerToken, "neo4j bearer auth token (env NEO4J_BEARER_TOKEN)")
+	flags.StringVar(&c.Neo4j.Database, "neo4j-database", c.Neo4j.Database, "neo4j database name (env NEO4J_DATABASE)")
+	flags.IntVar(&c.Neo4j.MaxConnectionPoolSize, "neo4j-max-pool-size", c.Neo4j.MaxConnectionPoolSize, "maximum neo4j connections per server (env NEO4J_MAX_POOL_SIZE)")
+	flags.DurationVar(&c.Neo4j.ConnectionTimeout, "neo4j-connection-timeout", c.Neo4j.ConnectionTimeout, "neo4j connection timeout (env NEO4J_CONNECTION_TIMEOUT)")
+	flags.StringVar(&c.Neo4j.CACertFile, "neo4j-ca-cert-file", c.Neo4j.CACertFile, "PEM file of CA certificates trusted for neo4j TLS (env NEO4J_CA_CERT_FILE)")
+}
+
+// fileConfig is the format of the config file. Settings left out of the file keep their current value.
+type fileConfig struct {
+	Datastore  *string `json:"datastore"`
+	SQLitePath *string `json:"sqlitePath"`
+	SurveyPath *string `json:"survey"`
+	Neo4j      struct {
+		URI                   *string `json:"uri"`
+		Username              *string `json:"username"`
+		Password              *string `json:"password"`
+		BearerToken           *string `json:"bearerToken"`
+		Database              *string `json:"database"`
+		MaxConnectionPoolSize *int    `json:"maxConnectionPoolSize"`
+		ConnectionTimeout     *string `json:"connectionTimeout"` // e.g. "5s"
+		CACertFile            *string `json:"caCertFile"`
+	} `json:"neo4j"`
+}
+
+func loadFile(path string, c *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "problem opening config file "+path)
+	}
+	defer f.Close()
+
+	var fc fileConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fc); err != nil {
+		return errors.Wrap(err, "problem decoding config file "+path)
+	}
+
+	setString(&c.Datastore, fc.Datastore)
+	setString(&c.SQLitePath, fc.SQLitePath)
+	setString(&c.SurveyPath, fc.SurveyPath)
+	setString(&c.Neo4j.URI, fc.Neo4j.URI)
+	setString(&c.Neo4j.Username, fc.Neo4j.Username)
+	setString(&c.Neo4j.Password, fc.Neo4j.Password)
+	setString(&c.Neo4j.BearerToken, fc.Neo4j.BearerToken)
+	setString(&c.Neo4j.Database, fc.Neo4j.Database)
+	setString(&c.Neo4j.CACertFile, fc.Neo4j.CACertFile)
+	if fc.Neo4j.MaxConnectionPoolSize != nil {
+		c.Neo4j.MaxConnectionPoolSize = *fc.Neo4j.MaxConnectionPoolSize
+	}
+	if fc.Neo4j.ConnectionTimeout != nil {
+		timeout, err := time.ParseDuration(*fc.Neo4j.ConnectionTimeout)
+		if err != nil {
+			return errors.Wrap(err, "problem parsing neo4j.connectionTimeout in config file "+path)
+		}
+		c.Neo4j.ConnectionTimeout = timeout
+	}
+	return nil
+}
+
+func setString(dst *string, src *string) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+func loadEnv(c *Config) error {
+	for name, dst := range map[string]*string{
+		"DATASTORE":          &c.Datastore,
+		"SQLITE_PATH":        &c.SQLitePath,
+		"SURVEY_PATH":        &c.SurveyPath,
+		"NEO4J_TARGET":       &c.Neo4j.URI,
+		"NEO4J_USERNAME":     &c.Neo4j.Username,
+		"NEO4J_PASSWORD":     &c.Neo4j.Password,
+		"NEO4J_BEARER_TOKEN": &c.Neo4j.BearerToken,
+		"NEO4J_DATABASE":     &c.Neo4j.Database,
+		"NEO4J_CA_CERT_FILE": &c.Neo4j.CACertFile,
+	} {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	if v, ok := os.LookupEnv("NEO4J_MAX_POOL_SIZE"); ok {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.Wrap(err, "problem parsing NEO4J_MAX_POOL_SIZE")
+		}
+		c.Neo4j.MaxConnectionPoolSize = size
+	}
+	if v, ok := os.LookupEnv("NEO4J_CONNECTION_TIMEOUT"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Wrap(err, "problem parsing NEO4J_CONNECTION_TIMEOUT")
+		}
+		c.Neo4j.ConnectionTimeout = timeout
+	}
+	return nil
+}
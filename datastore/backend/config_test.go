@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/internal"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{
+		"datastore": "sqlite",
+		"sqlitePath": "file.db",
+		"survey": "survey.json",
+		"neo4j": {
+			"uri": "neo4j://file:7687",
+			"username": "file-user",
+			"connectionTimeout": "30s"
+		}
+	}`), 0600))
+
+	for name, value := range map[string]string{
+		"APPOINTMENT_CONFIG": path,
+		"SQLITE_PATH":        "env.db",
+		"NEO4J_USERNAME":     "env-user",
+	} {
+		require.NoError(t, os.Setenv(name, value))
+		defer os.Unsetenv(name)
+	}
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--neo4j-username", "flag-user"}))
+
+	c, err := Load(flags)
+	require.NoError(t, err)
+
+	expected := DefaultConfig()
+	expected.Datastore = "sqlite"            // file
+	expected.SQLitePath = "env.db"           // env overrides file
+	expected.SurveyPath = "survey.json"      // file
+	expected.Neo4j.URI = "neo4j://file:7687" // file
+	expected.Neo4j.Username = "flag-user"    // flag overrides env and file
+	expected.Neo4j.ConnectionTimeout = 30 * time.Second
+	assert.Equal(t, expected, c)
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	require.NoError(t, os.Setenv("NEO4J_CONNECTION_TIMEOUT", "soon"))
+	defer os.Unsetenv("NEO4J_CONNECTION_TIMEOUT")
+
+	_, err := Load(nil)
+	assert.Error(t, err)
+}
+
+func TestLoadSurvey(t *testing.T) {
+	survey, err := LoadSurvey(DefaultConfig())
+	require.NoError(t, err)
+	assert.Equal(t, internal.DefaultSurveyID, survey.ID)
+
+	path := filepath.Join(t.TempDir(), "survey.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"id": "short", "version": 1, "questions": [{"id": "q1", "type": "yesNo", "text": "Was it quick?"}]}`), 0600))
+	survey, err = LoadSurvey(Config{SurveyPath: path})
+	require.NoError(t, err)
+	assert.Equal(t, "short", survey.ID)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"id": "broken", "version": 1, "questions": [{"id": "q1", "type": "stars", "text": "Rate us"}]}`), 0600))
+	_, err = LoadSurvey(Config{SurveyPath: path})
+	assert.EqualError(t, err, `problem reading survey `+path+`: invalid survey broken: question q1: unknown type "stars"`)
+
+	path = filepath.Join(t.TempDir(), "survey.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`
+id: short
+version: 2
+questions:
+  - id: q1
+    type: scale
+    min: 1
+    max: 5
+    text: How quick was it?
+  - id: q2
+    type: text
+    text: What took long?
+    when: {question: q1, max: 2}
+`), 0600))
+	survey, err = LoadSurvey(Config{SurveyPath: path})
+	require.NoError(t, err)
+	assert.Equal(t, 2, survey.Version)
+	require.Len(t, survey.Questions, 2)
+	assert.Equal(t, &internal.Condition{Question: "q1", Max: intPtr(2)}, survey.Questions[1].When)
+
+	// unknown fields are refused as in JSON
+	require.NoError(t, ioutil.WriteFile(path, []byte("id: short\nversion: 1\ncolour: blue\n"), 0600))
+	_, err = LoadSurvey(Config{SurveyPath: path})
+	assert.EqualError(t, err, `problem reading survey `+path+`: problem decoding survey: json: unknown field "colour"`)
+}
+
+func intPtr(n int) *int { return &n }
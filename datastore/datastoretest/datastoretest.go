@@ -0,0 +1,762 @@
+// Package datastoretest provides a conformance suite describing how a datastore.Store must behave. Every
+// backend runs the suite from its own tests so they stay interchangeable.
+package datastoretest
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+// Store is a datastore under test: it must be readable as a datastore.Store and writable as an
+// internal.ResourceWriter.
+type Store interface {
+	datastore.Store
+	internal.ResourceWriter
+}
+
+// Run runs every conformance test as a subtest of t. newStore is called once per subtest; it may return a
+// store shared with other subtests since each subtest writes resources under freshly generated ids.
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+var tests = []struct {
+	name string
+	test func(t *testing.T, store Store)
+}{
+	{"patient not found", func(t *testing.T, store Store) {
+		patient, err := store.GetPatient(newID())
+		require.NoError(t, err)
+		assert.Nil(t, patient)
+	}},
+	{"doctor not found", func(t *testing.T, store Store) {
+		doctor, err := store.GetDoctor(newID())
+		require.NoError(t, err)
+		assert.Nil(t, doctor)
+	}},
+	{"appointment not found", func(t *testing.T, store Store) {
+		appointment, err := store.GetAppointment(newID())
+		require.NoError(t, err)
+		assert.Nil(t, appointment)
+	}},
+	{"feedback not found", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		feedback, err := store.GetPatientFeedback(f.Appointment.ID())
+		require.NoError(t, err)
+		assert.Nil(t, feedback)
+		feedback, err = store.GetFeedback(newID())
+		require.NoError(t, err)
+		assert.Nil(t, feedback)
+	}},
+	{"no appointments for unknown patient", func(t *testing.T, store Store) {
+		appointments, err := store.GetPatientAppointments(newID())
+		require.NoError(t, err)
+		assert.Empty(t, appointments)
+	}},
+	{"patient round-trip", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		require.NotNil(t, patient)
+		assert.Equal(t, f.Patient.ResourceTypeAndID, patient.ResourceTypeAndID)
+		assert.Equal(t, f.Patient.Identifiers, patient.Identifiers)
+		assertName(t, f.Patient.Name, patient.Name)
+		assert.Equal(t, f.Patient.Active, patient.Active)
+		assert.Equal(t, f.Patient.Gender, patient.Gender)
+		assert.Equal(t, f.Patient.BirthDate, patient.BirthDate)
+		assert.Equal(t, f.Patient.Telecom, patient.Telecom)
+		assert.Equal(t, f.Patient.Address, patient.Address)
+		assert.Equal(t, f.Patient.Contacts, patient.Contacts)
+	}},
+	{"patient without demographics", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		f.Patient.Active, f.Patient.Gender, f.Patient.BirthDate = nil, "", ""
+		f.Patient.Telecom, f.Patient.Address, f.Patient.Contacts = nil, nil, nil
+		require.NoError(t, store.WritePatient(f.Patient))
+
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		require.NotNil(t, patient)
+		assert.Nil(t, patient.Active)
+		assert.Empty(t, patient.Gender)
+		assert.Empty(t, patient.BirthDate)
+		assert.Empty(t, patient.Telecom)
+		assert.Empty(t, patient.Address)
+		assert.Empty(t, patient.Contacts)
+	}},
+	{"doctor round-trip", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		doctor, err := store.GetDoctor(f.Doctor.ID())
+		require.NoError(t, err)
+		require.NotNil(t, doctor)
+		assert.Equal(t, f.Doctor.ResourceTypeAndID, doctor.ResourceTypeAndID)
+		assert.Equal(t, f.Doctor.Identifiers, doctor.Identifiers)
+		assertName(t, f.Doctor.Name, doctor.Name)
+	}},
+	{"doctor roles", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		inactive := false
+		roles := []internal.PractitionerRole{
+			{
+				ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "PractitionerRole"},
+				Practitioner:      internal.Reference{ResourceID: f.Doctor.ID(), ResourceType: "Doctor"},
+				Specialty:         []internal.CodeableConcept{{Coding: []internal.Coding{{System: internal.CodeSystemSNOMED, Code: "394583002", Display: "Endocrinology"}}}},
+			},
+			{
+				ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "PractitionerRole"},
+				Active:            &inactive,
+				Practitioner:      internal.Reference{ResourceID: f.Doctor.ID(), ResourceType: "Doctor"},
+				Specialty:         []internal.CodeableConcept{{Text: "General practice"}},
+			},
+		}
+		for _, role := range roles {
+			require.NoError(t, store.WritePractitionerRole(role))
+		}
+		sort.Slice(roles, func(i, j int) bool {
+			return roles[i].ID() < roles[j].ID()
+		})
+
+		doctor, err := store.GetDoctor(f.Doctor.ID())
+		require.NoError(t, err)
+		require.NotNil(t, doctor)
+		assert.Equal(t, roles, doctor.Roles)
+
+		// roles of other doctors are not included
+		other, err := store.GetDoctor(writeFixture(t, store).Doctor.ID())
+		require.NoError(t, err)
+		require.NotNil(t, other)
+		assert.Empty(t, other.Roles)
+
+		if lookup, ok := store.(internal.ResourceLookup); ok {
+			exists, err := lookup.HasResource("PractitionerRole", roles[0].ID())
+			require.NoError(t, err)
+			assert.True(t, exists)
+		}
+	}},
+	{"appointment carries references and diagnosis", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		appointment, err := store.GetAppointment(f.Appointment.ID())
+		require.NoError(t, err)
+		require.NotNil(t, appointment)
+		assertAppointment(t, f, *appointment)
+		assert.Nil(t, appointment.Feedback)
+	}},
+	{"patient appointments", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		other := writeFixture(t, store)
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assertAppointment(t, f, appointments[0])
+
+		appointments, err = store.GetPatientAppointments(other.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assertAppointment(t, other, appointments[0])
+	}},
+	{"patient appointments in chronological order", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		start := *f.Appointment.Period.Start
+
+		earlier := f.Appointment
+		earlier.ResourceID = newID()
+		earlier.Period = period(start.Add(-24*time.Hour), time.Hour)
+		unscheduled := f.Appointment
+		unscheduled.ResourceID = newID()
+		unscheduled.Period = internal.Period{}
+		for _, appointment := range []internal.Appointment{unscheduled, earlier} {
+			require.NoError(t, store.WriteAppointment(appointment))
+		}
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		var ids []string
+		for _, appointment := range appointments {
+			ids = append(ids, appointment.ID())
+		}
+		assert.Equal(t, []string{earlier.ID(), f.Appointment.ID(), unscheduled.ID()}, ids)
+	}},
+	{"rewrite replaces resource", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+
+		f.Patient.Name = []internal.Name{{Family: "Renamed", Given: []string{"Tendo"}}}
+		require.NoError(t, store.WritePatient(f.Patient))
+		f.Appointment.Status = "cancelled"
+		require.NoError(t, store.WriteAppointment(f.Appointment))
+
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		require.NotNil(t, patient)
+		assertName(t, f.Patient.Name, patient.Name)
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assertAppointment(t, f, appointments[0])
+	}},
+	{"appointment written before its patient", func(t *testing.T, store Store) {
+		f := newFixture()
+		require.NoError(t, store.WriteAppointment(f.Appointment))
+		require.NoError(t, store.WriteDiagnosis(f.Diagnosis))
+		require.NoError(t, store.WritePatient(f.Patient))
+		require.NoError(t, store.WriteDoctor(f.Doctor))
+
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		require.NotNil(t, patient)
+		assertName(t, f.Patient.Name, patient.Name)
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assertAppointment(t, f, appointments[0])
+	}},
+	{"resources known only by reference not found", func(t *testing.T, store Store) {
+		f := newFixture()
+		require.NoError(t, store.WriteAppointment(f.Appointment))
+		require.NoError(t, store.WriteDiagnosis(f.Diagnosis))
+
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		assert.Nil(t, patient)
+		doctor, err := store.GetDoctor(f.Doctor.ID())
+		require.NoError(t, err)
+		assert.Nil(t, doctor)
+	}},
+	{"transaction commits", func(t *testing.T, store Store) {
+		transactional := requireTransactional(t, store)
+		f := newFixture()
+		err := transactional.WriteTransaction(func(tx internal.ResourceWriter) error {
+			if err := tx.WritePatient(f.Patient); err != nil {
+				return err
+			}
+			if err := tx.WriteDoctor(f.Doctor); err != nil {
+				return err
+			}
+			if err := tx.WriteAppointment(f.Appointment); err != nil {
+				return err
+			}
+			return tx.WriteDiagnosis(f.Diagnosis)
+		})
+		require.NoError(t, err)
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assertAppointment(t, f, appointments[0])
+	}},
+	{"transaction rolls back", func(t *testing.T, store Store) {
+		transactional := requireTransactional(t, store)
+		f := newFixture()
+		err := transactional.WriteTransaction(func(tx internal.ResourceWriter) error {
+			if err := tx.WritePatient(f.Patient); err != nil {
+				return err
+			}
+			return errors.New("abort")
+		})
+		require.EqualError(t, err, "abort")
+
+		patient, err := store.GetPatient(f.Patient.ID())
+		require.NoError(t, err)
+		assert.Nil(t, patient)
+	}},
+	{"has resource", func(t *testing.T, store Store) {
+		lookup, ok := store.(internal.ResourceLookup)
+		if !ok {
+			t.Skip("store does not implement ResourceLookup")
+		}
+		f := newFixture()
+		require.NoError(t, store.WriteAppointment(f.Appointment))
+
+		exists, err := lookup.HasResource("Appointment", f.Appointment.ID())
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		// the appointment refers to the patient, but the patient itself has not been written
+		exists, err = lookup.HasResource("Patient", f.Patient.ID())
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		require.NoError(t, store.WritePatient(f.Patient))
+		exists, err = lookup.HasResource("Patient", f.Patient.ID())
+		require.NoError(t, err)
+		assert.True(t, exists)
+	}},
+	{"find by identifier", func(t *testing.T, store Store) {
+		lookup, ok := store.(internal.IdentifierLookup)
+		if !ok {
+			t.Skip("store does not implement IdentifierLookup")
+		}
+		f := writeFixture(t, store)
+
+		id, err := lookup.FindByIdentifier("Patient", f.Patient.Identifiers[1])
+		require.NoError(t, err)
+		assert.Equal(t, f.Patient.ID(), id)
+
+		id, err = lookup.FindByIdentifier("Doctor", f.Doctor.Identifiers[0])
+		require.NoError(t, err)
+		assert.Equal(t, f.Doctor.ID(), id)
+
+		// identifiers are scoped by resource type
+		id, err = lookup.FindByIdentifier("Doctor", f.Patient.Identifiers[0])
+		require.NoError(t, err)
+		assert.Empty(t, id)
+
+		// rewriting the patient without the identifier removes it
+		removed := f.Patient.Identifiers[1]
+		f.Patient.Identifiers = f.Patient.Identifiers[:1]
+		require.NoError(t, store.WritePatient(f.Patient))
+		id, err = lookup.FindByIdentifier("Patient", removed)
+		require.NoError(t, err)
+		assert.Empty(t, id)
+	}},
+	{"diagnoses by code", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		// a diagnosis of another appointment with the same SNOMED code but a different ICD-10 code
+		other := newFixture()
+		other.Diagnosis.Appointment = internal.Reference{ResourceID: f.Appointment.ID(), ResourceType: "Appointment"}
+		other.Diagnosis.Code.Coding[0].Code = "E11.65"
+		require.NoError(t, store.WriteDiagnosis(other.Diagnosis))
+
+		diagnoses, err := store.GetDiagnosesByCode(internal.CodeSystemICD10, "E11.9")
+		require.NoError(t, err)
+		assert.Contains(t, diagnosisIDs(diagnoses), f.Diagnosis.ID())
+		assert.NotContains(t, diagnosisIDs(diagnoses), other.Diagnosis.ID())
+		for _, diagnosis := range diagnoses {
+			if diagnosis.ID() == f.Diagnosis.ID() {
+				assert.Equal(t, f.Diagnosis.Code, diagnosis.Code)
+				assert.Equal(t, f.Diagnosis.Status, diagnosis.Status)
+				assert.Equal(t, f.Diagnosis.Appointment, diagnosis.Appointment)
+			}
+		}
+
+		diagnoses, err = store.GetDiagnosesByCode(internal.CodeSystemSNOMED, "44054006")
+		require.NoError(t, err)
+		assert.Contains(t, diagnosisIDs(diagnoses), f.Diagnosis.ID())
+		assert.Contains(t, diagnosisIDs(diagnoses), other.Diagnosis.ID())
+
+		// the code must be in the system
+		diagnoses, err = store.GetDiagnosesByCode(internal.CodeSystemSNOMED, "E11.9")
+		require.NoError(t, err)
+		assert.NotContains(t, diagnosisIDs(diagnoses), f.Diagnosis.ID())
+	}},
+	{"appointment diagnoses in rank order", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		unranked := newFixture().Diagnosis
+		unranked.Appointment = f.Diagnosis.Appointment
+		unranked.Rank = 0
+		unranked.Code = internal.CodeableConcept{Text: "Hypertension"}
+		secondary := newFixture().Diagnosis
+		secondary.Appointment = f.Diagnosis.Appointment
+		secondary.Rank = 2
+		secondary.Code = internal.CodeableConcept{Text: "Obesity"}
+		require.NoError(t, store.WriteDiagnosis(unranked))
+		require.NoError(t, store.WriteDiagnosis(secondary))
+
+		expected := []internal.Diagnosis{f.Diagnosis, secondary, unranked}
+		appointment, err := store.GetAppointment(f.Appointment.ID())
+		require.NoError(t, err)
+		require.NotNil(t, appointment)
+		assert.Equal(t, expected, appointment.Diagnoses)
+		require.NotNil(t, appointment.PrimaryDiagnosis())
+		assert.Equal(t, f.Diagnosis.ID(), appointment.PrimaryDiagnosis().ID())
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assert.Equal(t, expected, appointments[0].Diagnoses)
+	}},
+	{"diagnoses linked through encounter", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		encounter := internal.Encounter{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Encounter"},
+			Status:            "finished",
+			Subject:           f.Appointment.Subject,
+			BasedOn:           []internal.Reference{{ResourceID: f.Appointment.ID(), ResourceType: "Appointment"}},
+		}
+		// one condition is written before the encounter listing it, the other after, naming the encounter
+		before := newFixture().Diagnosis
+		before.Appointment = internal.Reference{}
+		before.Rank = 0
+		before.Code = internal.CodeableConcept{Text: "Hypertension"}
+		after := newFixture().Diagnosis
+		after.Appointment = internal.Reference{}
+		after.Rank = 0
+		after.Code = internal.CodeableConcept{Text: "Obesity"}
+		after.Encounter = &internal.Reference{ResourceID: encounter.ID(), ResourceType: "Encounter"}
+		encounter.Diagnoses = []internal.EncounterDiagnosis{
+			{Condition: internal.Reference{ResourceID: before.ID(), ResourceType: "Diagnosis"}, Rank: 2},
+			{Condition: internal.Reference{ResourceID: after.ID(), ResourceType: "Diagnosis"}, Rank: 3},
+		}
+		require.NoError(t, store.WriteDiagnosis(before))
+		require.NoError(t, store.WriteEncounter(encounter))
+		require.NoError(t, store.WriteDiagnosis(after))
+
+		before.Appointment = f.Diagnosis.Appointment
+		before.Rank = 2
+		after.Appointment = f.Diagnosis.Appointment
+		after.Rank = 3
+		appointment, err := store.GetAppointment(f.Appointment.ID())
+		require.NoError(t, err)
+		require.NotNil(t, appointment)
+		assert.Equal(t, []internal.Diagnosis{f.Diagnosis, before, after}, appointment.Diagnoses)
+
+		if lookup, ok := store.(internal.ResourceLookup); ok {
+			exists, err := lookup.HasResource("Encounter", encounter.ID())
+			require.NoError(t, err)
+			assert.True(t, exists)
+		}
+	}},
+	{"feedback round-trip", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		recommend, explained, feeling, visit := 8, true, "relieved", "follow-up"
+		feedback := internal.Feedback{
+			Survey:        "custom-survey",
+			SurveyVersion: 4,
+			Answers: map[string]internal.Answer{
+				"recommend": {Number: &recommend},
+				"explained": {Bool: &explained},
+				"feeling":   {Text: &feeling},
+				"visit":     {Text: &visit},
+				"topics":    {Choices: []string{"diet", "medication"}},
+				"none":      {Choices: []string{}},
+			},
+			Diagnosis: &internal.Reference{ResourceID: f.Diagnosis.ID(), ResourceType: "Diagnosis"},
+			Author:    &internal.Reference{ResourceID: f.Patient.ID(), ResourceType: "Patient"},
+			Channel:   internal.FeedbackChannelSMS,
+		}
+		saved, err := store.SavePatientFeedback(f.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		require.NotNil(t, saved)
+		assert.Equal(t, "Feedback", saved.Type())
+		assert.NotEmpty(t, saved.ID())
+		require.NotNil(t, saved.CreatedAt)
+		assert.Equal(t, saved.CreatedAt, saved.UpdatedAt)
+		feedback.ResourceTypeAndID = saved.ResourceTypeAndID
+		feedback.Appointment = internal.Reference{ResourceID: f.Appointment.ID(), ResourceType: "Appointment"}
+		feedback.CreatedAt, feedback.UpdatedAt = saved.CreatedAt, saved.UpdatedAt
+		assert.Equal(t, feedback, *saved)
+
+		got, err := store.GetPatientFeedback(f.Appointment.ID())
+		require.NoError(t, err)
+		assert.Equal(t, saved, got)
+		got, err = store.GetFeedback(saved.ID())
+		require.NoError(t, err)
+		assert.Equal(t, saved, got)
+
+		appointment, err := store.GetAppointment(f.Appointment.ID())
+		require.NoError(t, err)
+		require.NotNil(t, appointment)
+		assert.Equal(t, &internal.Reference{ResourceID: saved.ID(), ResourceType: "Feedback"}, appointment.Feedback)
+
+		appointments, err := store.GetPatientAppointments(f.Patient.ID())
+		require.NoError(t, err)
+		require.Len(t, appointments, 1)
+		assert.Equal(t, appointment.Feedback, appointments[0].Feedback)
+	}},
+	{"feedback replaced", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		first, err := store.SavePatientFeedback(f.Appointment.ID(), internal.LegacyFeedback(3, false, "confused"))
+		require.NoError(t, err)
+
+		feedback := internal.LegacyFeedback(9, true, "relieved")
+		feedback.Channel = internal.FeedbackChannelWeb
+		second, err := store.SavePatientFeedback(f.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		assert.Equal(t, first.ID(), second.ID())
+		assert.Equal(t, first.CreatedAt, second.CreatedAt)
+		assert.False(t, second.UpdatedAt.Before(*first.UpdatedAt))
+		assert.Equal(t, feedback.Answers, second.Answers)
+		assert.Equal(t, internal.FeedbackChannelWeb, second.Channel)
+
+		got, err := store.GetFeedback(first.ID())
+		require.NoError(t, err)
+		assert.Equal(t, second, got)
+	}},
+	{"feedback keeps supplied id and creation time", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		createdAt := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+		feedback := internal.LegacyFeedback(3, false, "confused")
+		feedback.ResourceTypeAndID = internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Feedback"}
+		feedback.CreatedAt = &createdAt
+		first, err := store.SavePatientFeedback(f.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		assert.Equal(t, feedback.ID(), first.ID())
+		require.NotNil(t, first.CreatedAt)
+		assert.True(t, createdAt.Equal(*first.CreatedAt), first.CreatedAt)
+		assert.True(t, first.UpdatedAt.After(createdAt))
+
+		// replacing feedback keeps its id and creation time over those supplied
+		later := createdAt.Add(time.Hour)
+		feedback.ResourceID, feedback.CreatedAt = newID(), &later
+		second, err := store.SavePatientFeedback(f.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		assert.Equal(t, first.ID(), second.ID())
+		assert.True(t, createdAt.Equal(*second.CreatedAt), second.CreatedAt)
+
+		// the id of the feedback about another appointment is not taken over
+		other := writeFixture(t, store)
+		feedback.ResourceID = first.ID()
+		_, err = store.SavePatientFeedback(other.Appointment.ID(), feedback)
+		assert.Equal(t, internal.ErrFeedbackIDTaken, errors.Cause(err), err)
+		got, err := store.GetFeedback(first.ID())
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, f.Appointment.ID(), got.Appointment.ResourceID)
+
+		// unless that appointment has feedback already, whose id is kept
+		feedback.ResourceID = ""
+		replaced, err := store.SavePatientFeedback(other.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		feedback.ResourceID = first.ID()
+		replacedAgain, err := store.SavePatientFeedback(other.Appointment.ID(), feedback)
+		require.NoError(t, err)
+		assert.Equal(t, replaced.ID(), replacedAgain.ID())
+	}},
+	{"feedback for unknown appointment", func(t *testing.T, store Store) {
+		_, err := store.SavePatientFeedback(newID(), internal.LegacyFeedback(3, false, "confused"))
+		assert.Error(t, err)
+
+		// an appointment known only by reference
+		f := newFixture()
+		require.NoError(t, store.WriteDiagnosis(f.Diagnosis))
+		_, err = store.SavePatientFeedback(f.Appointment.ID(), internal.LegacyFeedback(3, false, "confused"))
+		assert.EqualError(t, err, "appointment "+f.Appointment.ID()+" not found")
+		feedback, err := store.GetPatientFeedback(f.Appointment.ID())
+		require.NoError(t, err)
+		assert.Nil(t, feedback)
+	}},
+	{"questionnaire and response written in a transaction", func(t *testing.T, store Store) {
+		f := writeFixture(t, store)
+		survey := internal.Survey{ID: newID(), Version: 1, Questions: []internal.Question{
+			{ID: "seen", Type: internal.QuestionYesNo, Text: "Were you seen on time?"},
+		}}
+		questionnaire, err := survey.Questionnaire()
+		require.NoError(t, err)
+		seen := true
+		response := internal.Feedback{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Feedback"},
+			Survey:            survey.ID,
+			SurveyVersion:     survey.Version,
+			Answers:           map[string]internal.Answer{"seen": {Bool: &seen}},
+		}.QuestionnaireResponse(f.Appointment, survey)
+
+		require.NoError(t, internal.WriteResource(internal.Bundle{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Bundle"},
+			BundleType:        internal.BundleTypeTransaction,
+			Resources:         internal.BundledResources{questionnaire, response},
+		}, store))
+
+		saved, err := store.GetSurvey(survey.ID, survey.Version)
+		require.NoError(t, err)
+		assert.Equal(t, &survey, saved)
+		feedback, err := store.GetPatientFeedback(f.Appointment.ID())
+		require.NoError(t, err)
+		require.NotNil(t, feedback)
+		assert.Equal(t, survey.ID, feedback.Survey)
+		assert.Equal(t, &seen, feedback.Answers["seen"].Bool)
+
+		// a response to a survey version that has not been saved rolls the transaction back
+		response.Questionnaire = internal.SurveyCanonical(survey.ID, 2)
+		require.Error(t, internal.WriteResource(internal.Bundle{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Bundle"},
+			BundleType:        internal.BundleTypeTransaction,
+			Resources:         internal.BundledResources{response},
+		}, store))
+	}},
+	{"survey versions", func(t *testing.T, store Store) {
+		id := newID()
+		v1 := internal.Survey{ID: id, Version: 1, Title: "Visit", Questions: []internal.Question{
+			{ID: "rating", Type: internal.QuestionScale, Min: 1, Max: 5, Text: "How was your visit?"},
+		}}
+		v2 := v1
+		v2.Version = 2
+		v2.Questions = []internal.Question{
+			{ID: "rating", Type: internal.QuestionScale, Min: 1, Max: 10, Text: "How was your visit with Dr {{.Doctor}}?"},
+			{ID: "again", Type: internal.QuestionYesNo, Text: "Would you come again?", Optional: true},
+		}
+		require.NoError(t, store.SaveSurvey(v1))
+		require.NoError(t, store.SaveSurvey(v2))
+
+		saved, err := store.GetSurvey(id, 1)
+		require.NoError(t, err)
+		require.NotNil(t, saved)
+		assert.Equal(t, v1, *saved)
+		saved, err = store.GetSurvey(id, 2)
+		require.NoError(t, err)
+		require.NotNil(t, saved)
+		assert.Equal(t, v2, *saved)
+
+		// a saved version is immutable
+		changed := v1
+		changed.Title = "Changed"
+		require.NoError(t, store.SaveSurvey(changed))
+		saved, err = store.GetSurvey(id, 1)
+		require.NoError(t, err)
+		require.NotNil(t, saved)
+		assert.Equal(t, v1, *saved)
+		assert.Error(t, internal.PublishSurvey(store, changed))
+		assert.NoError(t, internal.PublishSurvey(store, v2))
+
+		saved, err = store.GetSurvey(id, 3)
+		require.NoError(t, err)
+		assert.Nil(t, saved)
+	}},
+}
+
+// fixture is a patient with one diagnosed appointment with a doctor.
+type fixture struct {
+	Patient     internal.Patient
+	Doctor      internal.Doctor
+	Appointment internal.Appointment
+	Diagnosis   internal.Diagnosis
+}
+
+func writeFixture(t *testing.T, store Store) fixture {
+	t.Helper()
+
+	f := newFixture()
+	require.NoError(t, store.WritePatient(f.Patient))
+	require.NoError(t, store.WriteDoctor(f.Doctor))
+	require.NoError(t, store.WriteAppointment(f.Appointment))
+	require.NoError(t, store.WriteDiagnosis(f.Diagnosis))
+	return f
+}
+
+func newFixture() fixture {
+	var f fixture
+	active := true
+	f.Patient = internal.Patient{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Patient"},
+		Identifiers: []internal.Identifier{
+			{System: "urn:oid:2.16.840.1.113883.4.1", Value: newID()},
+			{System: "http://hospital.example.org/mrn", Value: newID()},
+		},
+		Active:    &active,
+		Name:      []internal.Name{{Family: "Tenderson", Given: []string{"Tendo"}}},
+		Gender:    "female",
+		BirthDate: "1955-01-06",
+		Telecom: []internal.ContactPoint{
+			{System: "phone", Value: "555-555-2021", Use: "mobile"},
+			{System: "email", Value: "tendo@tendoco.com", Use: "work", Rank: 1},
+		},
+		Address: []internal.Address{{Use: "home", Line: []string{"2222 Home Street"}, City: "Springfield", PostalCode: "12345"}},
+		Contacts: []internal.PatientContact{{
+			Relationship: []internal.CodeableConcept{{
+				Coding: []internal.Coding{{System: "http://terminology.hl7.org/CodeSystem/v2-0131", Code: "N", Display: "Next-of-Kin"}},
+			}},
+			Name:    &internal.Name{Family: "Tenderson", Given: []string{"Tina"}},
+			Telecom: []internal.ContactPoint{{System: "phone", Value: "555-555-2022"}},
+		}},
+	}
+	f.Doctor = internal.Doctor{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Doctor"},
+		Identifiers:       []internal.Identifier{{System: "http://hl7.org/fhir/sid/us-npi", Value: newID()}},
+		Name:              []internal.Name{{Family: "Careful", Given: []string{"Adam"}}},
+	}
+	f.Appointment = internal.Appointment{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Appointment"},
+		Status:            "finished",
+		Description:       "Follow-up on blood sugar",
+		AppointmentType:   []internal.CodeableConcept{{Text: "Endocrinologist visit"}},
+		Period:            period(time.Date(2021, 4, 2, 11, 30, 0, 0, time.UTC), 30*time.Minute),
+		Location:          &internal.Reference{ResourceID: "clinic", ResourceType: "Location"},
+		Subject:           internal.Reference{ResourceID: f.Patient.ID(), ResourceType: "Patient"},
+		Actor:             internal.Reference{ResourceID: f.Doctor.ID(), ResourceType: "Doctor"},
+		Participants: []internal.Participant{
+			{Actor: internal.Reference{ResourceID: f.Patient.ID(), ResourceType: "Patient"}, Status: "accepted"},
+			{Actor: internal.Reference{ResourceID: f.Doctor.ID(), ResourceType: "Doctor"}, Required: "required", Status: "accepted"},
+		},
+	}
+	f.Diagnosis = internal.Diagnosis{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: newID(), ResourceType: "Diagnosis"},
+		Status:            "final",
+		Code: internal.CodeableConcept{
+			Coding: []internal.Coding{
+				{System: internal.CodeSystemICD10, Code: "E11.9", Display: "Type 2 diabetes mellitus without complications"},
+				{System: internal.CodeSystemSNOMED, Code: "44054006", Display: "Diabetes mellitus type 2"},
+			},
+			Text: "Diabetes without complications",
+		},
+		Appointment: internal.Reference{ResourceID: f.Appointment.ID(), ResourceType: "Appointment"},
+		Rank:        1,
+	}
+	return f
+}
+
+// period returns the period starting at start and lasting d.
+func period(start time.Time, d time.Duration) internal.Period {
+	end := start.Add(d)
+	return internal.Period{Start: &start, End: &end}
+}
+
+func requireTransactional(t *testing.T, store Store) internal.TransactionalWriter {
+	t.Helper()
+	transactional, ok := store.(internal.TransactionalWriter)
+	if !ok {
+		t.Skip("store does not support transactions")
+	}
+	return transactional
+}
+
+func assertName(t *testing.T, expected, actual []internal.Name) {
+	t.Helper()
+	require.Len(t, actual, len(expected))
+	for i := range expected {
+		assert.Equal(t, expected[i].Family, actual[i].Family)
+		assert.Equal(t, expected[i].Given, actual[i].Given)
+	}
+}
+
+func assertAppointment(t *testing.T, f fixture, appointment internal.Appointment) {
+	t.Helper()
+	assert.Equal(t, f.Appointment.ResourceTypeAndID, appointment.ResourceTypeAndID)
+	assert.Equal(t, f.Appointment.Status, appointment.Status)
+	assert.Equal(t, f.Appointment.Description, appointment.Description)
+	assert.Equal(t, f.Appointment.AppointmentType, appointment.AppointmentType)
+	assertTime(t, f.Appointment.Period.Start, appointment.Period.Start)
+	assertTime(t, f.Appointment.Period.End, appointment.Period.End)
+	assert.Equal(t, f.Appointment.Location, appointment.Location)
+	assert.Equal(t, f.Appointment.Participants, appointment.Participants)
+	assert.Equal(t, f.Appointment.Subject, appointment.Subject)
+	assert.Equal(t, f.Appointment.Actor, appointment.Actor)
+	require.Len(t, appointment.Diagnoses, 1)
+	assert.Equal(t, f.Diagnosis, appointment.Diagnoses[0])
+}
+
+func diagnosisIDs(diagnoses []internal.Diagnosis) []string {
+	ids := make([]string, len(diagnoses))
+	for i, diagnosis := range diagnoses {
+		ids[i] = diagnosis.ID()
+	}
+	return ids
+}
+
+// assertTime asserts that the times are both nil or the same instant, whatever their location.
+func assertTime(t *testing.T, expected, actual *time.Time) {
+	t.Helper()
+	if expected == nil || actual == nil {
+		assert.Equal(t, expected, actual)
+		return
+	}
+	assert.True(t, expected.Equal(*actual), "expected %s, actual %s", expected, actual)
+}
+
+func newID() string {
+	return uuid.New().String()
+}
@@ -0,0 +1,77 @@
+package neo4j
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"github.com/pkg/errors"
+)
+
+// Config configures the connection to the Neo4j server.
+//
+// Encryption is selected by the scheme of URI: neo4j+s and bolt+s require TLS with a certificate trusted by the
+// system or by CACertFile, neo4j+ssc and bolt+ssc accept self-signed certificates.
+type Config struct {
+	// URI of the server or cluster, e.g. neo4j://localhost:7687.
+	URI string
+	// Username and Password authenticate with basic auth when Username is set.
+	Username string
+	Password string
+	// BearerToken authenticates with a token issued by an SSO provider, taking precedence over basic auth.
+	BearerToken string
+	// Database to run queries against; the server's default database when empty.
+	Database string
+	// MaxConnectionPoolSize is the maximum number of connections to each server.
+	MaxConnectionPoolSize int
+	// ConnectionTimeout bounds establishing a connection to a server.
+	ConnectionTimeout time.Duration
+	// CACertFile is a PEM file of certificates to trust in place of the system's trusted certificates.
+	CACertFile string
+}
+
+// DefaultConfig returns a Config for an unauthenticated local server.
+func DefaultConfig() Config {
+	return Config{
+		URI:                   "neo4j://localhost:7687",
+		MaxConnectionPoolSize: 100,
+		ConnectionTimeout:     5 * time.Second,
+	}
+}
+
+func (c Config) auth() neo4j.AuthToken {
+	switch {
+	case c.BearerToken != "":
+		return neo4j.CustomAuth("bearer", "", c.BearerToken, "", nil)
+	case c.Username != "":
+		return neo4j.BasicAuth(c.Username, c.Password, "")
+	default:
+		return neo4j.NoAuth()
+	}
+}
+
+func (c Config) configure() (func(*neo4j.Config), error) {
+	var rootCAs *x509.CertPool
+	if c.CACertFile != "" {
+		pem, err := ioutil.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem reading CA certificate file "+c.CACertFile)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA certificate file %s", c.CACertFile)
+		}
+	}
+
+	return func(config *neo4j.Config) {
+		config.RootCAs = rootCAs
+		if c.MaxConnectionPoolSize > 0 {
+			config.MaxConnectionPoolSize = c.MaxConnectionPoolSize
+		}
+		if c.ConnectionTimeout > 0 {
+			config.SocketConnectTimeout = c.ConnectionTimeout
+			config.ConnectionAcquisitionTimeout = c.ConnectionTimeout
+		}
+	}, nil
+}
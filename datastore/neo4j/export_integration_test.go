@@ -0,0 +1,16 @@
+//go:build integration
+// +build integration
+
+package neo4j
+
+import "github.com/neo4j/neo4j-go-driver/v4/neo4j"
+
+// DeleteAll deletes every node of the database, so that a test starts from, and leaves, an empty database.
+func (store Neo4jStore) DeleteAll() error {
+	sess := store.session(neo4j.AccessModeWrite)
+	defer sess.Close()
+	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return nil, txWriter{tx}.run(`MATCH (n) DETACH DELETE n`, nil)
+	})
+	return err
+}
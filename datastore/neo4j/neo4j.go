@@ -1,58 +1,67 @@
 package neo4j
 
 import (
-	"github.com/google/uuid"
+	"encoding/json"
+	"sort"
+	"time"
+
 	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
 	"github.com/pkg/errors"
 
 	. "github.com/scraymondjr/appointment/internal"
 )
 
-func New() Neo4jStore {
-	// TODO accept config input instead of hardcoding
-	driver, err := neo4j.NewDriver("neo4j://localhost:7687", neo4j.AuthToken{})
+// New connects to the Neo4j server configured by c.
+//
+// Returns an error if the configuration is invalid or the server cannot be reached.
+func New(c Config) (Neo4jStore, error) {
+	configure, err := c.configure()
+	if err != nil {
+		return Neo4jStore{}, err
+	}
+	driver, err := neo4j.NewDriver(c.URI, c.auth(), configure)
 	if err != nil {
-		panic(err)
+		return Neo4jStore{}, errors.Wrap(err, "problem creating neo4j driver for "+c.URI)
 	}
-	return Neo4jStore{
-		neo4j: driver,
+	if err := driver.VerifyConnectivity(); err != nil {
+		driver.Close()
+		return Neo4jStore{}, errors.Wrap(err, "could not connect to neo4j at "+c.URI)
 	}
+	store := Neo4jStore{
+		neo4j:    driver,
+		database: c.Database,
+	}
+	if err := store.EnsureSchema(); err != nil {
+		driver.Close()
+		return Neo4jStore{}, err
+	}
+	return store, nil
 }
 
 type Neo4jStore struct {
-	neo4j neo4j.Driver
+	neo4j    neo4j.Driver
+	database string
 }
 
-func (store Neo4jStore) WritePatient(p Patient) error {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer sess.Close()
-	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return tx.Run(
-			`MERGE (a:Patient {
-					id: $id,
-					givenName: $givenName,
-					familyName: $familyName
-				} ) RETURN a`,
-			map[string]interface{}{
-				"id":         p.ID(),
-				"givenName":  p.Name[0].Given[0],
-				"familyName": p.Name[0].Family,
-			},
-		)
+func (store Neo4jStore) session(mode neo4j.AccessMode) neo4j.Session {
+	return store.neo4j.NewSession(neo4j.SessionConfig{
+		AccessMode:   mode,
+		DatabaseName: store.database,
 	})
-	if err != nil {
-		return errors.Wrap(err, "problem saving patient "+p.ID())
-	}
-	return nil
+}
+
+func (store Neo4jStore) Close() error {
+	return store.neo4j.Close()
 }
 
 func (store Neo4jStore) GetPatient(id string) (*Patient, error) {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	sess := store.session(neo4j.AccessModeRead)
 	defer sess.Close()
 
 	record, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
 		result, err := tx.Run(`
 		MATCH (p:Patient { id:$id })
+		WHERE p.updatedAt IS NOT NULL
 		RETURN p
 		`, map[string]interface{}{
 			"id": id,
@@ -61,58 +70,63 @@ func (store Neo4jStore) GetPatient(id string) (*Patient, error) {
 			return nil, err
 		}
 
-		return result.Single()
+		return single(result)
 	})
 	if record == nil || err != nil {
 		return nil, err
 	}
 
-	patientNode := record.(*neo4j.Record).Values[0].(neo4j.Node)
+	props := record.(*neo4j.Record).Values[0].(neo4j.Node).Props
 
-	return &Patient{
+	patient := Patient{
 		ResourceTypeAndID: ResourceTypeAndID{
 			ResourceID:   id,
 			ResourceType: "Patient",
 		},
-		Name: []Name{
-			{
-				Family: patientNode.Props["familyName"].(string),
-				Given:  []string{patientNode.Props["givenName"].(string)},
-			},
-		},
-	}, nil
+		Identifiers: identifiersFromProps(props),
+		Name:        nameFromProps(props),
+	}
+	patient.Gender, _ = props["gender"].(string)
+	patient.BirthDate, _ = props["birthDate"].(string)
+	if active, ok := props["active"].(bool); ok {
+		patient.Active = &active
+	}
+	if err := jsonFromProps(props, map[string]interface{}{
+		"telecom": &patient.Telecom,
+		"address": &patient.Address,
+		"contact": &patient.Contacts,
+	}); err != nil {
+		return nil, errors.Wrap(err, "problem decoding patient "+id)
+	}
+	return &patient, nil
 }
 
-func (store Neo4jStore) WriteDoctor(d Doctor) error {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
-	defer sess.Close()
-	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return tx.Run(
-			`MERGE (a:Doctor {
-					id: $id,
-					givenName: $givenName,
-					familyName: $familyName
-				} ) RETURN a`,
-			map[string]interface{}{
-				"id":         d.ID(),
-				"givenName":  d.Name[0].Given[0],
-				"familyName": d.Name[0].Family,
-			})
-	})
-	if err != nil {
-		return errors.Wrap(err, "problem saving patient "+d.ID())
+// jsonFromProps decodes the properties stored as JSON strings into values. Properties that are not set, on
+// placeholder nodes or nodes written before the property was stored, are skipped.
+func jsonFromProps(props map[string]interface{}, values map[string]interface{}) error {
+	for name, value := range values {
+		data, _ := props[name].(string)
+		if data == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), value); err != nil {
+			return errors.Wrap(err, "problem decoding "+name)
+		}
 	}
 	return nil
 }
 
 func (store Neo4jStore) GetDoctor(id string) (*Doctor, error) {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	sess := store.session(neo4j.AccessModeRead)
 	defer sess.Close()
 
 	record, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
 		result, err := tx.Run(`
 		MATCH (d:Doctor { id:$id })
-		RETURN d
+		WHERE d.updatedAt IS NOT NULL
+		OPTIONAL MATCH (r:PractitionerRole)-[:PRACTITIONER]->(d)
+		WITH d, r ORDER BY r.id
+		RETURN d, collect(r)
 		`, map[string]interface{}{
 			"id": id,
 		})
@@ -120,35 +134,103 @@ func (store Neo4jStore) GetDoctor(id string) (*Doctor, error) {
 			return nil, err
 		}
 
-		return result.Single()
+		return single(result)
 	})
 	if record == nil || err != nil {
 		return nil, err
 	}
 
-	patientNode := record.(*neo4j.Record).Values[0].(neo4j.Node)
-
-	return &Doctor{
+	doctorNode := record.(*neo4j.Record).Values[0].(neo4j.Node)
+	doctor := Doctor{
 		ResourceTypeAndID: ResourceTypeAndID{
 			ResourceID:   id,
 			ResourceType: "Doctor",
 		},
-		Name: []Name{
-			{
-				Family: patientNode.Props["familyName"].(string),
-				Given:  []string{patientNode.Props["givenName"].(string)},
-			},
+		Identifiers: identifiersFromProps(doctorNode.Props),
+		Name:        nameFromProps(doctorNode.Props),
+	}
+	roleNodes, _ := record.(*neo4j.Record).Values[1].([]interface{})
+	for _, node := range roleNodes {
+		role, err := roleFromNode(node.(neo4j.Node), id)
+		if err != nil {
+			return nil, err
+		}
+		doctor.Roles = append(doctor.Roles, *role)
+	}
+	return &doctor, nil
+}
+
+// roleFromNode reads the practitioner role of the doctor from its node.
+func roleFromNode(node neo4j.Node, doctorID string) (*PractitionerRole, error) {
+	role := PractitionerRole{
+		ResourceTypeAndID: ResourceTypeAndID{
+			ResourceType: "PractitionerRole",
+		},
+		Practitioner: Reference{
+			ResourceID:   doctorID,
+			ResourceType: "Doctor",
 		},
-	}, nil
+	}
+	role.ResourceID, _ = node.Props["id"].(string)
+	if active, ok := node.Props["active"].(bool); ok {
+		role.Active = &active
+	}
+	if err := jsonFromProps(node.Props, map[string]interface{}{
+		"specialty": &role.Specialty,
+	}); err != nil {
+		return nil, errors.Wrap(err, "problem decoding practitioner role "+role.ResourceID)
+	}
+	return &role, nil
+}
+
+// nameFromProps reads the name stored on a person node. Nodes created as placeholders by a reference from
+// another resource have no name.
+func nameFromProps(props map[string]interface{}) []Name {
+	family, _ := props["familyName"].(string)
+	given, _ := props["givenName"].(string)
+	if family == "" && given == "" {
+		return nil
+	}
+	return []Name{
+		{
+			Family: family,
+			Given:  []string{given},
+		},
+	}
+}
+
+// identifiersFromProps reads the identifiers stored on a person node as "{system}|{value}" tokens.
+func identifiersFromProps(props map[string]interface{}) []Identifier {
+	tokens, _ := props["identifiers"].([]interface{})
+	var identifiers []Identifier
+	for _, token := range tokens {
+		if token, ok := token.(string); ok {
+			identifiers = append(identifiers, ParseIdentifier(token))
+		}
+	}
+	return identifiers
+}
+
+// single returns the only record of result, or nil if the result is empty.
+func single(result neo4j.Result) (interface{}, error) {
+	if !result.Next() {
+		return nil, result.Err()
+	}
+	record := result.Record()
+	if result.Next() {
+		return nil, errors.New("result contains more than one record")
+	}
+	return record, result.Err()
 }
 
 func (store Neo4jStore) GetPatientAppointments(patientID string) ([]Appointment, error) {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	sess := store.session(neo4j.AccessModeRead)
 	defer sess.Close()
 
 	result, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
 		result, err := tx.Run(`
 		MATCH (:Patient { id:$patientId })<-[:SUBJECT]-(a:Appointment)
+		WHERE a.updatedAt IS NOT NULL
 		MATCH (a)-[r]-(n)
 		RETURN *
 		`, map[string]interface{}{
@@ -166,139 +248,165 @@ func (store Neo4jStore) GetPatientAppointments(patientID string) ([]Appointment,
 
 	m := map[string]*Appointment{}
 	for _, record := range result.([]*neo4j.Record) {
-		processAppointmentRecord(record, m)
+		if err := processAppointmentRecord(record, m); err != nil {
+			return nil, err
+		}
 	}
 
 	var apps []Appointment
 	for _, app := range m {
 		apps = append(apps, *app)
 	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Before(apps[j])
+	})
+	for i := range apps {
+		sortDiagnoses(apps[i].Diagnoses)
+	}
 
 	return apps, nil
 }
 
-func (store Neo4jStore) SavePatientFeedback(appointmentID string, feedback Feedback) error {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+func (store Neo4jStore) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	sess := store.session(neo4j.AccessModeWrite)
 	defer sess.Close()
-	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return tx.Run(
-			`MATCH (a:Appointment {id:$appointmentID} )
-			MERGE (a)-[:FEEDBACK]->(:Feedback { id:$id, recommend:$recommend, explained:$explained, feeling:$feeling })
-			RETURN a`,
-			map[string]interface{}{
-				"appointmentID": appointmentID,
-				"id":            uuid.New().String(),
-				"recommend":     feedback.Recommend,
-				"explained":     *feedback.Explained,
-				"feeling":       *feedback.Feeling,
-			},
-		)
+	saved, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.SavePatientFeedback(appointmentID, feedback)
 	})
 	if err != nil {
-		return errors.Wrap(err, "problem saving feedback for appointment "+appointmentID)
+		return nil, err
 	}
-	return nil
+	return saved.(*Feedback), nil
 }
 
-func (store Neo4jStore) GetPatientFeedback(appointmentID string) (*Feedback, error) {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
-	defer sess.Close()
+// diagnosisID returns the id of the diagnosis the feedback is about, or nil if it has none.
+func diagnosisID(feedback Feedback) interface{} {
+	if feedback.Diagnosis == nil {
+		return nil
+	}
+	return feedback.Diagnosis.ResourceID
+}
 
-	record, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		result, err := tx.Run(`
-		MATCH (:Appointment { id:$appointmentId })-[:FEEDBACK]->(f:Feedback)
-		RETURN f
-		`, map[string]interface{}{
-			"appointmentId": appointmentID,
-		})
-		if err != nil {
-			return nil, err
-		}
+// authorID returns the id of the patient who submitted the feedback, or nil if it is not known.
+func authorID(feedback Feedback) interface{} {
+	if feedback.Author == nil {
+		return nil
+	}
+	return feedback.Author.ResourceID
+}
 
-		return result.Single()
+func (store Neo4jStore) GetPatientFeedback(appointmentID string) (*Feedback, error) {
+	sess := store.session(neo4j.AccessModeRead)
+	defer sess.Close()
+	feedback, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.GetPatientFeedback(appointmentID)
 	})
-	if record == nil || err != nil {
+	if err != nil {
 		return nil, err
 	}
+	return feedback.(*Feedback), nil
+}
 
-	feedbackNode := record.(*neo4j.Record).Values[0].(neo4j.Node)
-	explained := feedbackNode.Props["explained"].(bool)
-	feeling := feedbackNode.Props["feeling"].(string)
-	return &Feedback{
-		Recommend: int(feedbackNode.Props["recommend"].(int64)),
-		Explained: &explained,
-		Feeling:   &feeling,
-	}, nil
+func (store Neo4jStore) GetFeedback(id string) (*Feedback, error) {
+	sess := store.session(neo4j.AccessModeRead)
+	defer sess.Close()
+	feedback, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.GetFeedback(id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return feedback.(*Feedback), nil
 }
 
-func (store Neo4jStore) GetPatientNotifications(patientID string) error {
-	return nil
+// feedbackFromNode returns the feedback of a Feedback node about the appointment. Feedback saved before surveys
+// were configurable has no answers, and is read from its recommend, explained and feeling properties.
+func feedbackFromNode(node neo4j.Node, appointmentID string) (*Feedback, error) {
+	var feedback Feedback
+	if _, ok := node.Props["answers"]; ok {
+		feedback.Survey, _ = node.Props["survey"].(string)
+		feedback.SurveyVersion = 1 // feedback saved before surveys were versioned
+		if version, ok := node.Props["surveyVersion"].(int64); ok {
+			feedback.SurveyVersion = int(version)
+		}
+		if err := jsonFromProps(node.Props, map[string]interface{}{
+			"answers": &feedback.Answers,
+		}); err != nil {
+			return nil, errors.Wrap(err, "problem decoding feedback for appointment "+appointmentID)
+		}
+	} else {
+		recommend, _ := node.Props["recommend"].(int64)
+		explained, _ := node.Props["explained"].(bool)
+		feeling, _ := node.Props["feeling"].(string)
+		feedback = LegacyFeedback(int(recommend), explained, feeling)
+	}
+	id, _ := node.Props["id"].(string)
+	feedback.ResourceTypeAndID = ResourceTypeAndID{ResourceID: id, ResourceType: "Feedback"}
+	feedback.Appointment = Reference{ResourceID: appointmentID, ResourceType: "Appointment"}
+	if diagnosisID, ok := node.Props["diagnosisId"].(string); ok {
+		feedback.Diagnosis = &Reference{
+			ResourceID:   diagnosisID,
+			ResourceType: "Diagnosis",
+		}
+	}
+	if authorID, ok := node.Props["authorId"].(string); ok {
+		feedback.Author = &Reference{
+			ResourceID:   authorID,
+			ResourceType: "Patient",
+		}
+	}
+	channel, _ := node.Props["channel"].(string)
+	feedback.Channel = FeedbackChannel(channel)
+	if createdAt, ok := node.Props["createdAt"].(time.Time); ok {
+		feedback.CreatedAt = &createdAt
+	}
+	if updatedAt, ok := node.Props["updatedAt"].(time.Time); ok {
+		feedback.UpdatedAt = &updatedAt
+	}
+	return &feedback, nil
 }
 
-func (store Neo4jStore) WriteAppointment(a Appointment) error {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+// SaveSurvey saves the version of the survey unless that version has been saved already.
+func (store Neo4jStore) SaveSurvey(survey Survey) error {
+	sess := store.session(neo4j.AccessModeWrite)
 	defer sess.Close()
 	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return tx.Run(
-			`MERGE (a:Appointment {
-					id: $id,
-					status: $status,
-					type: $type
-				} )
-				MERGE (p:Patient { id:$patientId })
-				MERGE (d:Doctor { id:$doctorId })
-				MERGE (a)-[sub:SUBJECT]->(p)
-				MERGE (a)-[actor:ACTOR]->(d)
-				RETURN a`,
-			map[string]interface{}{
-				"id":        a.ID(),
-				"status":    a.Status,
-				"type":      a.Description,
-				"patientId": a.Subject.ResourceID,
-				"doctorId":  a.Actor.ResourceID,
-			},
-		)
+		return nil, txWriter{tx}.SaveSurvey(survey)
+	})
+	return err
+}
+
+func (store Neo4jStore) GetSurvey(id string, version int) (*Survey, error) {
+	sess := store.session(neo4j.AccessModeRead)
+	defer sess.Close()
+	survey, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.GetSurvey(id, version)
 	})
 	if err != nil {
-		return errors.Wrap(err, "problem saving appointment "+a.ID())
+		return nil, err
 	}
+	return survey.(*Survey), nil
+}
+
+func (store Neo4jStore) GetPatientNotifications(patientID string) error {
 	return nil
 }
 
+// GetAppointment returns the appointment with the id, or nil if it has not been written. Placeholder nodes, created
+// by diagnoses and encounters referring to an appointment before it is written, have no updatedAt and are skipped.
 func (store Neo4jStore) GetAppointment(id string) (*Appointment, error) {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeRead})
+	sess := store.session(neo4j.AccessModeRead)
 	defer sess.Close()
-
-	result, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		result, err := tx.Run(
-			`MATCH (a:Appointment { id:$id })-[r]-(n)
-			RETURN *
-			`,
-			map[string]interface{}{
-				"id": id,
-			},
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		return result.Collect()
+	appointment, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.GetAppointment(id)
 	})
-	if result == nil || err != nil {
+	if err != nil {
 		return nil, err
 	}
-	records := result.([]*neo4j.Record)
-
-	m := map[string]*Appointment{}
-	for _, record := range records {
-		processAppointmentRecord(record, m)
-	}
-
-	app := m[id]
-	return app, nil
+	return appointment.(*Appointment), nil
 }
 
-func processAppointmentRecord(record *neo4j.Record, appointments map[string]*Appointment) {
+func processAppointmentRecord(record *neo4j.Record, appointments map[string]*Appointment) error {
 	appointmentNode := record.Values[0].(neo4j.Node)
 	appointmentID := appointmentNode.Props["id"].(string)
 	appointment, ok := appointments[appointmentID] // get or create
@@ -308,8 +416,21 @@ func processAppointmentRecord(record *neo4j.Record, appointments map[string]*App
 				ResourceID:   appointmentID,
 				ResourceType: "Appointment",
 			},
-			Status:      appointmentNode.Props["status"].(string),
-			Description: appointmentNode.Props["type"].(string),
+		}
+		appointment.Status, _ = appointmentNode.Props["status"].(string)
+		appointment.Description, _ = appointmentNode.Props["type"].(string)
+		if start, ok := appointmentNode.Props["start"].(time.Time); ok {
+			appointment.Period.Start = &start
+		}
+		if end, ok := appointmentNode.Props["end"].(time.Time); ok {
+			appointment.Period.End = &end
+		}
+		if err := jsonFromProps(appointmentNode.Props, map[string]interface{}{
+			"appointmentType": &appointment.AppointmentType,
+			"location":        &appointment.Location,
+			"participants":    &appointment.Participants,
+		}); err != nil {
+			return errors.Wrap(err, "problem decoding appointment "+appointmentID)
 		}
 		appointments[appointmentID] = appointment
 	}
@@ -338,46 +459,91 @@ func processAppointmentRecord(record *neo4j.Record, appointments map[string]*App
 			ResourceType: "Feedback",
 		}
 	case "APPOINTMENT":
-		appointment.Diagnosis = Diagnosis{
-			ResourceTypeAndID: ResourceTypeAndID{
-				ResourceID:   nodeID,
-				ResourceType: "Diagnosis",
-			},
-			Status: node.(neo4j.Node).Props["status"].(string),
-			Name:   node.(neo4j.Node).Props["name"].(string),
-			Appointment: Reference{
-				ResourceID:   appointmentID,
-				ResourceType: "Appointment",
-			},
+		diagnosis, err := diagnosisFromNode(node.(neo4j.Node), appointmentID)
+		if err != nil {
+			return err
+		}
+		appointment.Diagnoses = append(appointment.Diagnoses, *diagnosis)
+	}
+	return nil
+}
+
+// sortDiagnoses sorts the diagnoses of an appointment in rank order, see Diagnosis.Before.
+func sortDiagnoses(diagnoses []Diagnosis) {
+	sort.Slice(diagnoses, func(i, j int) bool {
+		return diagnoses[i].Before(diagnoses[j])
+	})
+}
+
+// diagnosisFromNode reads the diagnosis of the appointment from its node; appointmentID is "" for a diagnosis
+// read from a Condition whose encounter has not been written. Diagnoses written before codes were stored only
+// have a name, which is taken as the text of the code.
+func diagnosisFromNode(node neo4j.Node, appointmentID string) (*Diagnosis, error) {
+	diagnosis := Diagnosis{
+		ResourceTypeAndID: ResourceTypeAndID{
+			ResourceType: "Diagnosis",
+		},
+	}
+	if appointmentID != "" {
+		diagnosis.Appointment = Reference{
+			ResourceID:   appointmentID,
+			ResourceType: "Appointment",
 		}
 	}
+	if encounterID, ok := node.Props["encounterId"].(string); ok {
+		diagnosis.Encounter = &Reference{
+			ResourceID:   encounterID,
+			ResourceType: "Encounter",
+		}
+	}
+	diagnosis.ResourceID, _ = node.Props["id"].(string)
+	diagnosis.Status, _ = node.Props["status"].(string)
+	if rank, ok := node.Props["rank"].(int64); ok {
+		diagnosis.Rank = int(rank)
+	}
+	if err := jsonFromProps(node.Props, map[string]interface{}{
+		"code": &diagnosis.Code,
+	}); err != nil {
+		return nil, errors.Wrap(err, "problem decoding diagnosis "+diagnosis.ResourceID)
+	}
+	if diagnosis.Code.Text == "" && len(diagnosis.Code.Coding) == 0 {
+		diagnosis.Code.Text, _ = node.Props["name"].(string)
+	}
+	return &diagnosis, nil
 }
 
-func (store Neo4jStore) WriteDiagnosis(d Diagnosis) error {
-	sess := store.neo4j.NewSession(neo4j.SessionConfig{AccessMode: neo4j.AccessModeWrite})
+func (store Neo4jStore) GetDiagnosesByCode(system, code string) ([]Diagnosis, error) {
+	sess := store.session(neo4j.AccessModeRead)
 	defer sess.Close()
-	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-		return tx.Run(
-			`
-				MERGE (a:Appointment { id:$appointmentId })
-				MERGE (d:Diagnosis {
-					id: $id,
-					status: $status,
-					name: $name
-				} )
-				MERGE (d)-[:APPOINTMENT]-(a)
-				RETURN d`,
-			map[string]interface{}{
-				"id":            d.ID(),
-				"status":        d.Status,
-				"name":          d.Name,
-				"appointmentId": d.Appointment.ResourceID,
-			},
-		)
+
+	result, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		result, err := tx.Run(`
+		MATCH (d:Diagnosis)
+		WHERE $coding IN d.codings
+		OPTIONAL MATCH (d)-[:APPOINTMENT]->(a:Appointment)
+		RETURN d, a.id
+		ORDER BY d.id
+		`, map[string]interface{}{
+			"coding": system + "|" + code,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return result.Collect()
 	})
 	if err != nil {
-		return errors.Wrap(err, "problem saving patient "+d.ID())
+		return nil, errors.Wrapf(err, "problem reading diagnoses with code %s|%s", system, code)
 	}
 
-	return nil
+	var diagnoses []Diagnosis
+	for _, record := range result.([]*neo4j.Record) {
+		appointmentID, _ := record.Values[1].(string)
+		diagnosis, err := diagnosisFromNode(record.Values[0].(neo4j.Node), appointmentID)
+		if err != nil {
+			return nil, err
+		}
+		diagnoses = append(diagnoses, *diagnosis)
+	}
+	return diagnoses, nil
 }
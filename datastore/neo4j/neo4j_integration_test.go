@@ -1,3 +1,4 @@
+//go:build integration
 // +build integration
 
 package neo4j_test
@@ -10,15 +11,16 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/scraymondjr/appointment/datastore/datastoretest"
 	"github.com/scraymondjr/appointment/datastore/neo4j"
 	"github.com/scraymondjr/appointment/internal"
 )
 
 func TestNeo4jStoreIngest(t *testing.T) {
-	f, err := os.Open("testdata/bundle.json")
+	f, err := os.Open("../../internal/testdata/bundle.json")
 	require.NoError(t, err)
 
-	store := neo4j.New()
+	store := newStore(t)
 	err = internal.Ingest(f, store)
 	require.NoError(t, err)
 
@@ -35,11 +37,11 @@ func TestNeo4jStoreIngest(t *testing.T) {
 	appointment, err := store.GetAppointment("be142dc6-93bd-11eb-a8b3-0242ac130003")
 	require.NoError(t, err)
 	require.NotNil(t, appointment)
-	assert.Equal(t, "Diabetes without complications", appointment.Diagnosis.Name)
+	assert.Equal(t, "Diabetes without complications", appointment.PrimaryDiagnosis().Name())
 }
 
 func TestNeo4jStore_WriteResource(t *testing.T) {
-	store := neo4j.New()
+	store := newStore(t)
 
 	appointmentJSON := `{
         "resourceType": "Appointment",
@@ -82,3 +84,40 @@ func TestNeo4jStore_WriteResource(t *testing.T) {
 		},
 	}, storedPatient)
 }
+
+func TestNeo4jStore_PlaceholderAppointment(t *testing.T) {
+	store := newStore(t)
+
+	// a diagnosis written before its appointment leaves a placeholder appointment node with only an id
+	appointmentID := "placeholder-appointment"
+	require.NoError(t, store.WriteDiagnosis(internal.Diagnosis{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "placeholder-diagnosis", ResourceType: "Diagnosis"},
+		Status:            "final",
+		Appointment:       internal.Reference{ResourceID: appointmentID, ResourceType: "Appointment"},
+	}))
+
+	appointment, err := store.GetAppointment(appointmentID)
+	require.NoError(t, err)
+	assert.Nil(t, appointment)
+}
+
+func TestNeo4jStore_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastoretest.Store {
+		return newStore(t)
+	})
+}
+
+// newStore connects to the test database and empties it, emptying it again when t ends, so that no test sees the
+// data of another or of an earlier run.
+func newStore(t *testing.T) neo4j.Neo4jStore {
+	config := neo4j.DefaultConfig()
+	if uri, ok := os.LookupEnv("NEO4J_TARGET"); ok {
+		config.URI = uri
+	}
+	store, err := neo4j.New(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	require.NoError(t, store.DeleteAll())
+	t.Cleanup(func() { assert.NoError(t, store.DeleteAll()) })
+	return store
+}
@@ -0,0 +1,67 @@
+package neo4j
+
+import (
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"github.com/pkg/errors"
+)
+
+// constraints make the id of each resource node unique, and the id and version of each survey. Writes MERGE nodes
+// on these, so without the constraints concurrent writes of the same resource could create duplicate nodes.
+var constraints = []string{
+	`CREATE CONSTRAINT patient_id IF NOT EXISTS FOR (n:Patient) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT doctor_id IF NOT EXISTS FOR (n:Doctor) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT appointment_id IF NOT EXISTS FOR (n:Appointment) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT diagnosis_id IF NOT EXISTS FOR (n:Diagnosis) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT practitionerrole_id IF NOT EXISTS FOR (n:PractitionerRole) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT encounter_id IF NOT EXISTS FOR (n:Encounter) REQUIRE n.id IS UNIQUE`,
+	`CREATE CONSTRAINT survey_id_version IF NOT EXISTS FOR (n:Survey) REQUIRE (n.id, n.version) IS UNIQUE`,
+	`CREATE CONSTRAINT feedback_id IF NOT EXISTS FOR (n:Feedback) REQUIRE n.id IS UNIQUE`,
+}
+
+// backfills set updatedAt on nodes written before it was kept, so that they are not taken for the placeholders
+// created by references to resources not written yet, which only have an id. Each resource node written back then
+// has a property its placeholders lack.
+var backfills = []string{
+	`MATCH (n:Patient) WHERE n.updatedAt IS NULL AND (n.givenName IS NOT NULL OR n.familyName IS NOT NULL)
+	SET n.updatedAt = datetime()`,
+	`MATCH (n:Doctor) WHERE n.updatedAt IS NULL AND (n.givenName IS NOT NULL OR n.familyName IS NOT NULL)
+	SET n.updatedAt = datetime()`,
+	`MATCH (n:Appointment) WHERE n.updatedAt IS NULL AND n.status IS NOT NULL
+	SET n.updatedAt = datetime()`,
+	`MATCH (n:Diagnosis) WHERE n.updatedAt IS NULL AND (n.status IS NOT NULL OR n.name IS NOT NULL)
+	SET n.updatedAt = datetime()`,
+}
+
+// EnsureSchema creates the constraints the store relies on if they do not exist yet, and backfills nodes written
+// before updatedAt was kept.
+func (store Neo4jStore) EnsureSchema() error {
+	sess := store.session(neo4j.AccessModeWrite)
+	defer sess.Close()
+
+	// schema changes cannot be mixed with other statements, so each runs in its own transaction
+	for _, constraint := range constraints {
+		_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+			result, err := tx.Run(constraint, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume()
+		})
+		if err != nil {
+			return errors.Wrap(err, "problem creating constraint")
+		}
+	}
+	for _, backfill := range backfills {
+		_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+			result, err := tx.Run(backfill, nil)
+			if err != nil {
+				return nil, err
+			}
+			return result.Consume()
+		})
+		if err != nil {
+			return errors.Wrap(err, "problem backfilling updatedAt")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,633 @@
+package neo4j
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+	"github.com/neo4j/neo4j-go-driver/v4/neo4j"
+	"github.com/pkg/errors"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+var (
+	_ TransactionalWriter = Neo4jStore{}
+	_ ResourceLookup      = Neo4jStore{}
+	_ ResourceLookup      = txWriter{}
+	_ IdentifierLookup    = Neo4jStore{}
+	_ IdentifierLookup    = txWriter{}
+	_ SurveyWriter        = txWriter{}
+	_ FeedbackWriter      = txWriter{}
+)
+
+func (store Neo4jStore) WritePatient(p Patient) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WritePatient(p)
+	})
+}
+
+func (store Neo4jStore) WriteDoctor(d Doctor) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteDoctor(d)
+	})
+}
+
+func (store Neo4jStore) WriteAppointment(a Appointment) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteAppointment(a)
+	})
+}
+
+func (store Neo4jStore) WriteDiagnosis(d Diagnosis) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteDiagnosis(d)
+	})
+}
+
+func (store Neo4jStore) WritePractitionerRole(r PractitionerRole) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WritePractitionerRole(r)
+	})
+}
+
+func (store Neo4jStore) WriteEncounter(e Encounter) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteEncounter(e)
+	})
+}
+
+// WriteTransaction runs fn in a single neo4j write transaction.
+func (store Neo4jStore) WriteTransaction(fn func(ResourceWriter) error) error {
+	sess := store.session(neo4j.AccessModeWrite)
+	defer sess.Close()
+	_, err := sess.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return nil, fn(txWriter{tx})
+	})
+	return err
+}
+
+// HasResource returns whether the resource has been written. Placeholder nodes, created for the target of a
+// reference before the target itself is written, do not count.
+func (store Neo4jStore) HasResource(resourceType, id string) (bool, error) {
+	sess := store.session(neo4j.AccessModeRead)
+	defer sess.Close()
+	exists, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.HasResource(resourceType, id)
+	})
+	if err != nil {
+		return false, err
+	}
+	return exists.(bool), nil
+}
+
+func (store Neo4jStore) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	sess := store.session(neo4j.AccessModeRead)
+	defer sess.Close()
+	id, err := sess.ReadTransaction(func(tx neo4j.Transaction) (interface{}, error) {
+		return txWriter{tx}.FindByIdentifier(resourceType, identifier)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id.(string), nil
+}
+
+// txWriter writes resources within a transaction.
+type txWriter struct {
+	tx neo4j.Transaction
+}
+
+// run runs the query, consuming the result so any error is attributed to this query rather than surfacing
+// when the transaction commits.
+func (w txWriter) run(cypher string, params map[string]interface{}) error {
+	result, err := w.tx.Run(cypher, params)
+	if err != nil {
+		return err
+	}
+	_, err = result.Consume()
+	return err
+}
+
+func (w txWriter) WritePatient(p Patient) error {
+	params := personParams(p.ID(), p.Name, p.Identifiers)
+	params["gender"] = nullIfEmpty(p.Gender)
+	params["birthDate"] = nullIfEmpty(p.BirthDate)
+	params["active"] = nil
+	if p.Active != nil {
+		params["active"] = *p.Active
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"telecom": p.Telecom,
+		"address": p.Address,
+		"contact": p.Contacts,
+	}); err != nil {
+		return errors.Wrap(err, "problem encoding patient "+p.ID())
+	}
+
+	err := w.run(
+		`MERGE (a:Patient { id: $id })
+		SET a.givenName = $givenName, a.familyName = $familyName, a.identifiers = $identifiers,
+			a.active = $active, a.gender = $gender, a.birthDate = $birthDate,
+			a.telecom = $telecom, a.address = $address, a.contact = $contact,
+			a.updatedAt = datetime()
+		RETURN a`,
+		params,
+	)
+	return errors.Wrap(err, "problem saving patient "+p.ID())
+}
+
+// jsonParams adds values to params encoded as JSON. Nodes cannot hold nested properties, so structures are
+// stored as JSON strings.
+func jsonParams(params map[string]interface{}, values map[string]interface{}) error {
+	for name, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "problem encoding "+name)
+		}
+		params[name] = string(data)
+	}
+	return nil
+}
+
+// nullIfEmpty returns nil for the empty string, so that SET removes the property.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (w txWriter) WriteDoctor(d Doctor) error {
+	err := w.run(
+		`MERGE (a:Doctor { id: $id })
+		SET a.givenName = $givenName, a.familyName = $familyName, a.identifiers = $identifiers, a.updatedAt = datetime()
+		RETURN a`,
+		personParams(d.ID(), d.Name, d.Identifiers),
+	)
+	return errors.Wrap(err, "problem saving doctor "+d.ID())
+}
+
+func (w txWriter) WriteAppointment(a Appointment) error {
+	params := map[string]interface{}{
+		"id":        a.ID(),
+		"status":    a.Status,
+		"type":      a.Description,
+		"patientId": a.Subject.ResourceID,
+		"doctorId":  a.Actor.ResourceID,
+		"start":     nil,
+		"end":       nil,
+	}
+	if a.Period.Start != nil {
+		params["start"] = *a.Period.Start
+	}
+	if a.Period.End != nil {
+		params["end"] = *a.Period.End
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"appointmentType": a.AppointmentType,
+		"location":        a.Location,
+		"participants":    a.Participants,
+	}); err != nil {
+		return errors.Wrap(err, "problem encoding appointment "+a.ID())
+	}
+
+	err := w.run(
+		`MERGE (a:Appointment { id: $id })
+		SET a.status = $status, a.type = $type, a.start = $start, a.end = $end,
+			a.appointmentType = $appointmentType, a.location = $location, a.participants = $participants,
+			a.updatedAt = datetime()
+		WITH a
+		OPTIONAL MATCH (a)-[old:SUBJECT|ACTOR]->()
+		DELETE old
+		WITH DISTINCT a
+		MERGE (p:Patient { id:$patientId })
+		MERGE (d:Doctor { id:$doctorId })
+		MERGE (a)-[:SUBJECT]->(p)
+		MERGE (a)-[:ACTOR]->(d)
+		RETURN a`,
+		params,
+	)
+	return errors.Wrap(err, "problem saving appointment "+a.ID())
+}
+
+func (w txWriter) WriteDiagnosis(d Diagnosis) error {
+	params := map[string]interface{}{
+		"id":            d.ID(),
+		"status":        d.Status,
+		"name":          d.Name(),
+		"rank":          d.Rank,
+		"appointmentId": nullIfEmpty(d.Appointment.ResourceID),
+		"encounterId":   nil,
+		"codings":       nil,
+	}
+	if d.Encounter != nil {
+		params["encounterId"] = d.Encounter.ResourceID
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"code": d.Code,
+	}); err != nil {
+		return errors.Wrap(err, "problem encoding diagnosis "+d.ID())
+	}
+	// codings are also stored as "{system}|{code}" tokens to find diagnoses by code
+	if len(d.Code.Coding) > 0 {
+		codings := make([]string, len(d.Code.Coding))
+		for i, coding := range d.Code.Coding {
+			codings[i] = coding.System + "|" + coding.Code
+		}
+		params["codings"] = codings
+	}
+
+	err := w.run(
+		`MERGE (d:Diagnosis { id: $id })
+		SET d.status = $status, d.name = $name, d.code = $code, d.rank = $rank, d.codings = $codings,
+			d.encounterId = $encounterId, d.updatedAt = datetime()
+		WITH d
+		OPTIONAL MATCH (d)-[old:APPOINTMENT]->()
+		DELETE old
+		WITH DISTINCT d
+		FOREACH (_ IN CASE WHEN $appointmentId IS NULL THEN [] ELSE [1] END |
+			MERGE (a:Appointment { id:$appointmentId })
+			MERGE (d)-[:APPOINTMENT]->(a)
+		)
+		RETURN d`,
+		params,
+	)
+	if err == nil {
+		err = w.run(`MATCH (d:Diagnosis { id: $id })`+linkDiagnoses, params)
+	}
+	return errors.Wrap(err, "problem saving diagnosis "+d.ID())
+}
+
+// linkDiagnoses derives the appointment and rank of the diagnoses matched as d before it from the encounter they
+// belong to, if that has been written, see Encounter.Link.
+const linkDiagnoses = `
+	WHERE d.updatedAt IS NOT NULL
+	OPTIONAL MATCH (listing:Encounter)-[:DIAGNOSIS]->(d)
+	WITH d, min(listing.id) AS listingId
+	MATCH (owner:Encounter { id: coalesce(d.encounterId, listingId) })
+	OPTIONAL MATCH (owner)-[listed:DIAGNOSIS]->(d)
+	SET d.rank = coalesce(listed.rank, d.rank)
+	WITH DISTINCT d, owner
+	MATCH (owner)-[:BASED_ON]->(a:Appointment)
+	OPTIONAL MATCH (d)-[old:APPOINTMENT]->()
+	DELETE old
+	WITH DISTINCT d, a
+	MERGE (d)-[:APPOINTMENT]->(a)
+	RETURN d`
+
+func (w txWriter) WriteEncounter(e Encounter) error {
+	params := map[string]interface{}{
+		"id":            e.ID(),
+		"status":        e.Status,
+		"appointmentId": nil,
+	}
+	if ref := e.Appointment(); ref != nil {
+		params["appointmentId"] = ref.ResourceID
+	}
+	diagnoses := make([]interface{}, len(e.Diagnoses))
+	conditionIDs := make([]interface{}, len(e.Diagnoses))
+	for i, diagnosis := range e.Diagnoses {
+		diagnoses[i] = map[string]interface{}{
+			"conditionId": diagnosis.Condition.ResourceID,
+			"rank":        diagnosis.Rank,
+		}
+		conditionIDs[i] = diagnosis.Condition.ResourceID
+	}
+	params["diagnoses"] = diagnoses
+	params["conditionIds"] = conditionIDs
+
+	err := w.run(
+		`MERGE (e:Encounter { id: $id })
+		SET e.status = $status, e.updatedAt = datetime()
+		WITH e
+		OPTIONAL MATCH (e)-[old:BASED_ON|DIAGNOSIS]->()
+		DELETE old
+		WITH DISTINCT e
+		FOREACH (_ IN CASE WHEN $appointmentId IS NULL THEN [] ELSE [1] END |
+			MERGE (a:Appointment { id:$appointmentId })
+			MERGE (e)-[:BASED_ON]->(a)
+		)
+		FOREACH (diagnosis IN $diagnoses |
+			MERGE (d:Diagnosis { id: diagnosis.conditionId })
+			MERGE (e)-[:DIAGNOSIS { rank: diagnosis.rank }]->(d)
+		)
+		RETURN e`,
+		params,
+	)
+	if err == nil {
+		err = w.run(`MATCH (d:Diagnosis) WHERE d.encounterId = $id OR d.id IN $conditionIds
+			WITH d`+linkDiagnoses, params)
+	}
+	return errors.Wrap(err, "problem saving encounter "+e.ID())
+}
+
+func (w txWriter) WritePractitionerRole(r PractitionerRole) error {
+	params := map[string]interface{}{
+		"id":       r.ID(),
+		"active":   nil,
+		"doctorId": r.Practitioner.ResourceID,
+	}
+	if r.Active != nil {
+		params["active"] = *r.Active
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"specialty": r.Specialty,
+	}); err != nil {
+		return errors.Wrap(err, "problem encoding practitioner role "+r.ID())
+	}
+
+	err := w.run(
+		`MERGE (r:PractitionerRole { id: $id })
+		SET r.active = $active, r.specialty = $specialty, r.updatedAt = datetime()
+		WITH r
+		OPTIONAL MATCH (r)-[old:PRACTITIONER]->()
+		DELETE old
+		WITH DISTINCT r
+		MERGE (d:Doctor { id:$doctorId })
+		MERGE (r)-[:PRACTITIONER]->(d)
+		RETURN r`,
+		params,
+	)
+	return errors.Wrap(err, "problem saving practitioner role "+r.ID())
+}
+
+// personParams returns the query parameters id, givenName, familyName and identifiers. The names are taken from
+// the first name and, like identifiers, are null when there is none so that SET removes the property.
+// Identifiers are stored as a list of "{system}|{value}" tokens.
+func personParams(id string, names []Name, identifiers []Identifier) map[string]interface{} {
+	params := map[string]interface{}{
+		"id":          id,
+		"givenName":   nil,
+		"familyName":  nil,
+		"identifiers": nil,
+	}
+	if len(names) > 0 {
+		if len(names[0].Given) > 0 {
+			params["givenName"] = names[0].Given[0]
+		}
+		params["familyName"] = names[0].Family
+	}
+	if len(identifiers) > 0 {
+		tokens := make([]string, len(identifiers))
+		for i, identifier := range identifiers {
+			tokens[i] = identifier.String()
+		}
+		params["identifiers"] = tokens
+	}
+	return params
+}
+
+// labels are the node labels of the resource types that are stored.
+var labels = map[string]string{
+	"Patient":          "Patient",
+	"Doctor":           "Doctor",
+	"Appointment":      "Appointment",
+	"Diagnosis":        "Diagnosis",
+	"PractitionerRole": "PractitionerRole",
+	"Encounter":        "Encounter",
+}
+
+func (w txWriter) HasResource(resourceType, id string) (bool, error) {
+	label, ok := labels[resourceType]
+	if !ok {
+		return false, errors.Errorf("unknown resource type " + resourceType)
+	}
+	// labels cannot be query parameters; label is from the fixed set above
+	result, err := w.tx.Run(
+		`MATCH (n:`+label+` { id:$id })
+		WHERE n.updatedAt IS NOT NULL
+		RETURN n.id`,
+		map[string]interface{}{
+			"id": id,
+		},
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "problem looking up "+resourceType+" "+id)
+	}
+	exists := result.Next()
+	return exists, errors.Wrap(result.Err(), "problem looking up "+resourceType+" "+id)
+}
+
+// FindByIdentifier returns the id of the patient or doctor with the identifier, or "" if there is none. If
+// several have it, the lowest id is returned.
+func (w txWriter) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	if resourceType != "Patient" && resourceType != "Doctor" {
+		return "", errors.Errorf("resource type %s has no identifiers", resourceType)
+	}
+	// labels cannot be query parameters; resourceType is one of the labels above
+	result, err := w.tx.Run(
+		`MATCH (n:`+resourceType+`)
+		WHERE $identifier IN n.identifiers
+		RETURN n.id
+		ORDER BY n.id
+		LIMIT 1`,
+		map[string]interface{}{
+			"identifier": identifier.String(),
+		},
+	)
+	if err != nil {
+		return "", errors.Wrapf(err, "problem finding %s with identifier %s", resourceType, identifier)
+	}
+	if !result.Next() {
+		return "", errors.Wrapf(result.Err(), "problem finding %s with identifier %s", resourceType, identifier)
+	}
+	id, _ := result.Record().Values[0].(string)
+	return id, nil
+}
+
+// SavePatientFeedback saves the feedback for the appointment, keeping the id and creation time of the feedback
+// it replaces, or else those of the feedback if it has them, and reads it back.
+//
+// Returns an error caused by ErrFeedbackIDTaken if the appointment has no feedback and the id of the feedback is
+// that of the feedback about another appointment.
+func (w txWriter) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	id := feedback.ID()
+	if id == "" {
+		id = uuid.New().String()
+	} else if err := w.checkFeedbackID(appointmentID, id); err != nil {
+		return nil, err
+	}
+	params := map[string]interface{}{
+		"appointmentID": appointmentID,
+		"id":            id,
+		"createdAt":     nil,
+		"survey":        feedback.Survey,
+		"surveyVersion": feedback.SurveyVersion,
+		"diagnosisId":   diagnosisID(feedback),
+		"authorId":      authorID(feedback),
+		"channel":       nullIfEmpty(string(feedback.Channel)),
+	}
+	if feedback.CreatedAt != nil {
+		params["createdAt"] = *feedback.CreatedAt
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"answers": feedback.Answers,
+	}); err != nil {
+		return nil, errors.Wrap(err, "problem encoding feedback for appointment "+appointmentID)
+	}
+
+	result, err := w.tx.Run(
+		`MATCH (a:Appointment {id:$appointmentID} )
+		WHERE a.updatedAt IS NOT NULL
+		MERGE (a)-[:FEEDBACK]->(f:Feedback)
+		ON CREATE SET f.id = $id
+		SET f.survey = $survey, f.surveyVersion = $surveyVersion, f.answers = $answers, f.diagnosisId = $diagnosisId,
+			f.authorId = $authorId, f.channel = $channel, f.createdAt = coalesce(f.createdAt, $createdAt, datetime()),
+			f.updatedAt = datetime()
+		REMOVE f.recommend, f.explained, f.feeling
+		RETURN f`,
+		params,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem saving feedback for appointment "+appointmentID)
+	}
+	record, err := single(result)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem saving feedback for appointment "+appointmentID)
+	}
+	if record == nil {
+		return nil, errors.Errorf("appointment %s not found", appointmentID)
+	}
+	return feedbackFromNode(record.(*neo4j.Record).Values[0].(neo4j.Node), appointmentID)
+}
+
+// checkFeedbackID returns an error caused by ErrFeedbackIDTaken if the appointment has no feedback and the
+// feedback about another appointment has the id.
+func (w txWriter) checkFeedbackID(appointmentID, id string) error {
+	result, err := w.tx.Run(
+		`OPTIONAL MATCH (other:Appointment)-[:FEEDBACK]->(:Feedback {id:$id})
+		WHERE other.id <> $appointmentID
+		OPTIONAL MATCH (:Appointment {id:$appointmentID})-[:FEEDBACK]->(own:Feedback)
+		RETURN other IS NOT NULL AND own IS NULL`,
+		map[string]interface{}{
+			"appointmentID": appointmentID,
+			"id":            id,
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "problem reading feedback "+id)
+	}
+	record, err := single(result)
+	if err != nil {
+		return errors.Wrap(err, "problem reading feedback "+id)
+	}
+	if record, ok := record.(*neo4j.Record); ok && record.Values[0] == true {
+		return errors.Wrap(ErrFeedbackIDTaken, "problem saving feedback for appointment "+appointmentID)
+	}
+	return nil
+}
+
+func (w txWriter) GetAppointment(id string) (*Appointment, error) {
+	result, err := w.tx.Run(
+		`MATCH (a:Appointment { id:$id })-[r]-(n)
+		WHERE a.updatedAt IS NOT NULL
+		RETURN *
+		`,
+		map[string]interface{}{
+			"id": id,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading appointment "+id)
+	}
+	records, err := result.Collect()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading appointment "+id)
+	}
+
+	m := map[string]*Appointment{}
+	for _, record := range records {
+		if err := processAppointmentRecord(record, m); err != nil {
+			return nil, err
+		}
+	}
+
+	app := m[id]
+	if app != nil {
+		sortDiagnoses(app.Diagnoses)
+	}
+	return app, nil
+}
+
+func (w txWriter) GetPatientFeedback(appointmentID string) (*Feedback, error) {
+	result, err := w.tx.Run(
+		`MATCH (:Appointment { id:$appointmentId })-[:FEEDBACK]->(f:Feedback)
+		RETURN f`,
+		map[string]interface{}{
+			"appointmentId": appointmentID,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading feedback for appointment "+appointmentID)
+	}
+	record, err := single(result)
+	if record == nil || err != nil {
+		return nil, errors.Wrap(err, "problem reading feedback for appointment "+appointmentID)
+	}
+	return feedbackFromNode(record.(*neo4j.Record).Values[0].(neo4j.Node), appointmentID)
+}
+
+func (w txWriter) GetFeedback(id string) (*Feedback, error) {
+	result, err := w.tx.Run(
+		`MATCH (a:Appointment)-[:FEEDBACK]->(f:Feedback { id:$id })
+		RETURN f, a.id`,
+		map[string]interface{}{
+			"id": id,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading feedback "+id)
+	}
+	record, err := single(result)
+	if record == nil || err != nil {
+		return nil, errors.Wrap(err, "problem reading feedback "+id)
+	}
+	values := record.(*neo4j.Record).Values
+	appointmentID, _ := values[1].(string)
+	return feedbackFromNode(values[0].(neo4j.Node), appointmentID)
+}
+
+func (w txWriter) SaveSurvey(survey Survey) error {
+	params := map[string]interface{}{
+		"id":      survey.ID,
+		"version": survey.Version,
+	}
+	if err := jsonParams(params, map[string]interface{}{
+		"definition": survey,
+	}); err != nil {
+		return errors.Wrap(err, "problem encoding survey "+survey.ID)
+	}
+	err := w.run(
+		`MERGE (s:Survey { id:$id, version:$version })
+		ON CREATE SET s.definition = $definition`,
+		params,
+	)
+	return errors.Wrapf(err, "problem saving survey %s version %d", survey.ID, survey.Version)
+}
+
+// GetSurvey returns the version of the survey with the id, or nil if it has not been saved.
+func (w txWriter) GetSurvey(id string, version int) (*Survey, error) {
+	result, err := w.tx.Run(
+		`MATCH (s:Survey { id:$id, version:$version })
+		RETURN s`,
+		map[string]interface{}{
+			"id":      id,
+			"version": version,
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading survey %s version %d", id, version)
+	}
+	record, err := single(result)
+	if record == nil || err != nil {
+		return nil, errors.Wrapf(err, "problem reading survey %s version %d", id, version)
+	}
+
+	var survey Survey
+	if err := jsonFromProps(record.(*neo4j.Record).Values[0].(neo4j.Node).Props, map[string]interface{}{
+		"definition": &survey,
+	}); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding survey %s version %d", id, version)
+	}
+	return &survey, nil
+}
@@ -0,0 +1,176 @@
+package sqlite
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// migrations are the statements to bring the schema from one version to the next; the schema version of a
+// database is the number of migrations applied to it, tracked in PRAGMA user_version.
+//
+// Append new migrations to the end. Never modify a migration that has been released.
+var migrations = []string{
+	// 1: initial schema
+	`
+	CREATE TABLE patients (
+		id   TEXT PRIMARY KEY,
+		name TEXT NOT NULL
+	);
+	CREATE TABLE doctors (
+		id   TEXT PRIMARY KEY,
+		name TEXT NOT NULL
+	);
+	CREATE TABLE appointments (
+		id         TEXT PRIMARY KEY,
+		status     TEXT NOT NULL,
+		type       TEXT NOT NULL,
+		patient_id TEXT NOT NULL,
+		doctor_id  TEXT NOT NULL
+	);
+	CREATE INDEX appointments_patient_id ON appointments (patient_id);
+	CREATE TABLE diagnoses (
+		id             TEXT PRIMARY KEY,
+		status         TEXT NOT NULL,
+		name           TEXT NOT NULL,
+		appointment_id TEXT NOT NULL
+	);
+	CREATE INDEX diagnoses_appointment_id ON diagnoses (appointment_id);
+	CREATE TABLE feedback (
+		id             TEXT PRIMARY KEY,
+		appointment_id TEXT NOT NULL UNIQUE REFERENCES appointments (id),
+		recommend      INTEGER NOT NULL,
+		explained      BOOLEAN NOT NULL,
+		feeling        TEXT NOT NULL
+	);
+	`,
+	// 2: identifiers of patients and doctors
+	`
+	CREATE TABLE identifiers (
+		resource_type TEXT NOT NULL,
+		system        TEXT NOT NULL,
+		value         TEXT NOT NULL,
+		resource_id   TEXT NOT NULL,
+		PRIMARY KEY (resource_type, system, value)
+	);
+	CREATE INDEX identifiers_resource ON identifiers (resource_type, resource_id);
+	`,
+	// 3: patient demographics; lists are stored as JSON like name
+	`
+	ALTER TABLE patients ADD COLUMN active BOOLEAN;
+	ALTER TABLE patients ADD COLUMN gender TEXT NOT NULL DEFAULT '';
+	ALTER TABLE patients ADD COLUMN birth_date TEXT NOT NULL DEFAULT '';
+	ALTER TABLE patients ADD COLUMN telecom TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE patients ADD COLUMN address TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE patients ADD COLUMN contact TEXT NOT NULL DEFAULT 'null';
+	`,
+	// 4: appointment period, type, location and participants; times are stored in timeLayout so that they
+	// sort chronologically
+	`
+	ALTER TABLE appointments ADD COLUMN start_time TEXT;
+	ALTER TABLE appointments ADD COLUMN end_time TEXT;
+	ALTER TABLE appointments ADD COLUMN appointment_type TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE appointments ADD COLUMN location TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE appointments ADD COLUMN participants TEXT NOT NULL DEFAULT 'null';
+	CREATE INDEX appointments_patient_id_start_time ON appointments (patient_id, start_time);
+	`,
+	// 5: diagnosis codes, with their codings indexed to find diagnoses by code
+	`
+	ALTER TABLE diagnoses ADD COLUMN code TEXT NOT NULL DEFAULT 'null';
+	CREATE TABLE diagnosis_codings (
+		diagnosis_id TEXT NOT NULL,
+		system       TEXT NOT NULL,
+		code         TEXT NOT NULL,
+		PRIMARY KEY (diagnosis_id, system, code)
+	);
+	CREATE INDEX diagnosis_codings_code ON diagnosis_codings (system, code);
+	`,
+	// 6: rank of the diagnoses of an appointment, and the diagnosis feedback is about
+	`
+	ALTER TABLE diagnoses ADD COLUMN rank INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE feedback ADD COLUMN diagnosis_id TEXT;
+	`,
+	// 7: practitioner roles of doctors; specialty is stored as JSON
+	`
+	CREATE TABLE practitioner_roles (
+		id        TEXT PRIMARY KEY,
+		doctor_id TEXT NOT NULL,
+		active    BOOLEAN,
+		specialty TEXT NOT NULL
+	);
+	CREATE INDEX practitioner_roles_doctor_id ON practitioner_roles (doctor_id);
+	`,
+	// 8: encounters, from which the appointment and rank of the diagnoses read from Conditions are derived
+	`
+	ALTER TABLE diagnoses ADD COLUMN encounter_id TEXT;
+	CREATE INDEX diagnoses_encounter_id ON diagnoses (encounter_id);
+	CREATE TABLE encounters (
+		id             TEXT PRIMARY KEY,
+		status         TEXT NOT NULL,
+		appointment_id TEXT
+	);
+	CREATE TABLE encounter_diagnoses (
+		encounter_id TEXT NOT NULL,
+		condition_id TEXT NOT NULL,
+		rank         INTEGER NOT NULL,
+		PRIMARY KEY (encounter_id, condition_id)
+	);
+	CREATE INDEX encounter_diagnoses_condition_id ON encounter_diagnoses (condition_id);
+	`,
+	// 9: feedback as answers to a configurable survey; the recommend, explained and feeling columns are only read
+	// for feedback saved before, which has no answers
+	`
+	ALTER TABLE feedback ADD COLUMN survey TEXT;
+	ALTER TABLE feedback ADD COLUMN answers TEXT;
+	`,
+	// 10: published survey versions, and the version feedback answers
+	`
+	CREATE TABLE surveys (
+		id         TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		definition TEXT NOT NULL,
+		PRIMARY KEY (id, version)
+	);
+	ALTER TABLE feedback ADD COLUMN survey_version INTEGER;
+	UPDATE feedback SET survey_version = 1 WHERE answers IS NOT NULL;
+	`,
+	// 11: the patient who submitted feedback, how and when
+	`
+	ALTER TABLE feedback ADD COLUMN author_id TEXT;
+	ALTER TABLE feedback ADD COLUMN channel TEXT;
+	ALTER TABLE feedback ADD COLUMN created_at TEXT;
+	ALTER TABLE feedback ADD COLUMN updated_at TEXT;
+	`,
+}
+
+// migrate applies the migrations the database has not seen yet, each in its own transaction.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return errors.Wrap(err, "problem reading schema version")
+	}
+	if version > len(migrations) {
+		return errors.Errorf("schema version %d is newer than the latest known version %d", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return errors.Wrap(err, "problem starting migration")
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "problem applying migration %d", i+1)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(`PRAGMA user_version = ` + strconv.Itoa(i+1)); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "problem recording migration %d", i+1)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "problem committing migration %d", i+1)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+// Package sqlite is a datastore in an SQLite database file. Its driver, go-sqlite3, uses cgo: built with
+// CGO_ENABLED=0, opening a database fails.
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+// New opens the SQLite database at path, creating it if it does not exist, and migrates its schema to the
+// latest version.
+func New(path string) (SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
+	if err != nil {
+		return SQLiteStore{}, errors.Wrap(err, "problem opening sqlite database "+path)
+	}
+	// sqlite allows a single writer at a time, so serialize access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return SQLiteStore{}, errors.Wrap(err, "problem migrating sqlite database "+path)
+	}
+
+	return SQLiteStore{
+		db: db,
+	}, nil
+}
+
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func (store SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+func (store SQLiteStore) GetPatient(id string) (*Patient, error) {
+	var (
+		patient = Patient{
+			ResourceTypeAndID: ResourceTypeAndID{
+				ResourceID:   id,
+				ResourceType: "Patient",
+			},
+		}
+		name, telecom, address, contact string
+		active                          sql.NullBool
+	)
+	err := store.db.QueryRow(
+		`SELECT name, telecom, address, contact, active, gender, birth_date FROM patients WHERE id = ?`,
+		id,
+	).Scan(&name, &telecom, &address, &contact, &active, &patient.Gender, &patient.BirthDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading patient "+id)
+	}
+
+	for _, column := range []struct {
+		data  string
+		value interface{}
+	}{
+		{name, &patient.Name},
+		{telecom, &patient.Telecom},
+		{address, &patient.Address},
+		{contact, &patient.Contacts},
+	} {
+		if err := json.Unmarshal([]byte(column.data), column.value); err != nil {
+			return nil, errors.Wrap(err, "problem decoding patient "+id)
+		}
+	}
+	if active.Valid {
+		patient.Active = &active.Bool
+	}
+	if patient.Identifiers, err = store.identifiers("Patient", id); err != nil {
+		return nil, errors.Wrap(err, "problem reading identifiers of patient "+id)
+	}
+	return &patient, nil
+}
+
+func (store SQLiteStore) GetDoctor(id string) (*Doctor, error) {
+	var name string
+	err := store.db.QueryRow(`SELECT name FROM doctors WHERE id = ?`, id).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading doctor "+id)
+	}
+
+	doctor := Doctor{
+		ResourceTypeAndID: ResourceTypeAndID{
+			ResourceID:   id,
+			ResourceType: "Doctor",
+		},
+	}
+	if err := json.Unmarshal([]byte(name), &doctor.Name); err != nil {
+		return nil, errors.Wrap(err, "problem decoding name of doctor "+id)
+	}
+	if doctor.Identifiers, err = store.identifiers("Doctor", id); err != nil {
+		return nil, errors.Wrap(err, "problem reading identifiers of doctor "+id)
+	}
+	if doctor.Roles, err = store.roles(id); err != nil {
+		return nil, errors.Wrap(err, "problem reading roles of doctor "+id)
+	}
+	return &doctor, nil
+}
+
+// roles returns the practitioner roles of the doctor, ordered by id.
+func (store SQLiteStore) roles(doctorID string) ([]PractitionerRole, error) {
+	rows, err := store.db.Query(
+		`SELECT id, active, specialty FROM practitioner_roles WHERE doctor_id = ? ORDER BY id`,
+		doctorID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []PractitionerRole
+	for rows.Next() {
+		var (
+			role = PractitionerRole{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceType: "PractitionerRole"},
+				Practitioner:      Reference{ResourceID: doctorID, ResourceType: "Doctor"},
+			}
+			active    sql.NullBool
+			specialty string
+		)
+		if err := rows.Scan(&role.ResourceID, &active, &specialty); err != nil {
+			return nil, err
+		}
+		if active.Valid {
+			role.Active = &active.Bool
+		}
+		if err := json.Unmarshal([]byte(specialty), &role.Specialty); err != nil {
+			return nil, errors.Wrap(err, "problem decoding specialty of practitioner role "+role.ResourceID)
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// identifiers returns the identifiers of the resource in the order they were written.
+func (store SQLiteStore) identifiers(resourceType, id string) ([]Identifier, error) {
+	rows, err := store.db.Query(
+		`SELECT system, value FROM identifiers WHERE resource_type = ? AND resource_id = ? ORDER BY rowid`,
+		resourceType, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identifiers []Identifier
+	for rows.Next() {
+		var identifier Identifier
+		if err := rows.Scan(&identifier.System, &identifier.Value); err != nil {
+			return nil, err
+		}
+		identifiers = append(identifiers, identifier)
+	}
+	return identifiers, rows.Err()
+}
+
+// appointmentQuery selects appointments joined with their feedback, in the column order read by
+// scanAppointment. Diagnoses are read separately by diagnoses.
+const appointmentQuery = `
+	SELECT a.id, a.status, a.type, a.patient_id, a.doctor_id,
+		a.start_time, a.end_time, a.appointment_type, a.location, a.participants,
+		f.id
+	FROM appointments a
+	LEFT JOIN feedback f ON f.appointment_id = a.id`
+
+// diagnosisQuery selects diagnoses in the column order read by scanDiagnosis.
+const diagnosisQuery = `
+	SELECT d.id, d.status, d.name, d.code, d.rank, d.appointment_id, d.encounter_id
+	FROM diagnoses d`
+
+func (store SQLiteStore) GetAppointment(id string) (*Appointment, error) {
+	return writer{store.db}.GetAppointment(id)
+}
+
+// diagnoses returns the diagnoses of the appointment in rank order, see Diagnosis.Before.
+func (w writer) diagnoses(appointmentID string) ([]Diagnosis, error) {
+	rows, err := w.db.Query(
+		diagnosisQuery+` WHERE d.appointment_id = ? ORDER BY d.rank = 0, d.rank, d.id`,
+		appointmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var diagnoses []Diagnosis
+	for rows.Next() {
+		diagnosis, err := scanDiagnosis(rows)
+		if err != nil {
+			return nil, err
+		}
+		diagnoses = append(diagnoses, *diagnosis)
+	}
+	return diagnoses, rows.Err()
+}
+
+func (store SQLiteStore) GetPatientAppointments(patientID string) ([]Appointment, error) {
+	rows, err := store.db.Query(appointmentQuery+` WHERE a.patient_id = ? ORDER BY a.start_time IS NULL, a.start_time, a.id`, patientID)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading appointments for patient "+patientID)
+	}
+	defer rows.Close()
+
+	var apps []Appointment
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem reading appointments for patient "+patientID)
+		}
+		apps = append(apps, *appointment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "problem reading appointments for patient "+patientID)
+	}
+	// the single connection is busy until the rows are closed, so diagnoses are read after
+	rows.Close()
+	for i := range apps {
+		if apps[i].Diagnoses, err = (writer{store.db}).diagnoses(apps[i].ID()); err != nil {
+			return nil, errors.Wrap(err, "problem reading diagnoses of appointment "+apps[i].ID())
+		}
+	}
+	return apps, nil
+}
+
+func scanAppointment(row interface{ Scan(...interface{}) error }) (*Appointment, error) {
+	var (
+		appointment                             Appointment
+		feedbackID                              sql.NullString
+		start, end                              sql.NullString
+		appointmentType, location, participants string
+	)
+	err := row.Scan(
+		&appointment.ResourceID, &appointment.Status, &appointment.Description,
+		&appointment.Subject.ResourceID, &appointment.Actor.ResourceID,
+		&start, &end, &appointmentType, &location, &participants,
+		&feedbackID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if appointment.Period.Start, err = parseTimeColumn(start); err != nil {
+		return nil, err
+	}
+	if appointment.Period.End, err = parseTimeColumn(end); err != nil {
+		return nil, err
+	}
+	for _, column := range []struct {
+		data  string
+		value interface{}
+	}{
+		{appointmentType, &appointment.AppointmentType},
+		{location, &appointment.Location},
+		{participants, &appointment.Participants},
+	} {
+		if err := json.Unmarshal([]byte(column.data), column.value); err != nil {
+			return nil, errors.Wrap(err, "problem decoding appointment "+appointment.ResourceID)
+		}
+	}
+
+	appointment.ResourceType = "Appointment"
+	appointment.Subject.ResourceType = "Patient"
+	appointment.Actor.ResourceType = "Doctor"
+	if feedbackID.Valid {
+		appointment.Feedback = &Reference{
+			ResourceID:   feedbackID.String,
+			ResourceType: "Feedback",
+		}
+	}
+	return &appointment, nil
+}
+
+func scanDiagnosis(row interface{ Scan(...interface{}) error }) (*Diagnosis, error) {
+	var (
+		diagnosis = Diagnosis{
+			ResourceTypeAndID: ResourceTypeAndID{ResourceType: "Diagnosis"},
+		}
+		name, code, appointmentID string
+		encounterID               sql.NullString
+	)
+	err := row.Scan(
+		&diagnosis.ResourceID, &diagnosis.Status, &name, &code, &diagnosis.Rank, &appointmentID, &encounterID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// a diagnosis read from a Condition has no appointment until its encounter is written
+	if appointmentID != "" {
+		diagnosis.Appointment = Reference{ResourceID: appointmentID, ResourceType: "Appointment"}
+	}
+	if encounterID.Valid {
+		diagnosis.Encounter = &Reference{ResourceID: encounterID.String, ResourceType: "Encounter"}
+	}
+	if diagnosis.Code, err = decodeCode(code, name); err != nil {
+		return nil, errors.Wrap(err, "problem decoding diagnosis "+diagnosis.ResourceID)
+	}
+	return &diagnosis, nil
+}
+
+// decodeCode decodes the code of a diagnosis. Diagnoses written before codes were stored only have a name, which
+// is taken as the text of the code.
+func decodeCode(code, name string) (CodeableConcept, error) {
+	var concept CodeableConcept
+	if code != "" && code != "null" {
+		if err := json.Unmarshal([]byte(code), &concept); err != nil {
+			return concept, err
+		}
+	}
+	if concept.Text == "" && len(concept.Coding) == 0 {
+		concept.Text = name
+	}
+	return concept, nil
+}
+
+// GetDiagnosesByCode returns the diagnoses with a coding of the code in the system, ordered by id.
+func (store SQLiteStore) GetDiagnosesByCode(system, code string) ([]Diagnosis, error) {
+	rows, err := store.db.Query(
+		diagnosisQuery+`
+		JOIN diagnosis_codings c ON c.diagnosis_id = d.id
+		WHERE c.system = ? AND c.code = ?
+		ORDER BY d.id`,
+		system, code,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading diagnoses with code %s|%s", system, code)
+	}
+	defer rows.Close()
+
+	var diagnoses []Diagnosis
+	for rows.Next() {
+		diagnosis, err := scanDiagnosis(rows)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem reading diagnoses with code %s|%s", system, code)
+		}
+		diagnoses = append(diagnoses, *diagnosis)
+	}
+	return diagnoses, errors.Wrapf(rows.Err(), "problem reading diagnoses with code %s|%s", system, code)
+}
+
+// parseTimeColumn parses a time stored in timeLayout, returning nil for NULL.
+func parseTimeColumn(column sql.NullString) (*time.Time, error) {
+	if !column.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(timeLayout, column.String)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem parsing time")
+	}
+	return &t, nil
+}
+
+// SavePatientFeedback saves the feedback for the appointment, replacing any previously saved feedback.
+//
+// Returns an error if the appointment does not exist.
+func (store SQLiteStore) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	return writer{store.db}.SavePatientFeedback(appointmentID, feedback)
+}
+
+func (store SQLiteStore) GetPatientFeedback(appointmentID string) (*Feedback, error) {
+	return writer{store.db}.GetPatientFeedback(appointmentID)
+}
+
+func (store SQLiteStore) GetFeedback(id string) (*Feedback, error) {
+	return writer{store.db}.GetFeedback(id)
+}
+
+// SaveSurvey saves the version of the survey unless that version has been saved already.
+func (store SQLiteStore) SaveSurvey(survey Survey) error {
+	return writer{store.db}.SaveSurvey(survey)
+}
+
+func (store SQLiteStore) GetSurvey(id string, version int) (*Survey, error) {
+	return writer{store.db}.GetSurvey(id, version)
+}
+
+// diagnosisID returns the id of the diagnosis the feedback is about, or nil if it has none.
+func diagnosisID(feedback Feedback) interface{} {
+	if feedback.Diagnosis == nil {
+		return nil
+	}
+	return feedback.Diagnosis.ResourceID
+}
+
+// authorID returns the id of the patient who submitted the feedback, or nil if it is not known.
+func authorID(feedback Feedback) interface{} {
+	if feedback.Author == nil {
+		return nil
+	}
+	return feedback.Author.ResourceID
+}
+
+// channel returns the channel the feedback was submitted by, or nil if it is not known.
+func channel(feedback Feedback) interface{} {
+	if feedback.Channel == "" {
+		return nil
+	}
+	return string(feedback.Channel)
+}
@@ -0,0 +1,45 @@
+package sqlite_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/datastore/datastoretest"
+	"github.com/scraymondjr/appointment/datastore/sqlite"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+func TestSQLiteStore_Conformance(t *testing.T) {
+	store, err := sqlite.New(filepath.Join(t.TempDir(), "appointment.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	datastoretest.Run(t, func(t *testing.T) datastoretest.Store {
+		return store
+	})
+}
+
+func TestNew_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appointment.db")
+	patient := internal.Patient{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "testpatient", ResourceType: "Patient"},
+		Name:              []internal.Name{{Text: "Tendo Tenderson", Family: "Tenderson", Given: []string{"Tendo"}}},
+	}
+
+	store, err := sqlite.New(path)
+	require.NoError(t, err)
+	require.NoError(t, store.WritePatient(patient))
+	require.NoError(t, store.Close())
+
+	// migrations must not be re-applied to an up-to-date database
+	store, err = sqlite.New(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	stored, err := store.GetPatient(patient.ID())
+	require.NoError(t, err)
+	assert.Equal(t, &patient, stored)
+}
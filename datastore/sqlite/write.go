@@ -0,0 +1,534 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+var (
+	_ TransactionalWriter = SQLiteStore{}
+	_ ResourceLookup      = SQLiteStore{}
+	_ ResourceLookup      = writer{}
+	_ IdentifierLookup    = SQLiteStore{}
+	_ IdentifierLookup    = writer{}
+	_ SurveyWriter        = writer{}
+	_ FeedbackWriter      = writer{}
+)
+
+// WritePatient writes the patient and its identifiers in a single transaction.
+func (store SQLiteStore) WritePatient(p Patient) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WritePatient(p)
+	})
+}
+
+// WriteDoctor writes the doctor and its identifiers in a single transaction.
+func (store SQLiteStore) WriteDoctor(d Doctor) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteDoctor(d)
+	})
+}
+
+func (store SQLiteStore) WriteAppointment(a Appointment) error {
+	return writer{store.db}.WriteAppointment(a)
+}
+
+// WriteDiagnosis writes the diagnosis and its codings in a single transaction.
+func (store SQLiteStore) WriteDiagnosis(d Diagnosis) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteDiagnosis(d)
+	})
+}
+
+func (store SQLiteStore) WritePractitionerRole(r PractitionerRole) error {
+	return writer{store.db}.WritePractitionerRole(r)
+}
+
+// WriteEncounter writes the encounter and links the diagnoses belonging to it in a single transaction.
+func (store SQLiteStore) WriteEncounter(e Encounter) error {
+	return store.WriteTransaction(func(w ResourceWriter) error {
+		return w.WriteEncounter(e)
+	})
+}
+
+func (store SQLiteStore) HasResource(resourceType, id string) (bool, error) {
+	return writer{store.db}.HasResource(resourceType, id)
+}
+
+func (store SQLiteStore) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	return writer{store.db}.FindByIdentifier(resourceType, identifier)
+}
+
+// WriteTransaction runs fn in a single database transaction.
+func (store SQLiteStore) WriteTransaction(fn func(ResourceWriter) error) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "problem starting transaction")
+	}
+	if err := fn(writer{tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "problem committing transaction")
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// writer writes resources to the database, or to a transaction.
+type writer struct {
+	db execer
+}
+
+// tables are the tables of the resource types that are stored.
+var tables = map[string]string{
+	"Patient":          "patients",
+	"Doctor":           "doctors",
+	"Appointment":      "appointments",
+	"Diagnosis":        "diagnoses",
+	"PractitionerRole": "practitioner_roles",
+	"Encounter":        "encounters",
+}
+
+func (w writer) HasResource(resourceType, id string) (bool, error) {
+	table, ok := tables[resourceType]
+	if !ok {
+		return false, errors.Errorf("unknown resource type " + resourceType)
+	}
+	var exists bool
+	// table names cannot be query parameters; table is from the fixed set above
+	err := w.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id = ?)`, id).Scan(&exists)
+	return exists, errors.Wrap(err, "problem looking up "+resourceType+" "+id)
+}
+
+// FindByIdentifier returns the id of the patient or doctor with the identifier, or "" if there is none.
+func (w writer) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	var id string
+	err := w.db.QueryRow(
+		`SELECT resource_id FROM identifiers WHERE resource_type = ? AND system = ? AND value = ?`,
+		resourceType, identifier.System, identifier.Value,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return id, errors.Wrapf(err, "problem finding %s with identifier %s", resourceType, identifier)
+}
+
+// writeIdentifiers replaces the identifiers of the resource. An identifier belonging to another resource of the
+// same type is moved to this one.
+func (w writer) writeIdentifiers(resourceType, id string, identifiers []Identifier) error {
+	if _, err := w.db.Exec(`DELETE FROM identifiers WHERE resource_type = ? AND resource_id = ?`, resourceType, id); err != nil {
+		return err
+	}
+	for _, identifier := range identifiers {
+		_, err := w.db.Exec(
+			`INSERT INTO identifiers (resource_type, system, value, resource_id) VALUES (?, ?, ?, ?)
+			ON CONFLICT (resource_type, system, value) DO UPDATE SET resource_id = excluded.resource_id`,
+			resourceType, identifier.System, identifier.Value, id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w writer) WritePatient(p Patient) error {
+	lists, err := jsonColumns(p.Name, p.Telecom, p.Address, p.Contacts)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding patient "+p.ID())
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO patients (id, name, telecom, address, contact, active, gender, birth_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name,
+			telecom = excluded.telecom,
+			address = excluded.address,
+			contact = excluded.contact,
+			active = excluded.active,
+			gender = excluded.gender,
+			birth_date = excluded.birth_date`,
+		p.ID(), lists[0], lists[1], lists[2], lists[3], p.Active, p.Gender, p.BirthDate,
+	)
+	if err == nil {
+		err = w.writeIdentifiers("Patient", p.ID(), p.Identifiers)
+	}
+	if err != nil {
+		return errors.Wrap(err, "problem saving patient "+p.ID())
+	}
+	return nil
+}
+
+// jsonColumns encodes the values as JSON, for columns storing lists.
+func jsonColumns(values ...interface{}) ([]string, error) {
+	columns := make([]string, len(values))
+	for i, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		columns[i] = string(data)
+	}
+	return columns, nil
+}
+
+// timeLayout is the format of times stored in the database: UTC and fixed width, so that they sort
+// chronologically as text.
+const timeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// timeColumn returns t in timeLayout, or nil if t is nil.
+func timeColumn(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(timeLayout)
+}
+
+func (w writer) WriteDoctor(d Doctor) error {
+	name, err := json.Marshal(d.Name)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding name of doctor "+d.ID())
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO doctors (id, name) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name`,
+		d.ID(), string(name),
+	)
+	if err == nil {
+		err = w.writeIdentifiers("Doctor", d.ID(), d.Identifiers)
+	}
+	if err != nil {
+		return errors.Wrap(err, "problem saving doctor "+d.ID())
+	}
+	return nil
+}
+
+func (w writer) WriteAppointment(a Appointment) error {
+	lists, err := jsonColumns(a.AppointmentType, a.Location, a.Participants)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding appointment "+a.ID())
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO appointments (id, status, type, patient_id, doctor_id,
+			start_time, end_time, appointment_type, location, participants)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status,
+			type = excluded.type,
+			patient_id = excluded.patient_id,
+			doctor_id = excluded.doctor_id,
+			start_time = excluded.start_time,
+			end_time = excluded.end_time,
+			appointment_type = excluded.appointment_type,
+			location = excluded.location,
+			participants = excluded.participants`,
+		a.ID(), a.Status, a.Description, a.Subject.ResourceID, a.Actor.ResourceID,
+		timeColumn(a.Period.Start), timeColumn(a.Period.End), lists[0], lists[1], lists[2],
+	)
+	if err != nil {
+		return errors.Wrap(err, "problem saving appointment "+a.ID())
+	}
+	return nil
+}
+
+func (w writer) WriteDiagnosis(d Diagnosis) error {
+	code, err := json.Marshal(d.Code)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding code of diagnosis "+d.ID())
+	}
+	var encounterID interface{}
+	if d.Encounter != nil {
+		encounterID = d.Encounter.ResourceID
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO diagnoses (id, status, name, code, rank, appointment_id, encounter_id) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status,
+			name = excluded.name,
+			code = excluded.code,
+			rank = excluded.rank,
+			appointment_id = excluded.appointment_id,
+			encounter_id = excluded.encounter_id`,
+		d.ID(), d.Status, d.Name(), string(code), d.Rank, d.Appointment.ResourceID, encounterID,
+	)
+	if err == nil {
+		err = w.writeCodings(d.ID(), d.Code.Coding)
+	}
+	if err == nil {
+		_, err = w.db.Exec(linkDiagnoses+`WHERE id = ?`, d.ID())
+	}
+	if err != nil {
+		return errors.Wrap(err, "problem saving diagnosis "+d.ID())
+	}
+	return nil
+}
+
+func (w writer) WritePractitionerRole(r PractitionerRole) error {
+	specialty, err := json.Marshal(r.Specialty)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding specialty of practitioner role "+r.ID())
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO practitioner_roles (id, doctor_id, active, specialty) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			doctor_id = excluded.doctor_id,
+			active = excluded.active,
+			specialty = excluded.specialty`,
+		r.ID(), r.Practitioner.ResourceID, r.Active, string(specialty),
+	)
+	return errors.Wrap(err, "problem saving practitioner role "+r.ID())
+}
+
+// ownerEncounter is the id of the encounter a diagnosis belongs to, see Encounter.Link.
+const ownerEncounter = `COALESCE(diagnoses.encounter_id,
+	(SELECT MIN(encounter_id) FROM encounter_diagnoses WHERE condition_id = diagnoses.id))`
+
+// linkDiagnoses derives the appointment and rank of the diagnoses selected by the WHERE clause appended to it
+// from the encounter they belong to, if that has been written.
+const linkDiagnoses = `
+	UPDATE diagnoses SET
+		appointment_id = COALESCE(
+			(SELECT appointment_id FROM encounters WHERE id = ` + ownerEncounter + `),
+			appointment_id),
+		rank = COALESCE(
+			(SELECT rank FROM encounter_diagnoses WHERE encounter_id = ` + ownerEncounter + ` AND condition_id = diagnoses.id),
+			rank)
+	`
+
+func (w writer) WriteEncounter(e Encounter) error {
+	var appointmentID interface{}
+	if ref := e.Appointment(); ref != nil {
+		appointmentID = ref.ResourceID
+	}
+	_, err := w.db.Exec(
+		`INSERT INTO encounters (id, status, appointment_id) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			status = excluded.status,
+			appointment_id = excluded.appointment_id`,
+		e.ID(), e.Status, appointmentID,
+	)
+	if err == nil {
+		_, err = w.db.Exec(`DELETE FROM encounter_diagnoses WHERE encounter_id = ?`, e.ID())
+	}
+	for _, diagnosis := range e.Diagnoses {
+		if err != nil {
+			break
+		}
+		_, err = w.db.Exec(
+			`INSERT INTO encounter_diagnoses (encounter_id, condition_id, rank) VALUES (?, ?, ?)
+			ON CONFLICT DO UPDATE SET rank = excluded.rank`,
+			e.ID(), diagnosis.Condition.ResourceID, diagnosis.Rank,
+		)
+	}
+	if err == nil {
+		_, err = w.db.Exec(
+			linkDiagnoses+`WHERE encounter_id = ? OR id IN (SELECT condition_id FROM encounter_diagnoses WHERE encounter_id = ?)`,
+			e.ID(), e.ID(),
+		)
+	}
+	return errors.Wrap(err, "problem saving encounter "+e.ID())
+}
+
+// writeCodings replaces the codings of the diagnosis.
+func (w writer) writeCodings(diagnosisID string, codings []Coding) error {
+	if _, err := w.db.Exec(`DELETE FROM diagnosis_codings WHERE diagnosis_id = ?`, diagnosisID); err != nil {
+		return err
+	}
+	for _, coding := range codings {
+		_, err := w.db.Exec(
+			`INSERT INTO diagnosis_codings (diagnosis_id, system, code) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING`,
+			diagnosisID, coding.System, coding.Code,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePatientFeedback saves the feedback for the appointment, keeping the id and creation time of the feedback
+// it replaces, or else those of the feedback if it has them, and reads it back.
+//
+// Returns an error caused by ErrFeedbackIDTaken if the appointment has no feedback and the id of the feedback is
+// that of the feedback about another appointment.
+func (w writer) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	answers, err := json.Marshal(feedback.Answers)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem encoding feedback for appointment "+appointmentID)
+	}
+	now := time.Now()
+	id, createdAt := feedback.ID(), feedback.CreatedAt
+	if id == "" {
+		id = uuid.New().String()
+	} else if id, err = w.feedbackID(appointmentID, id); err != nil {
+		return nil, err
+	}
+	if createdAt == nil {
+		createdAt = &now
+	}
+	result, err := w.db.Exec(
+		`INSERT INTO feedback (id, appointment_id, recommend, explained, feeling, survey, survey_version, answers,
+			diagnosis_id, author_id, channel, created_at, updated_at)
+		SELECT ?, id, 0, FALSE, '', ?, ?, ?, ?, ?, ?, ?, ? FROM appointments WHERE id = ?
+		ON CONFLICT (appointment_id) DO UPDATE SET
+			survey = excluded.survey,
+			survey_version = excluded.survey_version,
+			answers = excluded.answers,
+			diagnosis_id = excluded.diagnosis_id,
+			author_id = excluded.author_id,
+			channel = excluded.channel,
+			created_at = coalesce(created_at, excluded.created_at),
+			updated_at = excluded.updated_at`,
+		id, feedback.Survey, feedback.SurveyVersion, string(answers), diagnosisID(feedback),
+		authorID(feedback), channel(feedback), timeColumn(createdAt), timeColumn(&now),
+		appointmentID,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem saving feedback for appointment "+appointmentID)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return nil, errors.Errorf("appointment %s not found", appointmentID)
+	}
+	return w.GetPatientFeedback(appointmentID)
+}
+
+// feedbackID returns the id to save feedback with the id for the appointment under: the id of the feedback it
+// replaces, if any, or else the id, unless the feedback about another appointment has it.
+func (w writer) feedbackID(appointmentID, id string) (string, error) {
+	var other string
+	err := w.db.QueryRow(`SELECT appointment_id FROM feedback WHERE id = ?`, id).Scan(&other)
+	if err == sql.ErrNoRows || (err == nil && other == appointmentID) {
+		return id, nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "problem reading feedback "+id)
+	}
+	previous, err := w.GetPatientFeedback(appointmentID)
+	if err != nil {
+		return "", err
+	}
+	if previous == nil {
+		return "", errors.Wrap(ErrFeedbackIDTaken, "problem saving feedback for appointment "+appointmentID)
+	}
+	return previous.ID(), nil
+}
+
+func (w writer) GetAppointment(id string) (*Appointment, error) {
+	appointment, err := scanAppointment(w.db.QueryRow(appointmentQuery+` WHERE a.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err == nil {
+		appointment.Diagnoses, err = w.diagnoses(id)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading appointment "+id)
+	}
+	return appointment, nil
+}
+
+func (w writer) GetPatientFeedback(appointmentID string) (*Feedback, error) {
+	return w.feedback(`appointment_id = ?`, appointmentID, "for appointment "+appointmentID)
+}
+
+func (w writer) GetFeedback(id string) (*Feedback, error) {
+	return w.feedback(`id = ?`, id, id)
+}
+
+// feedback reads the feedback matching where, or returns nil if there is none. Feedback saved before feedback
+// answered a survey has no answers, and is read from its recommend, explained and feeling columns.
+func (w writer) feedback(where string, arg interface{}, description string) (*Feedback, error) {
+	var (
+		id, appointmentID    string
+		recommend            int
+		explained            bool
+		feeling              string
+		survey, answers      sql.NullString
+		surveyVersion        sql.NullInt64
+		diagnosisID          sql.NullString
+		authorID, channel    sql.NullString
+		createdAt, updatedAt sql.NullString
+	)
+	err := w.db.QueryRow(
+		`SELECT id, appointment_id, recommend, explained, feeling, survey, survey_version, answers, diagnosis_id,
+			author_id, channel, created_at, updated_at
+		FROM feedback WHERE `+where,
+		arg,
+	).Scan(&id, &appointmentID, &recommend, &explained, &feeling, &survey, &surveyVersion, &answers, &diagnosisID,
+		&authorID, &channel, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "problem reading feedback "+description)
+	}
+	feedback := LegacyFeedback(recommend, explained, feeling)
+	if answers.Valid {
+		feedback = Feedback{Survey: survey.String, SurveyVersion: int(surveyVersion.Int64)}
+		if err := json.Unmarshal([]byte(answers.String), &feedback.Answers); err != nil {
+			return nil, errors.Wrap(err, "problem decoding feedback "+description)
+		}
+	}
+	feedback.ResourceTypeAndID = ResourceTypeAndID{ResourceID: id, ResourceType: "Feedback"}
+	feedback.Appointment = Reference{ResourceID: appointmentID, ResourceType: "Appointment"}
+	feedback.Channel = FeedbackChannel(channel.String)
+	if diagnosisID.Valid {
+		feedback.Diagnosis = &Reference{
+			ResourceID:   diagnosisID.String,
+			ResourceType: "Diagnosis",
+		}
+	}
+	if authorID.Valid {
+		feedback.Author = &Reference{
+			ResourceID:   authorID.String,
+			ResourceType: "Patient",
+		}
+	}
+	if feedback.CreatedAt, err = parseTimeColumn(createdAt); err != nil {
+		return nil, err
+	}
+	if feedback.UpdatedAt, err = parseTimeColumn(updatedAt); err != nil {
+		return nil, err
+	}
+	return &feedback, nil
+}
+
+func (w writer) SaveSurvey(survey Survey) error {
+	definition, err := json.Marshal(survey)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding survey "+survey.ID)
+	}
+	_, err = w.db.Exec(
+		`INSERT INTO surveys (id, version, definition) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+		survey.ID, survey.Version, string(definition),
+	)
+	return errors.Wrapf(err, "problem saving survey %s version %d", survey.ID, survey.Version)
+}
+
+func (w writer) GetSurvey(id string, version int) (*Survey, error) {
+	var definition string
+	err := w.db.QueryRow(`SELECT definition FROM surveys WHERE id = ? AND version = ?`, id, version).Scan(&definition)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading survey %s version %d", id, version)
+	}
+	var survey Survey
+	if err := json.Unmarshal([]byte(definition), &survey); err != nil {
+		return nil, errors.Wrapf(err, "problem decoding survey %s version %d", id, version)
+	}
+	return &survey, nil
+}
@@ -1,49 +1,538 @@
 package datastore
 
-import . "github.com/scraymondjr/appointment/internal"
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
 
 type Store interface {
 	GetPatient(id string) (*Patient, error)
 	GetDoctor(id string) (*Doctor, error)
 	GetPatientAppointments(patientID string) ([]Appointment, error)
-	SavePatientFeedback(appointmentID string, feedback Feedback) error
+	// SavePatientFeedback saves the feedback for the appointment, replacing any previously saved feedback, and
+	// returns it as saved: with the id of the feedback it replaces, or a new one, and its times set.
+	SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error)
 	GetPatientFeedback(appointmentID string) (*Feedback, error)
+	// GetFeedback returns the feedback with the id, or nil if there is none.
+	GetFeedback(id string) (*Feedback, error)
 	GetAppointment(id string) (*Appointment, error)
+	// GetDiagnosesByCode returns the diagnoses with a coding of the code in the system, such as
+	// CodeSystemICD10, ordered by id.
+	GetDiagnosesByCode(system, code string) ([]Diagnosis, error)
+	// SaveSurvey saves the version of the survey unless that version has been saved already, as versions are
+	// immutable, see PublishSurvey.
+	SaveSurvey(survey Survey) error
+	// GetSurvey returns the version of the survey with the id, or nil if it has not been saved.
+	GetSurvey(id string, version int) (*Survey, error)
 }
 
-func NewMemStore() MemStore {
-	return MemStore{
+var (
+	_ Store               = (*MemStore)(nil)
+	_ TransactionalWriter = (*MemStore)(nil)
+	_ ResourceLookup      = (*MemStore)(nil)
+	_ IdentifierLookup    = (*MemStore)(nil)
+	_ SurveyWriter        = (*MemStore)(nil)
+	_ FeedbackWriter      = (*MemStore)(nil)
+	_ SurveyWriter        = memTx{}
+	_ FeedbackWriter      = memTx{}
+)
+
+func NewMemStore() *MemStore {
+	return &MemStore{
 		Patients:     map[string]Patient{},
 		Doctors:      map[string]Doctor{},
 		Appointments: map[string]Appointment{},
 		Diagnoses:    map[string]Diagnosis{},
+		Roles:        map[string]PractitionerRole{},
+		Encounters:   map[string]Encounter{},
+		Feedback:     map[string]Feedback{},
+		FeedbackIDs:  map[string]string{},
+		Surveys:      map[string]map[int]Survey{},
 	}
 }
 
+// MemStore is an in-memory Store and ResourceWriter. It is safe for concurrent use.
 type MemStore struct {
-	Store
+	mu sync.RWMutex
+
 	Patients     map[string]Patient
 	Doctors      map[string]Doctor
 	Appointments map[string]Appointment
 	Diagnoses    map[string]Diagnosis
+	Roles        map[string]PractitionerRole
+	Encounters   map[string]Encounter
+	Feedback     map[string]Feedback       // keyed by appointment id
+	FeedbackIDs  map[string]string         // appointment id by feedback id
+	Surveys      map[string]map[int]Survey // keyed by id, then version
 }
 
-func (s MemStore) WritePatient(patient Patient) error {
+func (s *MemStore) WritePatient(patient Patient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Patients[patient.ID()] = patient
 	return nil
 }
 
-func (s MemStore) WriteDoctor(doctor Doctor) error {
+func (s *MemStore) WriteDoctor(doctor Doctor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Doctors[doctor.ID()] = doctor
 	return nil
 }
 
-func (s MemStore) WriteAppointment(appointment Appointment) error {
+func (s *MemStore) WriteAppointment(appointment Appointment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Appointments[appointment.ID()] = appointment
 	return nil
 }
 
-func (s MemStore) WriteDiagnosis(diagnosis Diagnosis) error {
-	s.Diagnoses[diagnosis.ID()] = diagnosis
+func (s *MemStore) WriteDiagnosis(diagnosis Diagnosis) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Diagnoses[diagnosis.ID()] = s.link(diagnosis)
+	return nil
+}
+
+// WriteEncounter writes the encounter and links the diagnoses belonging to it, see Encounter.Link.
+func (s *MemStore) WriteEncounter(encounter Encounter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Encounters[encounter.ID()] = encounter
+	s.relink(encounter)
+	return nil
+}
+
+// link returns the diagnosis linked to the encounter it belongs to, if that has been written. Caller must hold
+// the lock.
+func (s *MemStore) link(diagnosis Diagnosis) Diagnosis {
+	if diagnosis.Encounter != nil {
+		if encounter, ok := s.Encounters[diagnosis.Encounter.ResourceID]; ok {
+			return encounter.Link(diagnosis)
+		}
+		return diagnosis
+	}
+	var owner *Encounter
+	for _, encounter := range s.Encounters {
+		if encounter.FindDiagnosis(diagnosis.ID()) != nil && (owner == nil || encounter.ID() < owner.ID()) {
+			encounter := encounter
+			owner = &encounter
+		}
+	}
+	if owner == nil {
+		return diagnosis
+	}
+	return owner.Link(diagnosis)
+}
+
+// relink links the written diagnoses that may belong to the encounter. Caller must hold the lock.
+func (s *MemStore) relink(encounter Encounter) {
+	for id, diagnosis := range s.Diagnoses {
+		madeIn := diagnosis.Encounter != nil && diagnosis.Encounter.ResourceID == encounter.ID()
+		if madeIn || encounter.FindDiagnosis(id) != nil {
+			s.Diagnoses[id] = s.link(diagnosis)
+		}
+	}
+}
+
+func (s *MemStore) WritePractitionerRole(role PractitionerRole) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Roles[role.ID()] = role
+	return nil
+}
+
+// WriteTransaction stages the writes of fn in a separate MemStore and copies them into s once fn succeeds. The
+// write lock is held throughout, so other writes wait for the transaction rather than interleave with it, and
+// reads see either none or all of its writes. fn must only use the ResourceWriter it is given.
+func (s *MemStore) WriteTransaction(fn func(ResourceWriter) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staged := NewMemStore()
+	if err := fn(memTx{staged, s}); err != nil {
+		return err
+	}
+
+	for id, patient := range staged.Patients {
+		s.Patients[id] = patient
+	}
+	for id, doctor := range staged.Doctors {
+		s.Doctors[id] = doctor
+	}
+	for id, appointment := range staged.Appointments {
+		s.Appointments[id] = appointment
+	}
+	for id, role := range staged.Roles {
+		s.Roles[id] = role
+	}
+	// diagnoses and encounters are linked again against the committed ones
+	for id, encounter := range staged.Encounters {
+		s.Encounters[id] = encounter
+	}
+	for id, diagnosis := range staged.Diagnoses {
+		s.Diagnoses[id] = s.link(diagnosis)
+	}
+	for _, encounter := range staged.Encounters {
+		s.relink(encounter)
+	}
+	for appointmentID, feedback := range staged.Feedback {
+		s.Feedback[appointmentID] = feedback
+		s.FeedbackIDs[feedback.ID()] = appointmentID
+	}
+	for id, versions := range staged.Surveys {
+		if s.Surveys[id] == nil {
+			s.Surveys[id] = map[int]Survey{}
+		}
+		for version, survey := range versions {
+			if _, ok := s.Surveys[id][version]; !ok {
+				s.Surveys[id][version] = survey
+			}
+		}
+	}
+	return nil
+}
+
+// memTx writes to the staged MemStore of a transaction, and looks up resources in both the staged and the
+// committed MemStore, whose lock the transaction holds.
+type memTx struct {
+	*MemStore
+	committed *MemStore
+}
+
+func (tx memTx) HasResource(resourceType, id string) (bool, error) {
+	if exists, err := tx.MemStore.HasResource(resourceType, id); exists || err != nil {
+		return exists, err
+	}
+	return tx.committed.hasResource(resourceType, id)
+}
+
+func (tx memTx) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	if id, err := tx.MemStore.FindByIdentifier(resourceType, identifier); id != "" || err != nil {
+		return id, err
+	}
+	return tx.committed.findByIdentifier(resourceType, identifier)
+}
+
+// GetAppointment returns the appointment, staged or committed, with its diagnoses and feedback, staged or
+// committed.
+func (tx memTx) GetAppointment(id string) (*Appointment, error) {
+	tx.mu.RLock()
+	defer tx.mu.RUnlock()
+	appointment, ok := tx.Appointments[id]
+	if !ok {
+		appointment, ok = tx.committed.Appointments[id]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	tx.committed.join(&appointment)
+	committed := appointment.Diagnoses
+	tx.MemStore.join(&appointment) // staged feedback replaces the committed one
+	diagnoses := map[string]bool{}
+	for _, diagnosis := range appointment.Diagnoses {
+		diagnoses[diagnosis.ID()] = true
+	}
+	for _, diagnosis := range committed {
+		if !diagnoses[diagnosis.ID()] {
+			appointment.Diagnoses = append(appointment.Diagnoses, diagnosis)
+		}
+	}
+	sort.Slice(appointment.Diagnoses, func(i, j int) bool {
+		return appointment.Diagnoses[i].Before(appointment.Diagnoses[j])
+	})
+	return &appointment, nil
+}
+
+// SavePatientFeedback stages the feedback for an appointment that is either staged or committed.
+func (tx memTx) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	if exists, err := tx.HasResource("Appointment", appointmentID); err != nil || !exists {
+		return nil, errors.Errorf("appointment %s not found", appointmentID)
+	}
+	previous, err := tx.GetPatientFeedback(appointmentID)
+	if err != nil {
+		return nil, err
+	}
+	if committed, ok := tx.committed.Feedback[appointmentID]; previous == nil && ok {
+		previous = &committed
+	}
+	if previous == nil && tx.committed.feedbackOfAnother(feedback.ID(), appointmentID) {
+		return nil, errors.Wrap(ErrFeedbackIDTaken, "problem saving feedback for appointment "+appointmentID)
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.saveFeedback(appointmentID, feedback, previous)
+}
+
+func (tx memTx) GetSurvey(id string, version int) (*Survey, error) {
+	if survey, err := tx.MemStore.GetSurvey(id, version); survey != nil || err != nil {
+		return survey, err
+	}
+	if survey, ok := tx.committed.Surveys[id][version]; ok {
+		return &survey, nil
+	}
+	return nil, nil
+}
+
+// FindByIdentifier returns the id of the patient or doctor with the identifier, or "" if there is none. If
+// several have it, the lowest id is returned.
+func (s *MemStore) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.findByIdentifier(resourceType, identifier)
+}
+
+// findByIdentifier is FindByIdentifier for a caller holding the lock.
+func (s *MemStore) findByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	var found string
+	match := func(id string, identifiers []Identifier) {
+		for _, i := range identifiers {
+			if i == identifier && (found == "" || id < found) {
+				found = id
+			}
+		}
+	}
+	switch resourceType {
+	case "Patient":
+		for id, patient := range s.Patients {
+			match(id, patient.Identifiers)
+		}
+	case "Doctor":
+		for id, doctor := range s.Doctors {
+			match(id, doctor.Identifiers)
+		}
+	default:
+		return "", errors.Errorf("resource type %s has no identifiers", resourceType)
+	}
+	return found, nil
+}
+
+func (s *MemStore) HasResource(resourceType, id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hasResource(resourceType, id)
+}
+
+// hasResource is HasResource for a caller holding the lock.
+func (s *MemStore) hasResource(resourceType, id string) (bool, error) {
+	var exists bool
+	switch resourceType {
+	case "Patient":
+		_, exists = s.Patients[id]
+	case "Doctor":
+		_, exists = s.Doctors[id]
+	case "Appointment":
+		_, exists = s.Appointments[id]
+	case "Diagnosis":
+		_, exists = s.Diagnoses[id]
+	case "PractitionerRole":
+		_, exists = s.Roles[id]
+	case "Encounter":
+		_, exists = s.Encounters[id]
+	default:
+		return false, errors.Errorf("unknown resource type " + resourceType)
+	}
+	return exists, nil
+}
+
+func (s *MemStore) GetPatient(id string) (*Patient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	patient, ok := s.Patients[id]
+	if !ok {
+		return nil, nil
+	}
+	return &patient, nil
+}
+
+func (s *MemStore) GetDoctor(id string) (*Doctor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doctor, ok := s.Doctors[id]
+	if !ok {
+		return nil, nil
+	}
+	doctor.Roles = nil
+	for _, role := range s.Roles {
+		if role.Practitioner.ResourceID == id {
+			doctor.Roles = append(doctor.Roles, role)
+		}
+	}
+	sort.Slice(doctor.Roles, func(i, j int) bool {
+		return doctor.Roles[i].ID() < doctor.Roles[j].ID()
+	})
+	return &doctor, nil
+}
+
+func (s *MemStore) GetAppointment(id string) (*Appointment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	appointment, ok := s.Appointments[id]
+	if !ok {
+		return nil, nil
+	}
+	s.join(&appointment)
+	return &appointment, nil
+}
+
+// GetPatientAppointments returns the appointments for the patient in chronological order, see Appointment.Before.
+func (s *MemStore) GetPatientAppointments(patientID string) ([]Appointment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var apps []Appointment
+	for _, appointment := range s.Appointments {
+		if appointment.Subject.ResourceID != patientID {
+			continue
+		}
+		s.join(&appointment)
+		apps = append(apps, appointment)
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Before(apps[j])
+	})
+	return apps, nil
+}
+
+func (s *MemStore) GetDiagnosesByCode(system, code string) ([]Diagnosis, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var diagnoses []Diagnosis
+	for _, diagnosis := range s.Diagnoses {
+		if diagnosis.Code.HasCoding(system, code) {
+			diagnoses = append(diagnoses, diagnosis)
+		}
+	}
+	sort.Slice(diagnoses, func(i, j int) bool {
+		return diagnoses[i].ID() < diagnoses[j].ID()
+	})
+	return diagnoses, nil
+}
+
+// join populates the diagnoses and feedback of the appointment, the same way Neo4jStore assembles an
+// appointment from its relationships. Caller must hold the read lock.
+func (s *MemStore) join(appointment *Appointment) {
+	appointment.Diagnoses = nil
+	for _, diagnosis := range s.Diagnoses {
+		if diagnosis.Appointment.ResourceID == appointment.ID() {
+			appointment.Diagnoses = append(appointment.Diagnoses, diagnosis)
+		}
+	}
+	sort.Slice(appointment.Diagnoses, func(i, j int) bool {
+		return appointment.Diagnoses[i].Before(appointment.Diagnoses[j])
+	})
+	if feedback, ok := s.Feedback[appointment.ID()]; ok {
+		appointment.Feedback = &Reference{
+			ResourceID:   feedback.ID(),
+			ResourceType: "Feedback",
+		}
+	}
+}
+
+// SavePatientFeedback saves the feedback for the appointment, replacing any previously saved feedback.
+//
+// Returns an error if the appointment does not exist.
+func (s *MemStore) SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Appointments[appointmentID]; !ok {
+		return nil, errors.Errorf("appointment %s not found", appointmentID)
+	}
+	var previous *Feedback
+	if saved, ok := s.Feedback[appointmentID]; ok {
+		previous = &saved
+	}
+	return s.saveFeedback(appointmentID, feedback, previous)
+}
+
+// saveFeedback saves the feedback for the appointment, keeping the id and creation time of the previous
+// feedback, if any, or else those of the feedback if it has them. Caller must hold the write lock.
+//
+// Returns an error caused by ErrFeedbackIDTaken if the id of the feedback is that of the feedback about another
+// appointment.
+func (s *MemStore) saveFeedback(appointmentID string, feedback Feedback, previous *Feedback) (*Feedback, error) {
+	now := time.Now().UTC()
+	id, createdAt := feedback.ID(), feedback.CreatedAt
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if createdAt == nil {
+		createdAt = &now
+	}
+	if previous != nil {
+		id = previous.ID()
+		if previous.CreatedAt != nil {
+			createdAt = previous.CreatedAt
+		}
+	} else if s.feedbackOfAnother(id, appointmentID) {
+		return nil, errors.Wrap(ErrFeedbackIDTaken, "problem saving feedback for appointment "+appointmentID)
+	}
+	feedback.ResourceTypeAndID = ResourceTypeAndID{ResourceID: id, ResourceType: "Feedback"}
+	feedback.Appointment = Reference{ResourceID: appointmentID, ResourceType: "Appointment"}
+	feedback.CreatedAt, feedback.UpdatedAt = createdAt, &now
+	s.Feedback[appointmentID] = feedback
+	s.FeedbackIDs[feedback.ID()] = appointmentID
+	return &feedback, nil
+}
+
+// feedbackOfAnother returns whether id is the id of the feedback about an appointment other than appointmentID.
+// Caller must hold the lock.
+func (s *MemStore) feedbackOfAnother(id, appointmentID string) bool {
+	other, ok := s.FeedbackIDs[id]
+	return ok && other != appointmentID
+}
+
+func (s *MemStore) GetPatientFeedback(appointmentID string) (*Feedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	feedback, ok := s.Feedback[appointmentID]
+	if !ok {
+		return nil, nil
+	}
+	return &feedback, nil
+}
+
+func (s *MemStore) GetFeedback(id string) (*Feedback, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	feedback, ok := s.Feedback[s.FeedbackIDs[id]]
+	if !ok {
+		return nil, nil
+	}
+	return &feedback, nil
+}
+
+func (s *MemStore) SaveSurvey(survey Survey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions, ok := s.Surveys[survey.ID]
+	if !ok {
+		versions = map[int]Survey{}
+		s.Surveys[survey.ID] = versions
+	}
+	if _, ok := versions[survey.Version]; !ok {
+		versions[survey.Version] = survey
+	}
+	return nil
+}
+
+func (s *MemStore) GetSurvey(id string, version int) (*Survey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	survey, ok := s.Surveys[id][version]
+	if !ok {
+		return nil, nil
+	}
+	return &survey, nil
+}
+
+// Close does nothing; MemStore holds no resources beyond memory.
+func (s *MemStore) Close() error {
 	return nil
 }
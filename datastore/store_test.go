@@ -0,0 +1,46 @@
+package datastore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/datastore/datastoretest"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+func TestMemStore_Conformance(t *testing.T) {
+	datastoretest.Run(t, func(t *testing.T) datastoretest.Store {
+		return datastore.NewMemStore()
+	})
+}
+
+func TestMemStore_WriteTransactionExcludesWriters(t *testing.T) {
+	store := datastore.NewMemStore()
+	patient := internal.Patient{ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "p1", ResourceType: "Patient"}}
+
+	written := make(chan struct{})
+	require.NoError(t, store.WriteTransaction(func(w internal.ResourceWriter) error {
+		go func() {
+			store.WritePatient(patient)
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Error("write interleaved with the transaction")
+		case <-time.After(50 * time.Millisecond):
+		}
+		exists, err := w.(internal.ResourceLookup).HasResource("Patient", "p1")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		return nil
+	}))
+	<-written
+
+	stored, err := store.GetPatient("p1")
+	require.NoError(t, err)
+	assert.NotNil(t, stored)
+}
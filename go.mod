@@ -8,8 +8,11 @@ require (
 	github.com/c-bata/go-prompt v0.2.6
 	github.com/google/uuid v1.1.2
 	github.com/labstack/echo/v4 v4.1.17
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/neo4j/neo4j-go-driver/v4 v4.3.3
 	github.com/pkg/errors v0.8.1
 	github.com/spf13/cobra v1.2.1
+	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
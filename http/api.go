@@ -5,10 +5,11 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
 )
 
-// Echo returns an echo.Echo instance configured with all handlers.
-func Echo(store datastore.Store) *echo.Echo {
+// Echo returns an echo.Echo instance configured with all handlers. Feedback is given by answering survey.
+func Echo(store datastore.Store, survey internal.Survey) *echo.Echo {
 	e := echo.New()
 	e.Use(
 		middleware.Logger(),
@@ -19,10 +20,19 @@ func Echo(store datastore.Store) *echo.Echo {
 		// check if authorized to access patients resource
 		return next
 	}))
-	appointmentsHandler{store: store}.AddRoutes(e.Group("/appointments", func(next echo.HandlerFunc) echo.HandlerFunc {
+	doctorsHandler{store: store}.AddRoutes(e.Group("/doctors", func(next echo.HandlerFunc) echo.HandlerFunc {
+		// check if authorized to access doctors resource
+		return next
+	}))
+	appointmentsHandler{store: store, survey: survey}.AddRoutes(e.Group("/appointments", func(next echo.HandlerFunc) echo.HandlerFunc {
 		// check if authorized to access appointments resource
 		return next
 	}))
+	feedbackHandler{store: store}.AddRoutes(e.Group("/feedback", func(next echo.HandlerFunc) echo.HandlerFunc {
+		// check if authorized to access feedback resource
+		return next
+	}))
+	surveyHandler{store: store, survey: survey}.AddRoutes(e.Group("/survey"))
 
 	return e
 }
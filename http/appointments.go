@@ -1,7 +1,9 @@
 package http
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
@@ -11,7 +13,8 @@ import (
 )
 
 type appointmentsHandler struct {
-	store datastore.Store
+	store  datastore.Store
+	survey internal.Survey
 }
 
 func (h appointmentsHandler) AddRoutes(g *echo.Group) {
@@ -19,21 +22,88 @@ func (h appointmentsHandler) AddRoutes(g *echo.Group) {
 	g.GET("/:appointmentId/feedback", h.GETAppointmentFeedback)
 }
 
+// POSTAppointmentFeedback saves the feedback of the appointment's patient, submitted by the channel given in the
+// request or else the API, and returns it as saved. The feedback must answer a published version of a survey, the
+// configured one unless the request names another. The store assigns its id and times, ignoring any in the request.
 func (h appointmentsHandler) POSTAppointmentFeedback(c echo.Context) error {
 	var feedbackRequest internal.Feedback
 	if err := c.Bind(&feedbackRequest); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "could not parse request body").SetInternal(errors.WithStack(err))
 	}
 
-	err := h.store.SavePatientFeedback(c.Param("appointmentId"), feedbackRequest)
+	appointmentID := c.Param("appointmentId")
+	appointment, err := h.store.GetAppointment(appointmentID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting appointment "+appointmentID)
+	}
+	if appointment == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if !appointment.Ended(time.Now()) {
+		return echo.NewHTTPError(http.StatusConflict, "appointment has not ended")
+	}
+	// feedback is about the primary diagnosis unless the patient picked another of the appointment
+	if feedbackRequest.Diagnosis == nil {
+		if diagnosis := appointment.PrimaryDiagnosis(); diagnosis != nil {
+			feedbackRequest.Diagnosis = &internal.Reference{
+				ResourceID:   diagnosis.ID(),
+				ResourceType: "Diagnosis",
+			}
+		}
+	} else if appointment.FindDiagnosis(feedbackRequest.Diagnosis.ResourceID) == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "diagnosis is not of the appointment")
+	}
+	// answers that do not name their survey, or its version, answer the configured one
+	if feedbackRequest.Survey == "" {
+		feedbackRequest.Survey = h.survey.ID
+	}
+	if feedbackRequest.SurveyVersion == 0 && feedbackRequest.Survey == h.survey.ID {
+		feedbackRequest.SurveyVersion = h.survey.Version
+	}
+	survey, err := internal.LookupSurvey(h.store, feedbackRequest.Survey, feedbackRequest.SurveyVersion)
+	if err != nil {
+		return err
+	}
+	if survey == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("survey %s version %d is not published",
+			feedbackRequest.Survey, feedbackRequest.SurveyVersion))
+	}
+	if err := survey.Check(feedbackRequest); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if feedbackRequest.Channel == "" {
+		feedbackRequest.Channel = internal.FeedbackChannelAPI
+	} else if !feedbackRequest.Channel.Valid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "channel must be one of cli, api, sms or web")
+	}
+	// only ingested feedback keeps an id and times of its own
+	feedbackRequest.ResourceTypeAndID = internal.ResourceTypeAndID{}
+	feedbackRequest.CreatedAt, feedbackRequest.UpdatedAt = nil, nil
+	feedbackRequest.Author = nil
+	if appointment.Subject.ResourceID != "" {
+		author := appointment.Subject
+		feedbackRequest.Author = &author
+	}
+
+	feedback, err := h.store.SavePatientFeedback(appointmentID, feedbackRequest)
+	if errors.Cause(err) == internal.ErrFeedbackIDTaken {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 	if err != nil {
 		return errors.Wrap(err, "problem saving feedback")
 	}
 
-	return c.NoContent(http.StatusCreated)
+	return c.JSON(http.StatusCreated, feedback)
 }
 
+// GETAppointmentFeedback returns the appointment, referring to its feedback. With the form query parameter
+// QuestionnaireResponse, it returns the feedback as a FHIR QuestionnaireResponse instead.
 func (h appointmentsHandler) GETAppointmentFeedback(c echo.Context) error {
+	form := c.QueryParam("form")
+	if form != "" && form != "QuestionnaireResponse" {
+		return echo.NewHTTPError(http.StatusBadRequest, "form must be QuestionnaireResponse")
+	}
+
 	appointmentID := c.Param("appointmentId")
 	appointment, err := h.store.GetAppointment(appointmentID)
 	if err != nil {
@@ -42,6 +112,20 @@ func (h appointmentsHandler) GETAppointmentFeedback(c echo.Context) error {
 	if appointment == nil {
 		return c.NoContent(http.StatusNotFound)
 	}
+	if form == "" {
+		return c.JSON(http.StatusOK, appointment)
+	}
 
-	return c.JSON(http.StatusOK, appointment)
+	feedback, err := h.store.GetPatientFeedback(appointmentID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting feedback for appointment "+appointmentID)
+	}
+	if feedback == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	response, err := questionnaireResponse(h.store, *feedback, *appointment)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
 }
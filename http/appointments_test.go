@@ -0,0 +1,302 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+func TestEcho_AppointmentFeedback(t *testing.T) {
+	const appointmentID = "testappointment"
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WriteAppointment(internal.Appointment{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: appointmentID, ResourceType: "Appointment"},
+		Subject:           internal.Reference{ResourceID: "testpatient", ResourceType: "Patient"},
+		Status:            "finished",
+	}))
+
+	e := Echo(store, defaultSurvey(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/appointments/"+appointmentID+"/feedback", strings.NewReader(`{"recommend": 9, "explained": true, "feeling": "fine"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created internal.Feedback
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.NotEmpty(t, created.ID())
+	assert.Equal(t, internal.FeedbackChannelAPI, created.Channel)
+	assert.Equal(t, &internal.Reference{ResourceID: "testpatient", ResourceType: "Patient"}, created.Author)
+	assert.NotNil(t, created.CreatedAt)
+
+	feedback, err := store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, created.ID(), feedback.ID())
+	require.NotNil(t, feedback.Answers["recommend"].Number)
+	assert.Equal(t, 9, *feedback.Answers["recommend"].Number)
+
+	req = httptest.NewRequest(http.MethodGet, "/feedback/"+created.ID(), nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var got internal.Feedback
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	assert.Equal(t, created.ID(), got.ID())
+	assert.Equal(t, appointmentID, got.Appointment.ResourceID)
+
+	req = httptest.NewRequest(http.MethodGet, "/appointments/"+appointmentID+"/feedback", nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var response map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	assert.NotNil(t, response["feedback"])
+
+	req = httptest.NewRequest(http.MethodGet, "/appointments/"+appointmentID+"/feedback?form=QuestionnaireResponse", nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var questionnaireResponse internal.QuestionnaireResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&questionnaireResponse))
+	assert.Equal(t, created.ID(), questionnaireResponse.ID())
+	assert.Equal(t, "Questionnaire/appointment-feedback|1", questionnaireResponse.Questionnaire)
+	read, err := questionnaireResponse.Feedback(defaultSurvey(t))
+	require.NoError(t, err)
+	assert.Equal(t, feedback.Answers, read.Answers)
+	assert.Equal(t, feedback.Author, read.Author)
+
+	req = httptest.NewRequest(http.MethodGet, "/feedback/"+created.ID()+"?form=QuestionnaireResponse", nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	for _, path := range []string{"/appointments/unknown/feedback", "/feedback/unknown"} {
+		req = httptest.NewRequest(http.MethodGet, path, nil)
+		resp = httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNotFound, resp.Code, path)
+	}
+
+	// feedback arrives by a known channel
+	req = httptest.NewRequest(http.MethodPost, "/appointments/"+appointmentID+"/feedback", strings.NewReader(`{"recommend": 9, "explained": true, "feeling": "fine", "channel": "fax"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestEcho_AppointmentFeedbackBeforeEnd(t *testing.T) {
+	const appointmentID = "testappointment"
+	end := time.Now().Add(time.Hour)
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WriteAppointment(internal.Appointment{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: appointmentID, ResourceType: "Appointment"},
+		Status:            "booked",
+		Period:            internal.Period{End: &end},
+	}))
+
+	e := Echo(store, defaultSurvey(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/appointments/"+appointmentID+"/feedback", strings.NewReader(`{"recommend": 9, "explained": true, "feeling": "fine"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+
+	feedback, err := store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	assert.Nil(t, feedback)
+}
+
+func TestEcho_AppointmentFeedbackIgnoresIDAndTimes(t *testing.T) {
+	store := datastore.NewMemStore()
+	for _, id := range []string{"first", "second"} {
+		require.NoError(t, store.WriteAppointment(internal.Appointment{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: id, ResourceType: "Appointment"},
+			Status:            "finished",
+		}))
+	}
+	first, err := store.SavePatientFeedback("first", internal.LegacyFeedback(9, true, "fine"))
+	require.NoError(t, err)
+
+	e := Echo(store, defaultSurvey(t))
+
+	// the id of the feedback about another appointment, and backdated times
+	before := time.Now()
+	req := httptest.NewRequest(http.MethodPost, "/appointments/second/feedback", strings.NewReader(`{"id": "`+first.ID()+`",
+		"createdAt": "2001-01-01T00:00:00Z", "updatedAt": "2001-01-01T00:00:00Z", "recommend": 9, "explained": true, "feeling": "fine"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusCreated, resp.Code, resp.Body.String())
+	var created internal.Feedback
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.NotEmpty(t, created.ID())
+	assert.NotEqual(t, first.ID(), created.ID())
+	require.NotNil(t, created.CreatedAt)
+	assert.False(t, created.CreatedAt.Before(before.Truncate(time.Second)), created.CreatedAt)
+	require.NotNil(t, created.UpdatedAt)
+	assert.False(t, created.UpdatedAt.Before(before.Truncate(time.Second)), created.UpdatedAt)
+
+	feedback, err := store.GetFeedback(first.ID())
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, "first", feedback.Appointment.ResourceID)
+}
+
+func TestEcho_AppointmentFeedbackDiagnosis(t *testing.T) {
+	const appointmentID = "testappointment"
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WriteAppointment(internal.Appointment{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: appointmentID, ResourceType: "Appointment"},
+		Status:            "finished",
+	}))
+	for id, rank := range map[string]int{"primary": 1, "secondary": 2} {
+		require.NoError(t, store.WriteDiagnosis(internal.Diagnosis{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: id, ResourceType: "Diagnosis"},
+			Appointment:       internal.Reference{ResourceID: appointmentID, ResourceType: "Appointment"},
+			Rank:              rank,
+		}))
+	}
+
+	e := Echo(store, defaultSurvey(t))
+	post := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/appointments/"+appointmentID+"/feedback", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// defaults to the primary diagnosis
+	require.Equal(t, http.StatusCreated, post(`{"recommend": 9, "explained": true, "feeling": "fine"}`))
+	feedback, err := store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback.Diagnosis)
+	assert.Equal(t, "primary", feedback.Diagnosis.ResourceID)
+
+	require.Equal(t, http.StatusCreated, post(`{"recommend": 9, "explained": true, "feeling": "fine", "diagnosis": {"reference": "Diagnosis/secondary"}}`))
+	feedback, err = store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback.Diagnosis)
+	assert.Equal(t, "secondary", feedback.Diagnosis.ResourceID)
+
+	assert.Equal(t, http.StatusBadRequest, post(`{"recommend": 9, "explained": true, "feeling": "fine", "diagnosis": {"reference": "Diagnosis/other"}}`))
+}
+
+func TestEcho_AppointmentFeedbackSurvey(t *testing.T) {
+	const appointmentID = "testappointment"
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WriteAppointment(internal.Appointment{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: appointmentID, ResourceType: "Appointment"},
+		Status:            "finished",
+	}))
+	survey, err := internal.ReadSurvey(strings.NewReader(`{
+		"id": "visit",
+		"version": 3,
+		"questions": [
+			{"id": "rating", "type": "scale", "min": 1, "max": 5, "text": "How was your visit?"},
+			{"id": "channel", "type": "choice", "text": "How did you book?", "options": [{"value": "phone"}, {"value": "web"}]}
+		]
+	}`))
+	require.NoError(t, err)
+	require.NoError(t, internal.PublishSurvey(store, survey))
+
+	e := Echo(store, survey)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/appointments/"+appointmentID+"/feedback", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := post(`{"answers": {"rating": 4, "channel": "fax"}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "answer to channel must be one of phone, web")
+	// answers to a version that has not been published are rejected
+	resp = post(`{"survey": "visit", "surveyVersion": 2, "answers": {"rating": 4}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Contains(t, resp.Body.String(), "survey visit version 2 is not published")
+
+	// answers to a published version other than the configured one are checked against that version
+	previous, err := internal.ReadSurvey(strings.NewReader(`{
+		"id": "visit",
+		"version": 1,
+		"questions": [{"id": "rating", "type": "scale", "min": 1, "max": 10, "text": "How was your visit?"}]
+	}`))
+	require.NoError(t, err)
+	require.NoError(t, internal.PublishSurvey(store, previous))
+	assert.Equal(t, http.StatusBadRequest, post(`{"survey": "visit", "surveyVersion": 1, "answers": {"rating": 4, "channel": "web"}}`).Code)
+	require.Equal(t, http.StatusCreated, post(`{"survey": "visit", "surveyVersion": 1, "answers": {"rating": 8}}`).Code)
+	feedback, err := store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, 1, feedback.SurveyVersion)
+
+	// feedback in the format of the default survey answers that
+	assert.Equal(t, http.StatusBadRequest, post(`{"recommend": 11}`).Code)
+	require.Equal(t, http.StatusCreated, post(`{"recommend": 9, "explained": true, "feeling": "fine"}`).Code)
+	feedback, err = store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, internal.DefaultSurveyID, feedback.Survey)
+
+	require.Equal(t, http.StatusCreated, post(`{"answers": {"rating": 4, "channel": "web"}}`).Code)
+	feedback, err = store.GetPatientFeedback(appointmentID)
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, "visit", feedback.Survey)
+	assert.Equal(t, 3, feedback.SurveyVersion)
+	require.NotNil(t, feedback.Answers["channel"].Text)
+	assert.Equal(t, "web", *feedback.Answers["channel"].Text)
+
+	req := httptest.NewRequest(http.MethodGet, "/survey", nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var served internal.Survey
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&served))
+	assert.Equal(t, survey, served)
+
+	getVersion := func(id string, version string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/survey/"+id+"/versions/"+version, nil)
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, req)
+		return resp
+	}
+	resp = getVersion("visit", "3")
+	require.Equal(t, http.StatusOK, resp.Code)
+	served = internal.Survey{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&served))
+	assert.Equal(t, survey, served)
+	// the default survey is always available to show legacy feedback
+	assert.Equal(t, http.StatusOK, getVersion(internal.DefaultSurveyID, "1").Code)
+	assert.Equal(t, http.StatusNotFound, getVersion("visit", "2").Code)
+	assert.Equal(t, http.StatusBadRequest, getVersion("visit", "latest").Code)
+
+	resp = getVersion("visit", "3?form=Questionnaire")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var questionnaire internal.Questionnaire
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&questionnaire))
+	imported, err := questionnaire.Survey()
+	require.NoError(t, err)
+	assert.Equal(t, survey, imported)
+}
+
+func defaultSurvey(t *testing.T) internal.Survey {
+	survey, err := internal.DefaultSurvey()
+	require.NoError(t, err)
+	return survey
+}
@@ -0,0 +1,47 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+type doctorsHandler struct {
+	store datastore.Store
+}
+
+func (h doctorsHandler) AddRoutes(e *echo.Group) {
+	e.GET("/:doctorId", h.GETDoctor)
+}
+
+// GETDoctor returns a collection Bundle of the doctor and its roles. The form query parameter selects whether the
+// doctor is a Doctor, the default, or a Practitioner resource.
+func (h doctorsHandler) GETDoctor(c echo.Context) error {
+	form := internal.DoctorForm(c.QueryParam("form"))
+	switch form {
+	case "":
+		form = internal.DoctorFormDoctor
+	case internal.DoctorFormDoctor, internal.DoctorFormPractitioner:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "form must be Doctor or Practitioner")
+	}
+
+	doctorID := c.Param("doctorId")
+	doctor, err := h.store.GetDoctor(doctorID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting doctor "+doctorID)
+	}
+	if doctor == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	return c.JSON(http.StatusOK, internal.Bundle{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceType: "Bundle"},
+		BundleType:        internal.BundleTypeCollection,
+		Resources:         doctor.Export(form),
+	})
+}
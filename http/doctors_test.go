@@ -0,0 +1,62 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+func TestDoctorsHandler_GETDoctor(t *testing.T) {
+	const doctorID = "testdoctor"
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WriteDoctor(internal.Doctor{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: doctorID, ResourceType: "Doctor"},
+		Name:              []internal.Name{{Family: "Careful", Given: []string{"Adam"}}},
+	}))
+	require.NoError(t, store.WritePractitionerRole(internal.PractitionerRole{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "testrole", ResourceType: "PractitionerRole"},
+		Practitioner:      internal.Reference{ResourceID: doctorID, ResourceType: "Doctor"},
+		Specialty:         []internal.CodeableConcept{{Text: "Endocrinology"}},
+	}))
+
+	e := echo.New()
+	doctorsHandler{store}.AddRoutes(e.Group(""))
+	get := func(target string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		e.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, target, nil))
+		return resp
+	}
+
+	resp := get("/" + doctorID + "?form=Practitioner")
+	require.Equal(t, http.StatusOK, resp.Code)
+	var bundle struct {
+		Type  string `json:"type"`
+		Entry []struct {
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"entry"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&bundle))
+	assert.Equal(t, internal.BundleTypeCollection, bundle.Type)
+	require.Len(t, bundle.Entry, 2)
+	assert.Equal(t, "Practitioner", bundle.Entry[0].Resource["resourceType"])
+	assert.Equal(t, "PractitionerRole", bundle.Entry[1].Resource["resourceType"])
+	assert.Equal(t, map[string]interface{}{"reference": "Practitioner/" + doctorID}, bundle.Entry[1].Resource["practitioner"])
+
+	resp = get("/" + doctorID)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var doctorBundle internal.Bundle
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doctorBundle))
+	require.Len(t, doctorBundle.Resources, 2)
+	assert.Equal(t, "Doctor", doctorBundle.Resources[0].Type())
+
+	assert.Equal(t, http.StatusBadRequest, get("/"+doctorID+"?form=Person").Code)
+	assert.Equal(t, http.StatusNotFound, get("/unknown").Code)
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+type feedbackHandler struct {
+	store datastore.Store
+}
+
+func (h feedbackHandler) AddRoutes(g *echo.Group) {
+	g.GET("/:feedbackId", h.GETFeedback)
+}
+
+// GETFeedback returns the feedback with the id. With the form query parameter QuestionnaireResponse, it returns
+// the feedback as a FHIR QuestionnaireResponse instead.
+func (h feedbackHandler) GETFeedback(c echo.Context) error {
+	form := c.QueryParam("form")
+	if form != "" && form != "QuestionnaireResponse" {
+		return echo.NewHTTPError(http.StatusBadRequest, "form must be QuestionnaireResponse")
+	}
+
+	feedbackID := c.Param("feedbackId")
+	feedback, err := h.store.GetFeedback(feedbackID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting feedback "+feedbackID)
+	}
+	if feedback == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if form == "" {
+		return c.JSON(http.StatusOK, feedback)
+	}
+
+	appointmentID := feedback.Appointment.ResourceID
+	appointment, err := h.store.GetAppointment(appointmentID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting appointment "+appointmentID)
+	}
+	if appointment == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	response, err := questionnaireResponse(h.store, *feedback, *appointment)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// questionnaireResponse returns the feedback about the appointment as a QuestionnaireResponse answering the
+// survey version the feedback answers. Choices answering a survey version that is not known are exported as
+// strings rather than codings.
+func questionnaireResponse(store datastore.Store, feedback internal.Feedback, appointment internal.Appointment) (internal.QuestionnaireResponse, error) {
+	survey, err := internal.LookupSurvey(store, feedback.Survey, feedback.SurveyVersion)
+	if err != nil {
+		return internal.QuestionnaireResponse{}, err
+	}
+	if survey == nil {
+		survey = &internal.Survey{}
+	}
+	return feedback.QuestionnaireResponse(appointment, *survey), nil
+}
@@ -14,12 +14,29 @@ type patientsHandler struct {
 }
 
 func (h patientsHandler) AddRoutes(e *echo.Group) {
+	e.GET("/:patientId", h.GETPatient, func(next echo.HandlerFunc) echo.HandlerFunc {
+		// authorize request to access patient
+		return next
+	})
 	e.GET("/:patientId/appointments", h.GETPatientAppointments, func(next echo.HandlerFunc) echo.HandlerFunc {
 		// authorize request to access appointments for patient
 		return next
 	})
 }
 
+func (h patientsHandler) GETPatient(c echo.Context) error {
+	patientID := c.Param("patientId")
+	patient, err := h.store.GetPatient(patientID)
+	if err != nil {
+		return errors.Wrap(err, "problem getting patient "+patientID)
+	}
+	if patient == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	return c.JSON(http.StatusOK, patient)
+}
+
 func (h patientsHandler) GETPatientAppointments(c echo.Context) error {
 	patientID := c.Param("patientId")
 	appointments, err := h.store.GetPatientAppointments(patientID)
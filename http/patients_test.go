@@ -1,13 +1,16 @@
 package http
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/scraymondjr/appointment/datastore"
 	"github.com/scraymondjr/appointment/internal"
@@ -15,8 +18,29 @@ import (
 
 func TestPatientsHandler_GETPatientAppointments(t *testing.T) {
 	const patientID = "testpatient"
+	end := time.Date(2021, 4, 2, 12, 0, 0, 0, time.UTC)
+	subject := internal.Reference{ResourceID: patientID, ResourceType: "Patient"}
 	appointments := []internal.Appointment{
-		{Status: "finished"}, {Status: "other"},
+		{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "finished", ResourceType: "Appointment"},
+			Status:            "finished",
+			Period:            internal.Period{End: &end},
+			Subject:           subject,
+			Actor:             internal.Reference{ResourceID: "testdoctor", ResourceType: "Doctor"},
+			Feedback:          &internal.Reference{ResourceID: "testfeedback", ResourceType: "Feedback"},
+			Diagnoses: []internal.Diagnosis{{
+				ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "testdiagnosis", ResourceType: "Diagnosis"},
+				Status:            "final",
+				Code:              internal.CodeableConcept{Text: "Diabetes"},
+				Appointment:       internal.Reference{ResourceID: "finished", ResourceType: "Appointment"},
+				Rank:              1,
+			}},
+		},
+		{
+			ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: "other", ResourceType: "Appointment"},
+			Status:            "other",
+			Subject:           subject,
+		},
 	}
 	store := fakeStore{
 		patientAppointments: map[string][]internal.Appointment{
@@ -34,12 +58,44 @@ func TestPatientsHandler_GETPatientAppointments(t *testing.T) {
 	e.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusOK, resp.Code)
 
-	// TODO fix Appointment marshalling to be able to unmarshal JSON back into Go type
-	// var response []internal.Appointment
-	// err := json.NewDecoder(resp.Body).Decode(&response)
-	// require.NoError(t, err)
-	//
-	// assert.ElementsMatch(t, appointments, response)
+	var response []internal.Appointment
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	require.NoError(t, err)
+
+	assert.ElementsMatch(t, appointments, response)
+}
+
+func TestPatientsHandler_GETPatient(t *testing.T) {
+	const patientID = "testpatient"
+	active := true
+	patient := internal.Patient{
+		ResourceTypeAndID: internal.ResourceTypeAndID{ResourceID: patientID, ResourceType: "Patient"},
+		Active:            &active,
+		Name:              []internal.Name{{Family: "Tenderson", Given: []string{"Tendo"}}},
+		Telecom:           []internal.ContactPoint{{System: "email", Value: "tendo@tendoco.com", Use: "work"}},
+		Gender:            "female",
+		BirthDate:         "1955-01-06",
+		Address:           []internal.Address{{Use: "home", Line: []string{"2222 Home Street"}}},
+	}
+	store := datastore.NewMemStore()
+	require.NoError(t, store.WritePatient(patient))
+
+	e := echo.New()
+	patientsHandler{store}.AddRoutes(e.Group(""))
+
+	req := httptest.NewRequest(http.MethodGet, "/"+patientID, nil)
+	resp := httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var response internal.Patient
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	assert.Equal(t, patient, response)
+
+	req = httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	resp = httptest.NewRecorder()
+	e.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
 }
 
 type fakeStore struct {
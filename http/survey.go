@@ -0,0 +1,63 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+
+	"github.com/scraymondjr/appointment/datastore"
+	"github.com/scraymondjr/appointment/internal"
+)
+
+type surveyHandler struct {
+	store  datastore.Store
+	survey internal.Survey
+}
+
+func (h surveyHandler) AddRoutes(g *echo.Group) {
+	g.GET("", h.GETSurvey)
+	g.GET("/:surveyId/versions/:version", h.GETSurveyVersion)
+}
+
+// GETSurvey returns the definition of the survey feedback is given by answering. With the form query parameter
+// Questionnaire, it returns the survey as a FHIR Questionnaire.
+func (h surveyHandler) GETSurvey(c echo.Context) error {
+	return surveyForm(c, h.survey)
+}
+
+// GETSurveyVersion returns the definition of a published survey version, to show feedback answering it with its
+// questions. The form query parameter selects the form as for GETSurvey.
+func (h surveyHandler) GETSurveyVersion(c echo.Context) error {
+	surveyID := c.Param("surveyId")
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "version must be a number")
+	}
+	survey, err := internal.LookupSurvey(h.store, surveyID, version)
+	if err != nil {
+		return errors.Wrap(err, "problem getting survey "+surveyID)
+	}
+	if survey == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return surveyForm(c, *survey)
+}
+
+// surveyForm responds with the survey in the form selected by the form query parameter: the definition by
+// default, or a Questionnaire.
+func surveyForm(c echo.Context, survey internal.Survey) error {
+	switch c.QueryParam("form") {
+	case "":
+		return c.JSON(http.StatusOK, survey)
+	case "Questionnaire":
+		questionnaire, err := survey.Questionnaire()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+		}
+		return c.JSON(http.StatusOK, questionnaire)
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "form must be Questionnaire")
+	}
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// bundle.go contains the resolution of references between the entries of a bundle
+
+// bundleEntry is an entry of a bundle, before its resource is unmarshalled or after it is marshalled.
+type bundleEntry struct {
+	FullURL  string          `json:"fullUrl,omitempty"`
+	Resource json.RawMessage `json:"resource"`
+}
+
+// bundleResolver assigns ids to the entries of a bundle that have none and resolves references to entries by
+// their fullUrl, such as "urn:uuid:..." in a transaction bundle.
+//
+// The zero value resolves against no entries, so only absolute URL references resolve, to the resource at the
+// end of their path.
+type bundleResolver struct {
+	byFullURL map[string]Reference
+}
+
+// add registers the resource of an entry under the entry's fullUrl, assigning the resource a new id if it has
+// none, and returns the resource.
+func (b *bundleResolver) add(fullURL string, r Resource) Resource {
+	if r.ID() == "" {
+		r = withID(r, uuid.New().String())
+	}
+	if fullURL != "" {
+		if b.byFullURL == nil {
+			b.byFullURL = map[string]Reference{}
+		}
+		b.byFullURL[fullURL] = Reference{
+			ResourceID:   r.ID(),
+			ResourceType: r.Type(),
+		}
+	}
+	return r
+}
+
+// resolve returns r with its URL references replaced by the type and id of the resource they refer to.
+//
+// Returns an error if a reference is a URL that does not match the fullUrl of an entry and does not end in a
+// resource type and id.
+func (b *bundleResolver) resolve(r Resource) (Resource, error) {
+	return mapReferences(r, func(ref *Reference) error {
+		if ref.URL == "" {
+			return nil
+		}
+		if target, ok := b.byFullURL[ref.URL]; ok {
+			*ref = target
+			return nil
+		}
+		if ref.ResourceID == "" {
+			return errors.Errorf("reference %s does not match the fullUrl of any bundle entry", ref.URL)
+		}
+		ref.URL = ""
+		return nil
+	})
+}
+
+// refersForward returns whether r refers by fullUrl to an entry that has not been added yet, or to one of the
+// resources in deferred.
+func (b *bundleResolver) refersForward(r Resource, deferred map[resourceKey]bool) bool {
+	forward := false
+	_, _ = mapReferences(r, func(ref *Reference) error {
+		target := *ref
+		if ref.URL != "" {
+			var ok bool
+			if target, ok = b.byFullURL[ref.URL]; !ok {
+				forward = forward || strings.HasPrefix(ref.URL, "urn:")
+				return nil
+			}
+		}
+		forward = forward || deferred[resourceKey{target.ResourceType, target.ResourceID}]
+		return nil
+	})
+	return forward
+}
+
+// dependencyOrder returns resources, the entries of a bundle, ordered so that each comes after the entries it
+// refers to, and otherwise in their order in the bundle. Entries that refer to each other in a cycle keep their
+// order.
+func dependencyOrder(resources []Resource) []Resource {
+	pending := make(map[resourceKey]bool, len(resources))
+	for _, r := range resources {
+		pending[resourceKey{r.Type(), r.ID()}] = true
+	}
+
+	ordered := make([]Resource, 0, len(resources))
+	for cycle := false; len(resources) > 0; {
+		var remaining []Resource
+		for _, r := range resources {
+			if !cycle && refersToAny(r, pending) {
+				remaining = append(remaining, r)
+				continue
+			}
+			delete(pending, resourceKey{r.Type(), r.ID()})
+			ordered = append(ordered, r)
+		}
+		cycle = len(remaining) == len(resources)
+		resources = remaining
+	}
+	return ordered
+}
+
+// refersToAny returns whether r refers to any of the resources in keys.
+func refersToAny(r Resource, keys map[resourceKey]bool) bool {
+	found := false
+	_, _ = mapReferences(r, func(ref *Reference) error {
+		found = found || keys[resourceKey{ref.ResourceType, ref.ResourceID}]
+		return nil
+	})
+	return found
+}
+
+// withID returns r with its id set to id, see ResourceType.WithID.
+func withID(r Resource, id string) Resource {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.WithID == nil {
+		return r
+	}
+	return rt.WithID(r, id)
+}
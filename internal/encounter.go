@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+)
+
+// encounter.go contains the mapping of the FHIR Encounter and Condition resources onto the diagnoses of
+// appointments
+
+type (
+	// Encounter is the visit that took place for an appointment, listing the conditions diagnosed during it. It
+	// is written as a separate resource, from which the stores derive the appointment and rank of those
+	// diagnoses, see Link.
+	Encounter struct {
+		ResourceTypeAndID
+		Status  string    `json:"status"`
+		Subject Reference `json:"subject"`
+		// Appointments are the appointments the encounter took place for; only the first is used.
+		Appointments []Reference `json:"appointment,omitempty"`
+		// BasedOn are the requests the encounter fulfils. An appointment among them is used if Appointments is
+		// empty, as some sources link the appointment this way.
+		BasedOn   []Reference          `json:"basedOn,omitempty"`
+		Diagnoses []EncounterDiagnosis `json:"diagnosis,omitempty"`
+	}
+
+	// EncounterDiagnosis is a condition diagnosed during an encounter.
+	EncounterDiagnosis struct {
+		Condition Reference        `json:"condition"`
+		Use       *CodeableConcept `json:"use,omitempty"`
+		Rank      int              `json:"rank,omitempty"`
+	}
+)
+
+// Appointment returns the reference to the appointment the encounter took place for, or nil if it has none.
+func (e Encounter) Appointment() *Reference {
+	for _, refs := range [][]Reference{e.Appointments, e.BasedOn} {
+		for _, ref := range refs {
+			if ref.ResourceType == "Appointment" && ref.ResourceID != "" {
+				return &ref
+			}
+		}
+	}
+	return nil
+}
+
+// FindDiagnosis returns the entry of the encounter for the condition with the id, or nil if it has none.
+func (e Encounter) FindDiagnosis(conditionID string) *EncounterDiagnosis {
+	for i := range e.Diagnoses {
+		if e.Diagnoses[i].Condition.ResourceID == conditionID {
+			return &e.Diagnoses[i]
+		}
+	}
+	return nil
+}
+
+// Link returns d, a diagnosis belonging to the encounter, with the appointment of the encounter and the rank the
+// encounter gives it.
+//
+// A diagnosis belongs to the encounter it was made in, or, if it does not name one, to the encounter with the
+// lowest id that lists it. The stores link diagnoses whenever either is written, so that they may arrive in any
+// order.
+func (e Encounter) Link(d Diagnosis) Diagnosis {
+	if ref := e.Appointment(); ref != nil {
+		d.Appointment = *ref
+	}
+	if listed := e.FindDiagnosis(d.ID()); listed != nil {
+		d.Rank = listed.Rank
+	}
+	return d
+}
+
+// UnmarshalJSON unmarshals the diagnosis from a Diagnosis or a Condition resource. The status of a Condition is
+// the code of its verificationStatus, or else of its clinicalStatus.
+func (d *Diagnosis) UnmarshalJSON(data []byte) error {
+	type alias Diagnosis
+	var diagnosis struct {
+		alias
+		VerificationStatus *CodeableConcept `json:"verificationStatus"`
+		ClinicalStatus     *CodeableConcept `json:"clinicalStatus"`
+	}
+	if err := json.Unmarshal(data, &diagnosis); err != nil {
+		return err
+	}
+	*d = Diagnosis(diagnosis.alias)
+	d.ResourceType = canonicalType(d.ResourceType)
+	for _, status := range []*CodeableConcept{diagnosis.VerificationStatus, diagnosis.ClinicalStatus} {
+		if d.Status == "" && status != nil && len(status.Coding) > 0 {
+			d.Status = status.Coding[0].Code
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+)
+
+// identifiers.go contains the matching of resources by identifier during ingestion
+
+// identifierKey identifies a resource of a type by one of its identifiers.
+type identifierKey struct {
+	ResourceType string
+	Identifier
+}
+
+// identifiersOf returns the identifiers of r, see ResourceType.Identifiers.
+func identifiersOf(r Resource) []Identifier {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.Identifiers == nil {
+		return nil
+	}
+	return rt.Identifiers(r)
+}
+
+// resolveIdentifiers returns r as it must be written: with the id of the resource that shares one of its
+// identifiers, if any, so that the same patient from two sources is updated rather than duplicated; and with
+// its conditional references, and references to resources matched that way, resolved to ids.
+//
+// Returns an error if a conditional reference does not resolve.
+func (in *ingester) resolveIdentifiers(r Resource, w ResourceWriter) (Resource, error) {
+	for _, identifier := range identifiersOf(r) {
+		id, err := in.findByIdentifier(r.Type(), identifier, w)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			continue
+		}
+		if id != r.ID() {
+			r = withID(r, id)
+		}
+		break
+	}
+
+	return mapReferences(r, func(ref *Reference) error {
+		if ref.Identifier != nil {
+			id, err := in.findByIdentifier(ref.ResourceType, *ref.Identifier, w)
+			if err != nil {
+				return err
+			}
+			if id == "" {
+				return errors.Errorf("no %s with identifier %s", ref.ResourceType, ref.Identifier)
+			}
+			*ref = Reference{
+				ResourceID:   id,
+				ResourceType: ref.ResourceType,
+			}
+		}
+		in.mu.Lock()
+		id, ok := in.aliases[resourceKey{ref.ResourceType, ref.ResourceID}]
+		in.mu.Unlock()
+		if ok {
+			ref.ResourceID = id
+		}
+		return nil
+	})
+}
+
+// findByIdentifier returns the id of the resource of the type with the identifier, among the resources ingested
+// so far and, if w implements IdentifierLookup, the resources already written. Returns "" if there is none.
+func (in *ingester) findByIdentifier(resourceType string, identifier Identifier, w ResourceWriter) (string, error) {
+	in.mu.Lock()
+	id, ok := in.identified[identifierKey{resourceType, identifier}]
+	in.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	lookup, ok := w.(IdentifierLookup)
+	if !ok {
+		return "", nil
+	}
+	id, err := lookup.FindByIdentifier(resourceType, identifier)
+	return id, errors.Wrapf(err, "problem finding %s with identifier %s", resourceType, identifier)
+}
+
+// markIdentified records the identifiers of r, which has been written, so that later resources with the same
+// identifiers match it, and that r was written under its id rather than that of original, the resource as it
+// arrived, so that references to original resolve to r. Caller must hold in.mu.
+func (in *ingester) markIdentified(original, r Resource) {
+	if original.ID() != "" && original.ID() != r.ID() {
+		if in.aliases == nil {
+			in.aliases = map[resourceKey]string{}
+		}
+		in.aliases[resourceKey{original.Type(), original.ID()}] = r.ID()
+	}
+	identifiers := identifiersOf(r)
+	if len(identifiers) == 0 {
+		return
+	}
+	if in.identified == nil {
+		in.identified = map[identifierKey]string{}
+	}
+	for _, identifier := range identifiers {
+		in.identified[identifierKey{r.Type(), identifier}] = r.ID()
+	}
+}
+
+// unmarkIdentified forgets the identifiers and match of r, written as original in a transaction that was rolled
+// back. Caller must hold in.mu.
+func (in *ingester) unmarkIdentified(original, r Resource) {
+	for _, identifier := range identifiersOf(r) {
+		delete(in.identified, identifierKey{r.Type(), identifier})
+	}
+	delete(in.aliases, resourceKey{original.Type(), original.ID()})
+}
+
+// identifiersPending returns whether a resource sharing an identifier with r has been handed to a worker and not
+// written yet, see writeEntry.
+func (in *ingester) identifiersPending(r Resource) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, identifier := range identifiersOf(r) {
+		if in.pendingIdentifiers[identifierKey{r.Type(), identifier}] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// markPending records the identifiers of r, handed to a worker, until it has been written.
+func (in *ingester) markPending(r Resource, pending bool) {
+	identifiers := identifiersOf(r)
+	if len(identifiers) == 0 {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.pendingIdentifiers == nil {
+		in.pendingIdentifiers = map[identifierKey]int{}
+	}
+	for _, identifier := range identifiers {
+		key := identifierKey{r.Type(), identifier}
+		if pending {
+			in.pendingIdentifiers[key]++
+		} else if in.pendingIdentifiers[key]--; in.pendingIdentifiers[key] == 0 {
+			delete(in.pendingIdentifiers, key)
+		}
+	}
+}
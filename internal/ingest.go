@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io"
 	"reflect"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -12,23 +13,68 @@ import (
 
 // Ingest reads JSON data from reader and saves resources in the provided store.
 //
+// The data is a stream of JSON resources, either newline-delimited (NDJSON) or concatenated. Resources are
+// saved as they are decoded, see IngestWithReport.
+//
 // Returns an error if problem reading from reader, decoding JSON blob(s), or saving resource.
 func Ingest(reader io.Reader, writer ResourceWriter) error {
-	// parse data for resourceType
-
-	decoder := json.NewDecoder(reader)
+	_, err := IngestWithReport(reader, writer, IngestOptions{})
+	return err
+}
 
-	resource, err := unmarshalResource(decoder)
-	if err != nil {
-		return err
-	}
+// IngestOptions control how Ingest writes resources and proceeds when one fails to be written.
+type IngestOptions struct {
+	// ContinueOnError keeps writing the remaining resources after one fails, instead of stopping at the first
+	// failure. Resources of a transaction bundle are always written all-or-nothing.
+	ContinueOnError bool
+	// Workers is the number of goroutines writing resources concurrently, see IngestWithReport. With 0 or 1,
+	// resources are written one at a time on the decoding goroutine.
+	Workers int
+	// Progress, if set, is called each time a resource has been written or has failed. Calls are not concurrent.
+	Progress func(IngestProgress)
+	// References selects how references to other resources are validated, see ReferenceMode. The zero value
+	// does not validate references.
+	References ReferenceMode
+}
 
-	// save resource
+// IngestProgress counts the resources ingested so far.
+type IngestProgress struct {
+	// Decoded is the number of resources decoded and handed to a writer.
+	Decoded int
+	// Written is the number of resources written successfully.
+	Written int
+	// Failed is the number of resources that failed to be decoded or written.
+	Failed int
+}
 
-	return errors.Wrap(
-		WriteResource(resource, writer),
-		"problem saving resource "+resource.ID(),
-	)
+// IngestWithReport reads JSON data from reader, saves resources with writer, and reports the outcome of every
+// resource it attempted to write.
+//
+// Resources are decoded and saved one at a time so memory use is bounded by the largest resource rather than
+// the size of the input. The entries of a Bundle are streamed the same way when the bundle's type precedes its
+// entries and is not "transaction"; transaction bundles, which must be written all at once, and bundles of
+// unknown type are read into memory.
+//
+// With more than one worker, writing a resource overlaps with decoding and writing the resources that follow it,
+// except that a resource is only written once every resource it may depend on and decoded before it has been
+// written: patients and doctors before appointments and practitioner roles, appointments before encounters,
+// encounters before diagnoses, and diagnoses before questionnaire responses.
+// Decoding waits for a worker to be free, so at most opts.Workers resources are held in memory waiting to be
+// written. Transaction bundles are written on the decoding goroutine after all pending writes complete, and
+// writer must be safe for concurrent use.
+//
+// Returns an error if problem reading from reader or decoding JSON blob(s), or if any resource failed to be
+// saved. The report is returned along with the error.
+func IngestWithReport(reader io.Reader, writer ResourceWriter, opts IngestOptions) (*IngestReport, error) {
+	in := ingester{opts: opts}
+	if opts.Workers > 1 {
+		in.startPool(opts.Workers)
+	}
+	err := in.ingest(json.NewDecoder(reader), writer)
+	if stopErr := in.stopPool(); err == nil {
+		err = stopErr
+	}
+	return &in.report, in.result(err)
 }
 
 type ResourceWriter interface {
@@ -36,39 +82,313 @@ type ResourceWriter interface {
 	WriteDoctor(Doctor) error
 	WriteAppointment(Appointment) error
 	WriteDiagnosis(Diagnosis) error
+	WritePractitionerRole(PractitionerRole) error
+	WriteEncounter(Encounter) error
 }
 
+// TransactionalWriter is a ResourceWriter that can write a group of resources atomically.
+type TransactionalWriter interface {
+	ResourceWriter
+	// WriteTransaction calls fn with a ResourceWriter whose writes are all committed if fn returns nil, and all
+	// discarded otherwise. fn may be called more than once if the transaction is retried.
+	WriteTransaction(fn func(ResourceWriter) error) error
+}
+
+// ResourceLookup is implemented by ResourceWriters that can tell whether a resource has already been written,
+// which lets ingestion report resources as created or updated.
+type ResourceLookup interface {
+	HasResource(resourceType, id string) (bool, error)
+}
+
+// IdentifierLookup is implemented by ResourceWriters that can find a resource by one of its identifiers, which
+// lets ingestion resolve conditional references and match resources that arrive from several sources under
+// different ids.
+type IdentifierLookup interface {
+	// FindByIdentifier returns the id of the resource of the type with the identifier, or "" if there is none.
+	FindByIdentifier(resourceType string, identifier Identifier) (string, error)
+}
+
+// WriteResource saves r with writer, writing each resource of a Bundle according to the bundle type:
+//
+// A "transaction" bundle is written atomically and requires writer to be a TransactionalWriter. Every entry of a
+// "batch" bundle is written independently of the others failing. Entries of other bundles are written in order,
+// stopping at the first failure.
 func WriteResource(r Resource, writer ResourceWriter) error {
-	switch r := r.(type) {
-	case Bundle:
-		// TODO guard against number of resources allowed to be written in one bundle
-		// TODO include all bundled resources in one txn?
-		for _, bundledResource := range r.Resources {
-			if err := WriteResource(bundledResource, writer); err != nil {
-				// TODO decide if should error-fast or continue to loop through all remaining resources
-				return errors.Wrap(err, "problem writing resource "+bundledResource.ID())
+	var in ingester
+	return in.result(in.write(r, writer, ""))
+}
+
+// ingester writes resources, recording the outcome of each in its report.
+type ingester struct {
+	opts IngestOptions
+
+	// pool writes resources concurrently when set, see pipeline.go
+	pool          *writerPool
+	inTransaction bool
+	// transactionWrites are the resources written in the current transaction, forgotten if it rolls back
+	transactionWrites []writtenResource
+
+	mu       sync.Mutex // guards the fields below, which workers of pool update
+	report   IngestReport
+	progress IngestProgress
+	stopErr  error // failure of a concurrent write that stops ingestion
+	// ingested holds the resources written so far, to resolve references, see references.go
+	ingested map[resourceKey]bool
+	// identified and aliases hold the identifiers of the resources written so far and the ids they were matched
+	// from, and pendingIdentifiers those of resources handed to a worker and not written yet, see identifiers.go
+	identified         map[identifierKey]string
+	aliases            map[resourceKey]string
+	pendingIdentifiers map[identifierKey]int
+}
+
+// writtenResource is a resource as it was written, along with the resource as it arrived, which may have had
+// another id, see resolveIdentifiers.
+type writtenResource struct {
+	original, resource Resource
+}
+
+// write writes r, an entry of a bundle of type bundleType, with w. Returns an error if ingestion must stop.
+func (in *ingester) write(r Resource, w ResourceWriter, bundleType string) error {
+	bundle, ok := r.(Bundle)
+	if !ok {
+		return in.writeEntry(r, w, bundleType)
+	}
+
+	// TODO guard against number of resources allowed to be written in one bundle
+	switch bundle.BundleType {
+	case BundleTypeTransaction:
+		return in.writeTransaction(bundle, w)
+	default:
+		for _, bundledResource := range dependencyOrder(bundle.Resources) {
+			if err := in.write(bundledResource, w, bundle.BundleType); in.stop(bundle.BundleType, err) {
+				return err
 			}
 		}
-	case Patient:
-		return writer.WritePatient(r)
-	case Doctor:
-		return writer.WriteDoctor(r)
-	case Appointment:
-		return writer.WriteAppointment(r)
-	case Diagnosis:
-		return writer.WriteDiagnosis(r)
-	default:
-		return errors.Errorf("unknown resource type " + r.Type())
+		return nil
 	}
+}
+
+// stop returns whether err, the failure to write an entry of a bundle of type bundleType, stops ingestion.
+// Failures are in the report, so the entries of a batch bundle never stop ingestion on their own.
+func (in *ingester) stop(bundleType string, err error) bool {
+	return err != nil && (in.failFast(bundleType) || err == in.stopped())
+}
+
+// failFast returns whether the failure to write an entry of a bundle of type bundleType stops ingestion.
+func (in *ingester) failFast(bundleType string) bool {
+	return bundleType != BundleTypeBatch && !in.opts.ContinueOnError
+}
+
+// stopped returns the failure of a concurrent write that stops ingestion, if any.
+func (in *ingester) stopped() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.stopErr
+}
 
+func (in *ingester) writeTransaction(bundle Bundle, w ResourceWriter) error {
+	start := len(in.report.Entries)
+	transactionalWriter, ok := w.(TransactionalWriter)
+	if !ok {
+		err := errors.Errorf("cannot write transaction bundle %s: writer does not support transactions", bundle.ID())
+		for _, bundledResource := range bundle.Resources {
+			in.record(bundledResource.Type(), bundledResource.ID(), OutcomeFailed, err)
+		}
+		return err
+	}
+
+	// entries of the transaction may depend on resources still being written, and the transaction's writer is
+	// not safe for concurrent use, so write the transaction on its own
+	if err := in.drainPool(); err != nil {
+		return err
+	}
+	in.inTransaction = true
+	defer func() { in.inTransaction = false }()
+
+	// a transaction is all-or-nothing, so stop at the first failure whatever the options
+	opts := in.opts
+	in.opts.ContinueOnError = false
+	defer func() { in.opts = opts }()
+
+	defer func() { in.transactionWrites = nil }()
+	err := transactionalWriter.WriteTransaction(func(tx ResourceWriter) error {
+		in.report.Entries = in.report.Entries[:start] // discard entries from a retried attempt
+		in.unmarkTransaction()
+		for _, bundledResource := range dependencyOrder(bundle.Resources) {
+			if err := in.write(bundledResource, tx, BundleTypeTransaction); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		in.unmarkTransaction()
+		name := "transaction bundle"
+		if bundle.ID() != "" {
+			name += " " + bundle.ID()
+		}
+		err = errors.Wrap(err, name+" rolled back")
+		for i := start; i < len(in.report.Entries); i++ {
+			if in.report.Entries[i].Outcome != OutcomeFailed {
+				in.report.Entries[i].Outcome = OutcomeFailed
+				in.report.Entries[i].Error = err.Error()
+			}
+		}
+		return err
+	}
 	return nil
 }
 
+// writeEntry writes a single, non-bundle resource, an entry of a bundle of type bundleType, and records the
+// outcome. With a pool, the resource is handed to a worker instead.
+//
+// Later resources only resolve references to, and match the identifiers of, resources once they have been
+// written. With a pool, the resource is therefore checked once every resource it may depend on has been written,
+// and, if it shares an identifier with one still being written, once that has been written too.
+func (in *ingester) writeEntry(r Resource, w ResourceWriter, bundleType string) error {
+	concurrent := in.pool != nil && !in.inTransaction
+	if concurrent {
+		in.awaitDependencies(r.Type())
+		if in.identifiersPending(r) {
+			in.pool.pending[dependencyTier(r.Type())].Wait()
+		}
+	}
+
+	err := validateResource(r)
+	var (
+		matched  Resource
+		warnings []string
+	)
+	if err == nil {
+		matched, err = in.resolveIdentifiers(r, w)
+	}
+	if err == nil {
+		warnings, err = in.checkReferences(matched, w)
+	}
+	if err != nil {
+		in.record(r.Type(), r.ID(), OutcomeFailed, err)
+		return errors.Wrap(err, "problem writing resource "+r.ID())
+	}
+
+	if concurrent {
+		return in.dispatch(r, matched, w, warnings, in.failFast(bundleType))
+	}
+	outcome, err := writeResource(matched, w)
+	if err == nil {
+		in.markWritten(r, matched)
+		if in.inTransaction {
+			in.transactionWrites = append(in.transactionWrites, writtenResource{r, matched})
+		}
+	}
+	in.complete(in.reserve(matched.Type(), matched.ID(), warnings), outcome, err)
+	return errors.Wrap(err, "problem writing resource "+matched.ID())
+}
+
+// markWritten records that r, which arrived as original, has been written, see markIngested and markIdentified.
+func (in *ingester) markWritten(original, r Resource) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.markIngested(r)
+	in.markIdentified(original, r)
+}
+
+// unmarkTransaction forgets the resources written in the current transaction, which was rolled back or is
+// retried.
+func (in *ingester) unmarkTransaction() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, written := range in.transactionWrites {
+		in.unmarkIngested(written.resource)
+		in.unmarkIdentified(written.original, written.resource)
+	}
+	in.transactionWrites = nil
+}
+
+func (in *ingester) record(resourceType, id string, outcome Outcome, err error) {
+	in.complete(in.reserve(resourceType, id, nil), outcome, err)
+}
+
+// reserve adds an entry for the resource to the report and returns its index, to be completed once the resource
+// has been written.
+func (in *ingester) reserve(resourceType, id string, warnings []string) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	index := len(in.report.Entries)
+	in.report.Entries = append(in.report.Entries, EntryResult{
+		Index:        index,
+		ResourceType: resourceType,
+		ID:           id,
+		Warnings:     warnings,
+	})
+	in.progress.Decoded++
+	return index
+}
+
+// complete records the outcome of writing the resource of the report entry at index.
+func (in *ingester) complete(index int, outcome Outcome, err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	entry := &in.report.Entries[index]
+	entry.Outcome = outcome
+	if err != nil {
+		entry.Outcome = OutcomeFailed
+		entry.Error = err.Error()
+		in.progress.Failed++
+	} else {
+		in.progress.Written++
+	}
+	if in.opts.Progress != nil {
+		in.opts.Progress(in.progress)
+	}
+}
+
+// result returns err, the error that stopped ingestion, or else an error summarizing the failed resources.
+func (in *ingester) result(err error) error {
+	if err != nil {
+		return err
+	}
+	if failed := in.report.Failed(); len(failed) > 0 {
+		return errors.Errorf("%d of %d resources failed, first %s %s: %s",
+			len(failed), len(in.report.Entries), failed[0].ResourceType, failed[0].ID, failed[0].Error)
+	}
+	return nil
+}
+
+// writeResource writes a single, non-bundle resource with the writer of its registered type, using w as a
+// ResourceLookup if possible to tell whether the resource is created or updated.
+func writeResource(r Resource, w ResourceWriter) (Outcome, error) {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.Write == nil {
+		return OutcomeFailed, errors.Errorf("unknown resource type " + r.Type())
+	}
+
+	outcome := OutcomeCreated
+	if lookup, ok := w.(ResourceLookup); ok && rt.Tracked {
+		exists, err := lookup.HasResource(r.Type(), r.ID())
+		if err != nil {
+			return OutcomeFailed, errors.Wrap(err, "problem looking up resource")
+		}
+		if exists {
+			outcome = OutcomeUpdated
+		}
+	}
+
+	if err := rt.Write(r, w); err != nil {
+		return OutcomeFailed, err
+	}
+	return outcome, nil
+}
+
 func unmarshalResource(decoder *json.Decoder) (Resource, error) {
 	var m map[string]json.RawMessage
 	if err := decoder.Decode(&m); err != nil {
 		return nil, errors.Wrap(err, "problem decoding JSON object")
 	}
+	return resourceFromFields(m)
+}
+
+// resourceFromFields creates the resource of the type given by the resourceType field of the JSON object m.
+func resourceFromFields(m map[string]json.RawMessage) (Resource, error) {
 	resourceTypeJSON, ok := m["resourceType"]
 	if !ok {
 		return nil, errors.Errorf("resourceType not found")
@@ -77,11 +397,11 @@ func unmarshalResource(decoder *json.Decoder) (Resource, error) {
 	if err := json.Unmarshal(resourceTypeJSON, &resourceType); err != nil {
 		return nil, errors.Wrap(err, "problem parsing resourceType as string")
 	}
-	resourceFactory, ok := resourceFactoriesByType[resourceType]
+	rt, ok := LookupResourceType(resourceType)
 	if !ok {
 		return nil, errors.Errorf("unknown resourceType: " + string(resourceType))
 	}
-	resource := resourceFactory()
+	resource := rt.New()
 
 	mJSON, _ := json.Marshal(m)
 	if err := json.Unmarshal(mJSON, resource); err != nil {
@@ -90,21 +410,3 @@ func unmarshalResource(decoder *json.Decoder) (Resource, error) {
 
 	return reflect.ValueOf(resource).Elem().Interface().(Resource), nil
 }
-
-var resourceFactoriesByType = map[string]func() Resource{
-	"Bundle": func() Resource {
-		return &Bundle{}
-	},
-	"Patient": func() Resource {
-		return &Patient{}
-	},
-	"Doctor": func() Resource {
-		return &Doctor{}
-	},
-	"Appointment": func() Resource {
-		return &Appointment{}
-	},
-	"Diagnosis": func() Resource {
-		return &Diagnosis{}
-	},
-}
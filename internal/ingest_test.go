@@ -1,10 +1,16 @@
 package internal_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -27,6 +33,657 @@ func TestIngest(t *testing.T) {
 	assert.Contains(t, store.Doctors, "9bf9e532-93bd-11eb-a8b3-0242ac130003")
 	assert.Contains(t, store.Appointments, "be142dc6-93bd-11eb-a8b3-0242ac130003")
 	assert.Contains(t, store.Diagnoses, "541a72a8-df75-4484-ac89-ac4923f03b81")
+
+	patient := store.Patients["6739ec3e-93bd-11eb-a8b3-0242ac130003"]
+	require.NotNil(t, patient.Active)
+	assert.True(t, *patient.Active)
+	assert.Equal(t, "female", patient.Gender)
+	assert.Equal(t, "1955-01-06", patient.BirthDate)
+	// the bundle lists contact points under contact, which are taken as telecom
+	assert.Equal(t, []ContactPoint{
+		{System: "phone", Value: "555-555-2021", Use: "mobile"},
+		{System: "email", Value: "tendo@tendoco.com", Use: "work"},
+	}, patient.Telecom)
+	assert.Empty(t, patient.Contacts)
+	assert.Equal(t, []Address{{Use: "home", Line: []string{"2222 Home Street"}}}, patient.Address)
+
+	appointment := store.Appointments["be142dc6-93bd-11eb-a8b3-0242ac130003"]
+	assert.Equal(t, []CodeableConcept{{Text: "Endocrinologist visit"}}, appointment.AppointmentType)
+	require.NotNil(t, appointment.Period.Start)
+	require.NotNil(t, appointment.Period.End)
+	assert.Equal(t, time.Date(2021, 4, 2, 11, 30, 0, 0, time.UTC), *appointment.Period.Start)
+	assert.Equal(t, 30*time.Minute, appointment.Period.End.Sub(*appointment.Period.Start))
+}
+
+func TestIngest_NDJSON(t *testing.T) {
+	f, err := os.Open("testdata/resources.ndjson")
+	require.NoError(t, err)
+	defer f.Close()
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(f, store, IngestOptions{})
+	require.NoError(t, err)
+
+	assert.Len(t, report.Entries, 4)
+	assert.Contains(t, store.Patients, "6739ec3e-93bd-11eb-a8b3-0242ac130003")
+	assert.Contains(t, store.Doctors, "9bf9e532-93bd-11eb-a8b3-0242ac130003")
+	assert.Contains(t, store.Appointments, "be142dc6-93bd-11eb-a8b3-0242ac130003")
+	assert.Contains(t, store.Diagnoses, "541a72a8-df75-4484-ac89-ac4923f03b81")
+}
+
+func TestIngest_ConcatenatedDocuments(t *testing.T) {
+	in := `{"resourceType": "Patient", "id": "p1"} {"resourceType": "Unknown", "id": "u1"}
+		{"resourceType": "Bundle", "type": "collection", "entry": [{"resource": {"resourceType": "Patient", "id": "p2"}}]}`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(in), store, IngestOptions{ContinueOnError: true})
+	assert.Error(t, err)
+
+	require.Len(t, report.Entries, 3)
+	assert.Equal(t, EntryResult{Index: 1, ResourceType: "Unknown", ID: "u1", Outcome: OutcomeFailed, Error: "unknown resourceType: Unknown"}, report.Entries[1])
+	assert.Contains(t, store.Patients, "p1")
+	assert.Contains(t, store.Patients, "p2")
+}
+
+func TestIngest_StreamsBundleEntries(t *testing.T) {
+	// the input breaks off after the first entry, which must have been written by then
+	in := io.MultiReader(
+		strings.NewReader(`{"resourceType": "Bundle", "type": "batch", "entry": [{"resource": {"resourceType": "Patient", "id": "p1"}},`),
+		iotest.ErrReader(errors.New("connection reset")),
+	)
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(in, store, IngestOptions{})
+	assert.EqualError(t, err, "problem decoding bundled resource at entry 1: connection reset")
+	assert.Len(t, report.Entries, 1)
+	assert.Contains(t, store.Patients, "p1")
+}
+
+func TestIngest_ResolvesBundleReferences(t *testing.T) {
+	for _, bundleType := range []string{BundleTypeTransaction, "collection"} {
+		t.Run(bundleType, func(t *testing.T) {
+			in := `{
+				"resourceType": "Bundle",
+				"type": "` + bundleType + `",
+				"entry": [
+					{"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a", "resource": {"resourceType": "Patient"}},
+					{"fullUrl": "https://example.org/fhir/Doctor/d1", "resource": {"resourceType": "Doctor", "id": "d1"}},
+					{"fullUrl": "urn:uuid:88f151c0-a954-468a-88d6-ba3d6e1a2e4a", "resource": {
+						"resourceType": "Appointment",
+						"status": "finished",
+						"subject": {"reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a"},
+						"actor": {"reference": "https://example.org/fhir/Doctor/d1/_history/2"}
+					}}
+				]
+			}`
+
+			store := datastore.NewMemStore()
+			report, err := IngestWithReport(strings.NewReader(in), store, IngestOptions{References: ReferencesStrict})
+			require.NoError(t, err)
+			require.Len(t, report.Entries, 3)
+
+			patientID := report.Entries[0].ID
+			assert.NotEmpty(t, patientID)
+			assert.Contains(t, store.Patients, patientID)
+
+			appointment, ok := store.Appointments[report.Entries[2].ID]
+			require.True(t, ok)
+			assert.Equal(t, Reference{ResourceID: patientID, ResourceType: "Patient"}, appointment.Subject)
+			assert.Equal(t, Reference{ResourceID: "d1", ResourceType: "Doctor"}, appointment.Actor)
+		})
+	}
+}
+
+func TestIngest_ForwardBundleReferences(t *testing.T) {
+	// the diagnosis refers to the appointment, which refers to the patient, each by the fullUrl of a later entry
+	const entries = `[
+		{"fullUrl": "urn:uuid:3c5f6a9e-2a4b-4f0e-9a51-6f0c1c1d7f10", "resource": {"resourceType": "Diagnosis", "status": "final", "appointment": {"reference": "urn:uuid:88f151c0-a954-468a-88d6-ba3d6e1a2e4a"}}},
+		{"fullUrl": "urn:uuid:88f151c0-a954-468a-88d6-ba3d6e1a2e4a", "resource": {"resourceType": "Appointment", "status": "finished", "subject": {"reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a"}, "actor": {"reference": "Doctor/d1"}}},
+		{"resource": {"resourceType": "Doctor", "id": "d1"}},
+		{"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a", "resource": {"resourceType": "Patient"}}
+	]`
+
+	for name, in := range map[string]string{
+		"streamed":      `{"resourceType": "Bundle", "type": "collection", "entry": ` + entries + `}`,
+		"entries first": `{"resourceType": "Bundle", "entry": ` + entries + `, "type": "collection"}`,
+		"batch":         `{"resourceType": "Bundle", "type": "batch", "entry": ` + entries + `}`,
+		"transaction":   `{"resourceType": "Bundle", "type": "transaction", "entry": ` + entries + `}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := datastore.NewMemStore()
+			report, err := IngestWithReport(strings.NewReader(in), store, IngestOptions{References: ReferencesStrict, Workers: 4})
+			require.NoError(t, err)
+			require.Len(t, report.Entries, 4)
+
+			require.Len(t, store.Patients, 1)
+			require.Len(t, store.Appointments, 1)
+			require.Len(t, store.Diagnoses, 1)
+			for patientID := range store.Patients {
+				for appointmentID, appointment := range store.Appointments {
+					assert.Equal(t, patientID, appointment.Subject.ResourceID)
+					for _, diagnosis := range store.Diagnoses {
+						assert.Equal(t, appointmentID, diagnosis.Appointment.ResourceID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIngest_UnresolvedBundleReference(t *testing.T) {
+	in := `{"resourceType": "Appointment", "id": "a1", "subject": {"reference": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a"}, "actor": {"reference": "Doctor/d1"}}`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(in), store, IngestOptions{})
+	assert.Error(t, err)
+	require.Len(t, report.Entries, 1)
+	assert.Contains(t, report.Entries[0].Error, "reference urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a does not match the fullUrl of any bundle entry")
+	assert.Empty(t, store.Appointments)
+}
+
+func TestIngest_MatchesIdentifiers(t *testing.T) {
+	// the same patient arrives from two feeds under different ids, and an appointment refers to it by identifier
+	const feeds = `
+		{"resourceType": "Patient", "id": "feed1-p1", "identifier": [{"system": "http://hospital.example.org/mrn", "value": "12345"}], "name": [{"family": "Tenderson"}]}
+		{"resourceType": "Patient", "id": "feed2-p9", "identifier": [{"system": "http://hospital.example.org/mrn", "value": "12345"}], "name": [{"family": "Renamed"}]}
+		{"resourceType": "Doctor", "id": "d1"}
+		{"resourceType": "Appointment", "id": "a1", "status": "finished", "subject": {"reference": "Patient?identifier=http://hospital.example.org/mrn|12345"}, "actor": {"reference": "Doctor/d1"}}
+		{"resourceType": "Appointment", "id": "a2", "status": "finished", "subject": {"reference": "Patient/feed2-p9"}, "actor": {"reference": "Doctor/d1"}}
+		{"resourceType": "Appointment", "id": "a3", "status": "finished", "subject": {"type": "Patient", "identifier": {"system": "http://hospital.example.org/mrn", "value": "12345"}}, "actor": {"reference": "Doctor/d1"}}
+	`
+
+	for name, store := range map[string]*datastore.MemStore{
+		"matched within the ingest": datastore.NewMemStore(),
+		"matched in the store": func() *datastore.MemStore {
+			store := datastore.NewMemStore()
+			require.NoError(t, store.WritePatient(Patient{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "feed1-p1", ResourceType: "Patient"},
+				Identifiers:       []Identifier{{System: "http://hospital.example.org/mrn", Value: "12345"}},
+			}))
+			return store
+		}(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			report, err := IngestWithReport(strings.NewReader(feeds), store, IngestOptions{References: ReferencesStrict})
+			require.NoError(t, err)
+
+			require.Len(t, store.Patients, 1)
+			assert.Equal(t, "Renamed", store.Patients["feed1-p1"].Name[0].Family)
+			assert.Equal(t, "feed1-p1", report.Entries[1].ID)
+			assert.Equal(t, OutcomeUpdated, report.Entries[1].Outcome)
+			for _, id := range []string{"a1", "a2", "a3"} {
+				assert.Equal(t, "feed1-p1", store.Appointments[id].Subject.ResourceID, id)
+			}
+		})
+	}
+}
+
+func TestIngest_Practitioner(t *testing.T) {
+	const export = `
+		{"resourceType": "Patient", "id": "p1"}
+		{"resourceType": "Practitioner", "id": "d1", "identifier": [{"system": "http://hl7.org/fhir/sid/us-npi", "value": "1234567890"}], "name": [{"family": "Careful", "given": ["Adam"]}]}
+		{"resourceType": "PractitionerRole", "id": "r1", "practitioner": {"reference": "Practitioner/d1"}, "specialty": [{"text": "Endocrinology"}]}
+		{"resourceType": "Appointment", "id": "a1", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner/d1"}}
+		{"resourceType": "Appointment", "id": "a2", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner?identifier=http://hl7.org/fhir/sid/us-npi|1234567890"}}
+	`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(export), store, IngestOptions{References: ReferencesStrict})
+	require.NoError(t, err)
+	assert.Equal(t, "Doctor", report.Entries[1].ResourceType)
+
+	doctor, err := store.GetDoctor("d1")
+	require.NoError(t, err)
+	require.NotNil(t, doctor)
+	assert.Equal(t, "Doctor", doctor.Type())
+	assert.Equal(t, "Careful", doctor.Name[0].Family)
+	assert.Equal(t, []CodeableConcept{{Text: "Endocrinology"}}, doctor.Specialties())
+	for _, id := range []string{"a1", "a2"} {
+		assert.Equal(t, Reference{ResourceID: "d1", ResourceType: "Doctor"}, store.Appointments[id].Actor, id)
+	}
+
+	// either export form is read back as the same doctor
+	for _, form := range []DoctorForm{DoctorFormDoctor, DoctorFormPractitioner} {
+		data, err := json.Marshal(Bundle{BundleType: BundleTypeCollection, Resources: doctor.Export(form)})
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"resourceType":"`+string(form)+`"`)
+
+		imported := datastore.NewMemStore()
+		require.NoError(t, Ingest(bytes.NewReader(data), imported))
+		actual, err := imported.GetDoctor("d1")
+		require.NoError(t, err)
+		assert.Equal(t, doctor, actual, form)
+	}
+}
+
+func TestIngest_EncounterConditions(t *testing.T) {
+	const export = `
+		{"resourceType": "Patient", "id": "p1"}
+		{"resourceType": "Practitioner", "id": "d1"}
+		{"resourceType": "Appointment", "id": "a1", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner/d1"}}
+		{"resourceType": "Encounter", "id": "e1", "status": "finished", "subject": {"reference": "Patient/p1"}, "basedOn": [{"reference": "Appointment/a1"}], "diagnosis": [{"condition": {"reference": "Condition/c2"}, "rank": 1}, {"condition": {"reference": "Condition/c1"}, "rank": 2}]}
+		{"resourceType": "Condition", "id": "c1", "encounter": {"reference": "Encounter/e1"}, "verificationStatus": {"coding": [{"code": "confirmed"}]}, "clinicalStatus": {"coding": [{"code": "active"}]}, "code": {"text": "Hypertension"}}
+		{"resourceType": "Condition", "id": "c2", "encounter": {"reference": "Encounter/e1"}, "clinicalStatus": {"coding": [{"code": "active"}]}, "code": {"text": "Diabetes"}}
+	`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(export), store, IngestOptions{References: ReferencesStrict})
+	require.NoError(t, err)
+	assert.Equal(t, "Diagnosis", report.Entries[4].ResourceType)
+
+	appointment, err := store.GetAppointment("a1")
+	require.NoError(t, err)
+	require.NotNil(t, appointment)
+	require.Len(t, appointment.Diagnoses, 2)
+	assert.Equal(t, []string{"c2", "c1"}, []string{appointment.Diagnoses[0].ID(), appointment.Diagnoses[1].ID()})
+	assert.Equal(t, "confirmed", appointment.Diagnoses[1].Status)
+	assert.Equal(t, "active", appointment.Diagnoses[0].Status)
+	require.NotNil(t, appointment.PrimaryDiagnosis())
+	assert.Equal(t, "Diabetes", appointment.PrimaryDiagnosis().Name())
+	assert.Equal(t, &Reference{ResourceID: "e1", ResourceType: "Encounter"}, appointment.PrimaryDiagnosis().Encounter)
+}
+
+func TestIngest_QuestionnaireResponse(t *testing.T) {
+	const export = `
+		{"resourceType": "Patient", "id": "p1"}
+		{"resourceType": "Practitioner", "id": "d1"}
+		{"resourceType": "Appointment", "id": "a1", "status": "finished", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner/d1"}}
+		{"resourceType": "Appointment", "id": "a2", "status": "finished", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner/d1"}}
+		{"resourceType": "Appointment", "id": "a3", "status": "booked", "subject": {"reference": "Patient/p1"}, "actor": {"reference": "Practitioner/d1"}}
+		{"resourceType": "Encounter", "id": "e1", "status": "finished", "subject": {"reference": "Patient/p1"}, "basedOn": [{"reference": "Appointment/a2"}], "diagnosis": [{"condition": {"reference": "Condition/c1"}, "rank": 1}]}
+		{"resourceType": "Condition", "id": "c1", "encounter": {"reference": "Encounter/e1"}, "code": {"text": "Diabetes"}}
+		{"resourceType": "Questionnaire", "id": "visit", "version": "1", "status": "active", "item": [
+			{"linkId": "seen", "type": "boolean", "text": "Were you seen on time?", "required": true},
+			{"linkId": "wait", "type": "string", "text": "How long did you wait?", "required": true, "enableWhen": [{"question": "seen", "operator": "=", "answerBoolean": false}]}
+		]}
+		{"resourceType": "QuestionnaireResponse", "id": "r1", "extension": [{"url": "https://github.com/scraymondjr/appointment/StructureDefinition/feedback-channel", "valueCode": "sms"}], "questionnaire": "http://partner.example.org/Questionnaire/visit|1", "status": "completed", "basedOn": [{"reference": "Appointment/a1"}], "authored": "2021-03-04T09:30:00Z", "item": [
+			{"linkId": "seen", "answer": [{"valueBoolean": false}]},
+			{"linkId": "wait", "answer": [{"valueString": "an hour"}]}
+		]}
+		{"resourceType": "Bundle", "type": "transaction", "entry": [{"resource": {"resourceType": "QuestionnaireResponse", "questionnaire": "Questionnaire/appointment-feedback|1", "status": "completed", "basedOn": [{"reference": "Appointment/a2"}], "item": [
+			{"linkId": "recommend", "answer": [{"valueInteger": 8}]},
+			{"linkId": "explained", "answer": [{"valueBoolean": true}]},
+			{"linkId": "feeling", "answer": [{"valueString": "fine"}]}
+		]}}]}
+		{"resourceType": "QuestionnaireResponse", "id": "r3", "questionnaire": "Questionnaire/visit|1", "status": "completed", "basedOn": [{"reference": "Appointment/a2"}], "item": [
+			{"linkId": "seen", "answer": [{"valueBoolean": true}]},
+			{"linkId": "wait", "answer": [{"valueString": "none"}]}
+		]}
+		{"resourceType": "QuestionnaireResponse", "id": "r4", "questionnaire": "Questionnaire/visit|2", "status": "completed", "basedOn": [{"reference": "Appointment/a2"}]}
+		{"resourceType": "QuestionnaireResponse", "id": "r5", "extension": [{"url": "https://github.com/scraymondjr/appointment/StructureDefinition/diagnosis", "valueReference": {"reference": "Condition/c1"}}], "questionnaire": "Questionnaire/visit|1", "status": "completed", "basedOn": [{"reference": "Appointment/a1"}], "item": [
+			{"linkId": "seen", "answer": [{"valueBoolean": true}]}
+		]}
+		{"resourceType": "QuestionnaireResponse", "id": "r6", "questionnaire": "Questionnaire/visit|1", "status": "completed", "basedOn": [{"reference": "Appointment/a3"}], "item": [
+			{"linkId": "seen", "answer": [{"valueBoolean": true}]}
+		]}
+	`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(export), store, IngestOptions{References: ReferencesStrict, ContinueOnError: true})
+	assert.Error(t, err)
+	require.Len(t, report.Entries, 14)
+	for _, entry := range report.Entries[:10] {
+		assert.Equal(t, OutcomeCreated, entry.Outcome, entry.Error)
+	}
+	assert.Equal(t, "question wait is not asked given the other answers", report.Entries[10].Error)
+	assert.Equal(t, "survey visit version 2 has not been saved", report.Entries[11].Error)
+	assert.Equal(t, "diagnosis c1 is not of appointment a1", report.Entries[12].Error)
+	assert.Equal(t, "appointment a3 has not ended", report.Entries[13].Error)
+
+	survey, err := store.GetSurvey("visit", 1)
+	require.NoError(t, err)
+	require.NotNil(t, survey)
+	assert.Equal(t, &Condition{Question: "seen", Equals: &Answer{Bool: boolPtr(false)}}, survey.Question("wait").When)
+
+	feedback, err := store.GetPatientFeedback("a1")
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, "visit", feedback.Survey)
+	assert.Equal(t, "an hour", *feedback.Answers["wait"].Text)
+	// with the id, creation time and channel of the response
+	assert.Equal(t, "r1", feedback.ID())
+	assert.Equal(t, time.Date(2021, 3, 4, 9, 30, 0, 0, time.UTC), feedback.CreatedAt.UTC())
+	assert.Equal(t, FeedbackChannelSMS, feedback.Channel)
+
+	// written in a transaction, answering the default survey
+	feedback, err = store.GetPatientFeedback("a2")
+	require.NoError(t, err)
+	require.NotNil(t, feedback)
+	assert.Equal(t, LegacyFeedback(8, true, "fine").Answers, feedback.Answers)
+	assert.Equal(t, Reference{ResourceID: "a2", ResourceType: "Appointment"}, feedback.Appointment)
+}
+
+func TestIngest_UnresolvedConditionalReference(t *testing.T) {
+	in := `{"resourceType": "Appointment", "id": "a1", "subject": {"reference": "Patient?identifier=mrn|12345"}, "actor": {"reference": "Doctor/d1"}}`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(in), store, IngestOptions{})
+	assert.Error(t, err)
+	require.Len(t, report.Entries, 1)
+	assert.Contains(t, report.Entries[0].Error, "no Patient with identifier mrn|12345")
+	assert.Empty(t, store.Appointments)
+}
+
+func TestIngestWithReport_Workers(t *testing.T) {
+	const n = 200
+	var in strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&in, `{"resourceType": "Patient", "id": "p%d"}`+"\n", i)
+		fmt.Fprintf(&in, `{"resourceType": "Doctor", "id": "d%d"}`+"\n", i)
+		fmt.Fprintf(&in, `{"resourceType": "Appointment", "id": "a%d", "subject": {"reference": "Patient/p%d"}, "actor": {"reference": "Doctor/d%d"}}`+"\n", i, i, i)
+		fmt.Fprintf(&in, `{"resourceType": "Diagnosis", "id": "x%d", "code": {"coding": [{"name": "flu"}]}, "appointment": {"reference": "Appointment/a%d"}}`+"\n", i, i)
+	}
+
+	var progress []IngestProgress
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(in.String()), dependencyCheckingWriter{store}, IngestOptions{
+		Workers: 8,
+		Progress: func(p IngestProgress) {
+			progress = append(progress, p)
+		},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, report.Entries, 4*n)
+	for i, entry := range report.Entries {
+		assert.Equal(t, i, entry.Index)
+		assert.Equal(t, OutcomeCreated, entry.Outcome)
+	}
+	assert.Len(t, store.Diagnoses, n)
+	require.Len(t, progress, 4*n)
+	assert.Equal(t, IngestProgress{Decoded: 4 * n, Written: 4 * n}, progress[len(progress)-1])
+}
+
+// dependencyCheckingWriter fails to write a resource if a resource it refers to has not been written.
+type dependencyCheckingWriter struct {
+	*datastore.MemStore
+}
+
+func (w dependencyCheckingWriter) WriteAppointment(a Appointment) error {
+	if err := w.requireWritten(a.Subject, a.Actor); err != nil {
+		return err
+	}
+	return w.MemStore.WriteAppointment(a)
+}
+
+func (w dependencyCheckingWriter) WriteDiagnosis(d Diagnosis) error {
+	if err := w.requireWritten(d.Appointment); err != nil {
+		return err
+	}
+	return w.MemStore.WriteDiagnosis(d)
+}
+
+func (w dependencyCheckingWriter) requireWritten(refs ...Reference) error {
+	for _, ref := range refs {
+		if exists, _ := w.HasResource(ref.ResourceType, ref.ResourceID); !exists {
+			return fmt.Errorf("%s/%s not written yet", ref.ResourceType, ref.ResourceID)
+		}
+	}
+	return nil
+}
+
+func TestWriteResource_BundleType(t *testing.T) {
+	patient := Patient{ResourceTypeAndID: ResourceTypeAndID{ResourceID: "testpatient", ResourceType: "Patient"}}
+	unknown := ResourceTypeAndID{ResourceID: "testunknown", ResourceType: "Unknown"}
+	doctor := Doctor{ResourceTypeAndID: ResourceTypeAndID{ResourceID: "testdoctor", ResourceType: "Doctor"}}
+
+	for name, tt := range map[string]struct {
+		BundleType      string
+		ExpectedPatient bool
+		ExpectedDoctor  bool
+	}{
+		"transaction rolls back": {
+			BundleType: BundleTypeTransaction,
+		},
+		"batch writes all entries": {
+			BundleType:      BundleTypeBatch,
+			ExpectedPatient: true,
+			ExpectedDoctor:  true,
+		},
+		"collection stops at failure": {
+			BundleType:      "collection",
+			ExpectedPatient: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := datastore.NewMemStore()
+			err := WriteResource(Bundle{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "testbundle", ResourceType: "Bundle"},
+				BundleType:        tt.BundleType,
+				Resources:         BundledResources{patient, unknown, doctor},
+			}, store)
+			assert.Error(t, err)
+
+			_, ok := store.Patients[patient.ID()]
+			assert.Equal(t, tt.ExpectedPatient, ok)
+			_, ok = store.Doctors[doctor.ID()]
+			assert.Equal(t, tt.ExpectedDoctor, ok)
+		})
+	}
+
+	// a transaction without an id is named without one
+	err := WriteResource(Bundle{BundleType: BundleTypeTransaction, Resources: BundledResources{patient, unknown}}, datastore.NewMemStore())
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "transaction bundle rolled back: "), err.Error())
+}
+
+func TestIngestWithReport(t *testing.T) {
+	const bundleJSON = `{
+		"resourceType": "Bundle",
+		"id": "testbundle",
+		"type": "%s",
+		"entry": [
+			{"resource": {"resourceType": "Patient", "id": "testpatient", "name": [{"family": "Tenderson", "given": ["Tendo"]}]}},
+			{"resource": {"resourceType": "Doctor", "id": "faildoctor", "name": [{"family": "Failing", "given": ["Adam"]}]}},
+			{"resource": {"resourceType": "Doctor", "id": "testdoctor", "name": [{"family": "Careful", "given": ["Adam"]}]}}
+		]
+	}`
+
+	for name, tt := range map[string]struct {
+		BundleType       string
+		Options          IngestOptions
+		ExpectedOutcomes []Outcome
+	}{
+		"stop at first failure": {
+			ExpectedOutcomes: []Outcome{OutcomeUpdated, OutcomeFailed},
+		},
+		"continue on error": {
+			Options:          IngestOptions{ContinueOnError: true},
+			ExpectedOutcomes: []Outcome{OutcomeUpdated, OutcomeFailed, OutcomeCreated},
+		},
+		"batch": {
+			BundleType:       BundleTypeBatch,
+			ExpectedOutcomes: []Outcome{OutcomeUpdated, OutcomeFailed, OutcomeCreated},
+		},
+		"transaction": {
+			BundleType:       BundleTypeTransaction,
+			Options:          IngestOptions{ContinueOnError: true},
+			ExpectedOutcomes: []Outcome{OutcomeFailed, OutcomeFailed},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := datastore.NewMemStore()
+			require.NoError(t, store.WritePatient(Patient{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "testpatient", ResourceType: "Patient"},
+			}))
+
+			report, err := IngestWithReport(strings.NewReader(fmt.Sprintf(bundleJSON, tt.BundleType)), failingWriter{store}, tt.Options)
+			assert.Error(t, err)
+			require.NotNil(t, report)
+
+			var outcomes []Outcome
+			for i, entry := range report.Entries {
+				assert.Equal(t, i, entry.Index)
+				outcomes = append(outcomes, entry.Outcome)
+			}
+			assert.Equal(t, tt.ExpectedOutcomes, outcomes)
+			require.NotEmpty(t, report.Failed())
+			assert.Equal(t, "faildoctor", report.Failed()[len(report.Failed())-1].ID)
+		})
+	}
+}
+
+// failingWriter fails to write the doctor with id "faildoctor".
+type failingWriter struct {
+	*datastore.MemStore
+}
+
+func (w failingWriter) WriteDoctor(d Doctor) error {
+	if d.ID() == "faildoctor" {
+		return errors.New("doctor rejected")
+	}
+	return w.MemStore.WriteDoctor(d)
+}
+
+func (w failingWriter) WriteTransaction(fn func(ResourceWriter) error) error {
+	return w.MemStore.WriteTransaction(func(tx ResourceWriter) error {
+		return fn(failingTx{tx})
+	})
+}
+
+type failingTx struct {
+	ResourceWriter
+}
+
+func (tx failingTx) WriteDoctor(d Doctor) error {
+	if d.ID() == "faildoctor" {
+		return errors.New("doctor rejected")
+	}
+	return tx.ResourceWriter.WriteDoctor(d)
+}
+
+func (tx failingTx) HasResource(resourceType, id string) (bool, error) {
+	return tx.ResourceWriter.(ResourceLookup).HasResource(resourceType, id)
+}
+
+func TestIngestWithReport_References(t *testing.T) {
+	const resources = `
+		{"resourceType": "Patient", "id": "testpatient", "name": [{"family": "Tenderson", "given": ["Tendo"]}]}
+		{"resourceType": "Appointment", "id": "resolved", "status": "finished", "subject": {"reference": "Patient/testpatient"}, "actor": {"reference": "Doctor/storeddoctor"}}
+		{"resourceType": "Appointment", "id": "dangling", "status": "finished", "subject": {"reference": "Patient/testpatient"}, "actor": {"reference": "Doctor/nodoctor"}}
+		{"resourceType": "Appointment", "id": "wrongtype", "status": "finished", "subject": {"reference": "Patient/testpatient"}, "actor": {"reference": "Patient/testpatient"}}
+		{"resourceType": "Diagnosis", "id": "testdiagnosis", "status": "final", "code": {"coding": [{"name": "Diabetes without complications"}]}, "appointment": {"reference": "Appointment/resolved"}}
+	`
+
+	for name, tt := range map[string]struct {
+		Mode             ReferenceMode
+		ExpectedOutcomes []Outcome
+		ExpectedWarnings [][]string
+	}{
+		"unchecked": {
+			ExpectedOutcomes: []Outcome{OutcomeCreated, OutcomeCreated, OutcomeCreated, OutcomeCreated, OutcomeCreated},
+			ExpectedWarnings: [][]string{nil, nil, nil, nil, nil},
+		},
+		"lenient": {
+			Mode:             ReferencesLenient,
+			ExpectedOutcomes: []Outcome{OutcomeCreated, OutcomeCreated, OutcomeCreated, OutcomeCreated, OutcomeCreated},
+			ExpectedWarnings: [][]string{
+				nil,
+				nil,
+				{"actor refers to Doctor/nodoctor, which does not exist"},
+				{"actor refers to Patient/testpatient, expected a Doctor"},
+				nil,
+			},
+		},
+		"strict": {
+			Mode:             ReferencesStrict,
+			ExpectedOutcomes: []Outcome{OutcomeCreated, OutcomeCreated, OutcomeFailed, OutcomeFailed, OutcomeCreated},
+			ExpectedWarnings: [][]string{nil, nil, nil, nil, nil},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := datastore.NewMemStore()
+			require.NoError(t, store.WriteDoctor(Doctor{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "storeddoctor", ResourceType: "Doctor"},
+			}))
+
+			report, err := IngestWithReport(strings.NewReader(resources), store, IngestOptions{
+				ContinueOnError: true,
+				References:      tt.Mode,
+			})
+			if tt.Mode == ReferencesStrict {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			require.NotNil(t, report)
+
+			var (
+				outcomes []Outcome
+				warnings [][]string
+			)
+			for _, entry := range report.Entries {
+				outcomes = append(outcomes, entry.Outcome)
+				warnings = append(warnings, entry.Warnings)
+			}
+			assert.Equal(t, tt.ExpectedOutcomes, outcomes)
+			assert.Equal(t, tt.ExpectedWarnings, warnings)
+
+			_, written := store.Appointments["dangling"]
+			assert.Equal(t, tt.Mode != ReferencesStrict, written)
+		})
+	}
+}
+
+func TestIngestWithReport_ReferencesInRolledBackTransaction(t *testing.T) {
+	const resources = `
+		{
+			"resourceType": "Bundle",
+			"id": "testbundle",
+			"type": "transaction",
+			"entry": [
+				{"resource": {"resourceType": "Patient", "id": "testpatient"}},
+				{"resource": {"resourceType": "Doctor", "id": "faildoctor"}}
+			]
+		}
+		{"resourceType": "Doctor", "id": "testdoctor"}
+		{"resourceType": "Appointment", "id": "testappointment", "status": "finished", "subject": {"reference": "Patient/testpatient"}, "actor": {"reference": "Doctor/testdoctor"}}
+	`
+
+	store := datastore.NewMemStore()
+	report, err := IngestWithReport(strings.NewReader(resources), failingWriter{store}, IngestOptions{
+		ContinueOnError: true,
+		References:      ReferencesStrict,
+	})
+	assert.Error(t, err)
+	require.NotNil(t, report)
+
+	failed := report.Failed()
+	require.NotEmpty(t, failed)
+	last := failed[len(failed)-1]
+	assert.Equal(t, "testappointment", last.ID)
+	assert.Contains(t, last.Error, "subject refers to Patient/testpatient, which does not exist")
+}
+
+func TestIngestWithReport_ReferencesToFailedWrite(t *testing.T) {
+	// faildoctor fails to be written, so neither a reference to it nor its identifier resolves to it
+	const resources = `
+		{"resourceType": "Patient", "id": "testpatient"}
+		{"resourceType": "Doctor", "id": "faildoctor", "identifier": [{"system": "http://hospital.example.org/npi", "value": "42"}]}
+		{"resourceType": "Appointment", "id": "testappointment", "status": "finished", "subject": {"reference": "Patient/testpatient"}, "actor": {"reference": "Doctor/faildoctor"}}
+		{"resourceType": "Doctor", "id": "testdoctor", "identifier": [{"system": "http://hospital.example.org/npi", "value": "42"}]}
+	`
+
+	for name, workers := range map[string]int{"sequential": 0, "workers": 4} {
+		t.Run(name, func(t *testing.T) {
+			store := datastore.NewMemStore()
+			report, err := IngestWithReport(strings.NewReader(resources), failingWriter{store}, IngestOptions{
+				ContinueOnError: true,
+				Workers:         workers,
+				References:      ReferencesStrict,
+			})
+			assert.Error(t, err)
+			require.NotNil(t, report)
+
+			require.Len(t, report.Failed(), 2)
+			assert.Equal(t, "faildoctor", report.Failed()[0].ID)
+			assert.Equal(t, "testappointment", report.Failed()[1].ID)
+			assert.Contains(t, report.Failed()[1].Error, "actor refers to Doctor/faildoctor, which does not exist")
+
+			assert.Contains(t, store.Doctors, "testdoctor")
+			assert.NotContains(t, store.Appointments, "testappointment")
+		})
+	}
 }
 
 func TestReference_UnmarshalJSON(t *testing.T) {
@@ -42,6 +699,42 @@ func TestReference_UnmarshalJSON(t *testing.T) {
 				ResourceType: "Appointment",
 			},
 		},
+		"urn:uuid": {
+			InputJSON: json.RawMessage(`{"reference": "urn:uuid:be142dc6-93bd-11eb-a8b3-0242ac130003"}`),
+			ExpectedOutput: Reference{
+				URL: "urn:uuid:be142dc6-93bd-11eb-a8b3-0242ac130003",
+			},
+		},
+		"absolute URL": {
+			InputJSON: json.RawMessage(`{"reference": "https://example.org/fhir/Appointment/be142dc6-93bd-11eb-a8b3-0242ac130003"}`),
+			ExpectedOutput: Reference{
+				ResourceID:   "be142dc6-93bd-11eb-a8b3-0242ac130003",
+				ResourceType: "Appointment",
+				URL:          "https://example.org/fhir/Appointment/be142dc6-93bd-11eb-a8b3-0242ac130003",
+			},
+		},
+		"absolute URL without resource": {
+			InputJSON:     json.RawMessage(`{"reference": "https://example.org/"}`),
+			ExpectedError: fmt.Errorf(`unknown reference format for value "https://example.org/": expected a URL ending in {ResourceType}/{ResourceID}`),
+		},
+		"conditional": {
+			InputJSON: json.RawMessage(`{"reference": "Patient?identifier=http://hospital.example.org/mrn|12345"}`),
+			ExpectedOutput: Reference{
+				ResourceType: "Patient",
+				Identifier:   &Identifier{System: "http://hospital.example.org/mrn", Value: "12345"},
+			},
+		},
+		"conditional on unsupported search parameter": {
+			InputJSON:     json.RawMessage(`{"reference": "Patient?name=Tenderson"}`),
+			ExpectedError: fmt.Errorf(`unknown reference format for value "Patient?name=Tenderson": expected {ResourceType}?identifier={system}|{value}`),
+		},
+		"logical": {
+			InputJSON: json.RawMessage(`{"type": "Patient", "identifier": {"system": "http://hospital.example.org/mrn", "value": "12345"}}`),
+			ExpectedOutput: Reference{
+				ResourceType: "Patient",
+				Identifier:   &Identifier{System: "http://hospital.example.org/mrn", Value: "12345"},
+			},
+		},
 		"bad reference format": {
 			InputJSON:     json.RawMessage(`{"reference": "Appointment"}`),
 			ExpectedError: fmt.Errorf(`unknown reference format for value "Appointment": expected 2 parts, but found 1`),
@@ -67,3 +760,145 @@ func TestReference_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+// organization is a resource type registered by TestRegisterResourceType.
+type organization struct {
+	ResourceTypeAndID
+	Identifiers []Identifier `json:"identifier,omitempty"`
+	Name        string       `json:"name"`
+	PartOf      *Reference   `json:"partOf,omitempty"`
+}
+
+type organizationWriter interface {
+	WriteOrganization(organization) error
+}
+
+// organizationStore is a MemStore that also stores organizations.
+type organizationStore struct {
+	*datastore.MemStore
+	organizations map[string]organization
+}
+
+func (s organizationStore) WriteOrganization(o organization) error {
+	s.organizations[o.ID()] = o
+	return nil
+}
+
+func (s organizationStore) HasResource(resourceType, id string) (bool, error) {
+	if resourceType != "Organization" {
+		return s.MemStore.HasResource(resourceType, id)
+	}
+	_, ok := s.organizations[id]
+	return ok, nil
+}
+
+func (s organizationStore) FindByIdentifier(resourceType string, identifier Identifier) (string, error) {
+	if resourceType != "Organization" {
+		return s.MemStore.FindByIdentifier(resourceType, identifier)
+	}
+	for id, o := range s.organizations {
+		for _, i := range o.Identifiers {
+			if i == identifier {
+				return id, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func TestRegisterResourceType(t *testing.T) {
+	assert.Error(t, RegisterResourceType(ResourceType{Name: "Organization"}))
+	require.NoError(t, RegisterResourceType(ResourceType{
+		Name: "Organization",
+		New:  func() Resource { return &organization{} },
+		Validate: func(r Resource) error {
+			if r.(organization).Name == "" {
+				return errors.New("name is missing")
+			}
+			return nil
+		},
+		Write: func(r Resource, w ResourceWriter) error {
+			ow, ok := w.(organizationWriter)
+			if !ok {
+				return errors.New("writer does not store organizations")
+			}
+			return ow.WriteOrganization(r.(organization))
+		},
+		WithID: func(r Resource, id string) Resource {
+			o := r.(organization)
+			o.ResourceID = id
+			return o
+		},
+		Identifiers: func(r Resource) []Identifier { return r.(organization).Identifiers },
+		References: func(r Resource) []ReferenceField {
+			if o := r.(organization); o.PartOf != nil {
+				return []ReferenceField{{Name: "partOf", Reference: *o.PartOf, ExpectedType: "Organization"}}
+			}
+			return nil
+		},
+		MapReferences: func(r Resource, fn func(*Reference) error) (Resource, error) {
+			o := r.(organization)
+			if o.PartOf != nil {
+				partOf := *o.PartOf
+				if err := fn(&partOf); err != nil {
+					return nil, err
+				}
+				o.PartOf = &partOf
+			}
+			return o, nil
+		},
+	}))
+	rt, ok := LookupResourceType("Organization")
+	require.True(t, ok)
+	assert.False(t, rt.Tracked)
+
+	const export = `
+		{"resourceType": "Organization", "id": "o1", "name": "Springfield Clinic"}
+		{"resourceType": "Organization", "id": "o2"}
+		{"resourceType": "Patient", "id": "p1"}
+	`
+	store := organizationStore{datastore.NewMemStore(), map[string]organization{}}
+	report, err := IngestWithReport(strings.NewReader(export), store, IngestOptions{ContinueOnError: true})
+	assert.Error(t, err)
+	require.Len(t, report.Entries, 3)
+	assert.Equal(t, OutcomeCreated, report.Entries[0].Outcome)
+	assert.Equal(t, EntryResult{Index: 1, ResourceType: "Organization", ID: "o2", Outcome: OutcomeFailed, Error: "invalid Organization: name is missing"}, report.Entries[1])
+	assert.Equal(t, "Springfield Clinic", store.organizations["o1"].Name)
+	assert.NotContains(t, store.organizations, "o2")
+	assert.Contains(t, store.Patients, "p1")
+
+	// a store that does not know the type fails its resources
+	report, err = IngestWithReport(strings.NewReader(export), datastore.NewMemStore(), IngestOptions{ContinueOnError: true})
+	assert.Error(t, err)
+	assert.Equal(t, "writer does not store organizations", report.Entries[0].Error)
+
+	// the hooks match organizations by identifier and resolve and validate their references
+	const feeds = `
+		{"resourceType": "Organization", "id": "feed1-o1", "identifier": [{"system": "http://example.org/npi", "value": "1"}], "name": "Springfield Clinic"}
+		{"resourceType": "Organization", "id": "feed2-o7", "identifier": [{"system": "http://example.org/npi", "value": "1"}], "name": "Springfield Health"}
+		{"resourceType": "Organization", "id": "ward", "name": "Ward 3", "partOf": {"reference": "Organization/feed2-o7"}}
+		{"resourceType": "Organization", "id": "lab", "name": "Lab", "partOf": {"reference": "Patient/p1"}}
+	`
+	store = organizationStore{datastore.NewMemStore(), map[string]organization{}}
+	report, err = IngestWithReport(strings.NewReader(feeds), store, IngestOptions{ContinueOnError: true, References: ReferencesStrict})
+	assert.Error(t, err)
+	require.Len(t, report.Entries, 4)
+	assert.Equal(t, "feed1-o1", report.Entries[1].ID)
+	assert.Equal(t, "Springfield Health", store.organizations["feed1-o1"].Name)
+	assert.Equal(t, "feed1-o1", store.organizations["ward"].PartOf.ResourceID)
+	assert.Equal(t, "invalid references: partOf refers to Patient/p1, expected a Organization", report.Entries[3].Error)
+
+	assert.Error(t, RegisterResourceType(ResourceType{
+		Name:  "Organization",
+		New:   func() Resource { return &organization{} },
+		Write: func(Resource, ResourceWriter) error { return nil },
+		Tier:  -1,
+	}))
+	// a type read as another is written as that type
+	assert.Error(t, RegisterResourceType(ResourceType{
+		Name:   "Organization",
+		New:    func() Resource { return &organization{} },
+		Write:  func(Resource, ResourceWriter) error { return nil },
+		ReadAs: "Doctor",
+	}))
+}
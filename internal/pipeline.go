@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// pipeline.go contains the concurrent writing of resources for ingestion
+
+// numDependencyTiers is the number of tiers ordering resource types by the references between them, see
+// ResourceType.Tier.
+const numDependencyTiers = 5
+
+// dependencyTier returns the tier of resourceType. Unknown types depend on every other type.
+func dependencyTier(resourceType string) int {
+	if rt, ok := LookupResourceType(resourceType); ok {
+		return rt.Tier
+	}
+	return numDependencyTiers - 1
+}
+
+// writerPool is a fixed number of workers writing resources handed to them by the decoding goroutine.
+type writerPool struct {
+	jobs    chan writeJob
+	workers sync.WaitGroup
+	// pending counts the resources of each tier handed to workers and not yet written
+	pending [numDependencyTiers]sync.WaitGroup
+}
+
+type writeJob struct {
+	index    int // of the report entry
+	original Resource
+	resource Resource
+	writer   ResourceWriter
+	failFast bool
+}
+
+func (in *ingester) startPool(workers int) {
+	pool := &writerPool{
+		// unbuffered, so decoding waits for a free worker
+		jobs: make(chan writeJob),
+	}
+	pool.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer pool.workers.Done()
+			for job := range pool.jobs {
+				in.writeJob(job)
+				pool.pending[dependencyTier(job.resource.Type())].Done()
+			}
+		}()
+	}
+	in.pool = pool
+}
+
+func (in *ingester) writeJob(job writeJob) {
+	outcome, err := writeResource(job.resource, job.writer)
+	err = errors.Wrap(err, "problem writing resource "+job.resource.ID())
+	if err == nil {
+		in.markWritten(job.original, job.resource)
+	}
+	in.markPending(job.resource, false)
+	in.complete(job.index, outcome, err)
+	if err != nil && job.failFast {
+		in.mu.Lock()
+		if in.stopErr == nil {
+			in.stopErr = err
+		}
+		in.mu.Unlock()
+	}
+}
+
+// awaitDependencies waits for every resource handed to a worker that a resource of resourceType may depend on
+// to be written.
+func (in *ingester) awaitDependencies(resourceType string) {
+	for t := 0; t < dependencyTier(resourceType); t++ {
+		in.pool.pending[t].Wait()
+	}
+}
+
+// dispatch hands r, which arrived as original, to a worker. Every resource r may depend on must have been written,
+// see awaitDependencies. Returns an error if a previous write has stopped ingestion.
+func (in *ingester) dispatch(original, r Resource, w ResourceWriter, warnings []string, failFast bool) error {
+	if err := in.stopped(); err != nil {
+		return err
+	}
+
+	index := in.reserve(r.Type(), r.ID(), warnings)
+	in.markPending(r, true)
+	in.pool.pending[dependencyTier(r.Type())].Add(1)
+	in.pool.jobs <- writeJob{
+		index:    index,
+		original: original,
+		resource: r,
+		writer:   w,
+		failFast: failFast,
+	}
+	return nil
+}
+
+// drainPool waits for every resource handed to a worker to be written. Returns an error if a write has stopped
+// ingestion.
+func (in *ingester) drainPool() error {
+	if in.pool == nil {
+		return nil
+	}
+	for t := range in.pool.pending {
+		in.pool.pending[t].Wait()
+	}
+	return in.stopped()
+}
+
+// stopPool waits for the workers to write the resources handed to them and exit. Returns an error if a write
+// has stopped ingestion.
+func (in *ingester) stopPool() error {
+	if in.pool == nil {
+		return nil
+	}
+	close(in.pool.jobs)
+	in.pool.workers.Wait()
+	return in.stopped()
+}
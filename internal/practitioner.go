@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"encoding/json"
+)
+
+// practitioner.go contains the mapping of the FHIR Practitioner and PractitionerRole resources onto Doctor
+
+// PractitionerRole is a role of a doctor, giving the doctor's specialties. It is written as a separate resource
+// referring to the doctor, like a FHIR PractitionerRole refers to its Practitioner.
+type PractitionerRole struct {
+	ResourceTypeAndID
+	Active       *bool             `json:"active,omitempty"`
+	Practitioner Reference         `json:"practitioner"`
+	Specialty    []CodeableConcept `json:"specialty,omitempty"`
+}
+
+// DoctorForm is the resourceType a doctor is exported as.
+type DoctorForm string
+
+const (
+	// DoctorFormDoctor exports a doctor as a Doctor resource.
+	DoctorFormDoctor DoctorForm = "Doctor"
+	// DoctorFormPractitioner exports a doctor as a FHIR Practitioner resource.
+	DoctorFormPractitioner DoctorForm = "Practitioner"
+)
+
+// UnmarshalJSON unmarshals the doctor from a Doctor or a Practitioner resource.
+func (d *Doctor) UnmarshalJSON(data []byte) error {
+	type alias Doctor
+	var doctor alias
+	if err := json.Unmarshal(data, &doctor); err != nil {
+		return err
+	}
+	*d = Doctor(doctor)
+	d.ResourceType = canonicalType(d.ResourceType)
+	return nil
+}
+
+// Specialties returns the specialties of the active roles of the doctor.
+func (d Doctor) Specialties() []CodeableConcept {
+	var specialties []CodeableConcept
+	for _, role := range d.Roles {
+		if role.Active == nil || *role.Active {
+			specialties = append(specialties, role.Specialty...)
+		}
+	}
+	return specialties
+}
+
+// Export returns the doctor, followed by its roles, as resources of the form. Resources in the Practitioner form
+// refer to the doctor as a Practitioner; either form is read back as the same doctor.
+func (d Doctor) Export(form DoctorForm) []Resource {
+	doctor := d
+	doctor.ResourceType = string(form)
+	doctor.Roles = nil
+	resources := []Resource{doctor}
+	for _, role := range d.Roles {
+		role.ResourceType = "PractitionerRole"
+		role.Practitioner = Reference{
+			ResourceID:   d.ID(),
+			ResourceType: string(form),
+		}
+		resources = append(resources, role)
+	}
+	return resources
+}
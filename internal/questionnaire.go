@@ -0,0 +1,640 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// questionnaire.go contains the mapping of surveys onto FHIR Questionnaire resources, and of feedback onto FHIR
+// QuestionnaireResponse resources
+
+type (
+	// Questionnaire is a FHIR Questionnaire, the form a survey is exchanged in, see Survey.Questionnaire. It is
+	// ingested as the version of the survey it defines.
+	Questionnaire struct {
+		ResourceTypeAndID
+		URL string `json:"url,omitempty"`
+		// Version is the version of the survey, a whole number.
+		Version string              `json:"version"`
+		Title   string              `json:"title,omitempty"`
+		Status  string              `json:"status"` // draft, active, retired or unknown
+		Items   []QuestionnaireItem `json:"item"`
+	}
+
+	// QuestionnaireItem is a question of a Questionnaire. Its linkId is the id of the question.
+	QuestionnaireItem struct {
+		LinkID string `json:"linkId"`
+		Text   string `json:"text"`
+		// Type is integer for a scale, bounded by the minValue and maxValue extensions, boolean for a yes/no
+		// question, string or text for free text and choice for a choice, which repeats for a multiChoice.
+		Type           string                    `json:"type"`
+		Required       bool                      `json:"required,omitempty"`
+		Repeats        bool                      `json:"repeats,omitempty"`
+		Extensions     []Extension               `json:"extension,omitempty"`
+		AnswerOptions  []QuestionnaireAnswerType `json:"answerOption,omitempty"`
+		EnableWhen     []EnableWhen              `json:"enableWhen,omitempty"`
+		EnableBehavior string                    `json:"enableBehavior,omitempty"` // all or any
+	}
+
+	// QuestionnaireAnswerType is an answer option of a Questionnaire item, or an answer in a
+	// QuestionnaireResponse: one of the values is set.
+	QuestionnaireAnswerType struct {
+		ValueInteger *int    `json:"valueInteger,omitempty"`
+		ValueBoolean *bool   `json:"valueBoolean,omitempty"`
+		ValueString  *string `json:"valueString,omitempty"`
+		ValueCoding  *Coding `json:"valueCoding,omitempty"`
+	}
+
+	// EnableWhen is a condition of a Questionnaire item on the answer to another item: the operator compares the
+	// answer with the one answer value that is set.
+	EnableWhen struct {
+		Question      string  `json:"question"`
+		Operator      string  `json:"operator"` // =, !=, >, <, >= or <=
+		AnswerInteger *int    `json:"answerInteger,omitempty"`
+		AnswerBoolean *bool   `json:"answerBoolean,omitempty"`
+		AnswerString  *string `json:"answerString,omitempty"`
+		AnswerCoding  *Coding `json:"answerCoding,omitempty"`
+	}
+
+	// Extension is a FHIR extension: a value of a kind the resource has no element for, named by its URL.
+	Extension struct {
+		URL            string     `json:"url"`
+		ValueInteger   *int       `json:"valueInteger,omitempty"`
+		ValueString    *string    `json:"valueString,omitempty"`
+		ValueCode      *string    `json:"valueCode,omitempty"`
+		ValueReference *Reference `json:"valueReference,omitempty"`
+	}
+
+	// QuestionnaireResponse is a FHIR QuestionnaireResponse, the form feedback is exchanged in, see
+	// Feedback.QuestionnaireResponse. It is ingested as the feedback about the appointment it is based on.
+	QuestionnaireResponse struct {
+		ResourceTypeAndID
+		// Extensions hold the practitioner the appointment was with, the diagnosis the feedback is about and the
+		// channel it was submitted through.
+		Extensions []Extension `json:"extension,omitempty"`
+		// Questionnaire is the canonical URL of the survey version answered, such as "Questionnaire/visit|2".
+		Questionnaire string `json:"questionnaire"`
+		Status        string `json:"status"` // in-progress, completed, amended, entered-in-error or stopped
+		// BasedOn holds the appointment the feedback is about.
+		BasedOn []Reference `json:"basedOn,omitempty"`
+		Subject *Reference  `json:"subject,omitempty"`
+		// Authored is when the answers were given, and Source the patient who gave them.
+		Authored *time.Time                  `json:"authored,omitempty"`
+		Source   *Reference                  `json:"source,omitempty"`
+		Items    []QuestionnaireResponseItem `json:"item,omitempty"`
+	}
+
+	// QuestionnaireResponseItem is the answer to a question; a multiChoice question has an answer per choice.
+	QuestionnaireResponseItem struct {
+		LinkID  string                    `json:"linkId"`
+		Answers []QuestionnaireAnswerType `json:"answer,omitempty"`
+	}
+)
+
+// URLs of the extensions of Questionnaire and QuestionnaireResponse resources.
+const (
+	ExtensionMinValue = "http://hl7.org/fhir/StructureDefinition/minValue"
+	ExtensionMaxValue = "http://hl7.org/fhir/StructureDefinition/maxValue"
+	// ExtensionAnswerLabel is the Label of a question.
+	ExtensionAnswerLabel = "https://github.com/scraymondjr/appointment/StructureDefinition/answer-label"
+	// ExtensionTextTemplate is the Text of a question, a template, if the item's text, its wording for no
+	// patient, doctor or diagnosis, differs.
+	ExtensionTextTemplate = "https://github.com/scraymondjr/appointment/StructureDefinition/text-template"
+	// ExtensionPractitioner is the practitioner an appointment feedback is about was with. QuestionnaireResponse
+	// has no element for whom the answers are about other than the subject, the patient, and its author is whoever
+	// recorded the answers, so the practitioner, also the actor of the appointment in basedOn, is an extension
+	// for systems that do not resolve the appointment.
+	ExtensionPractitioner = "https://github.com/scraymondjr/appointment/StructureDefinition/practitioner"
+	// ExtensionDiagnosis is the diagnosis feedback is about.
+	ExtensionDiagnosis = "https://github.com/scraymondjr/appointment/StructureDefinition/diagnosis"
+	// ExtensionChannel is the channel feedback was submitted through, a FeedbackChannel code.
+	ExtensionChannel = "https://github.com/scraymondjr/appointment/StructureDefinition/feedback-channel"
+)
+
+// SurveyWriter is implemented by ResourceWriters that save survey versions, which lets ingestion write
+// Questionnaires as the surveys they define.
+type SurveyWriter interface {
+	SaveSurvey(Survey) error
+	GetSurvey(id string, version int) (*Survey, error)
+}
+
+// FeedbackWriter is implemented by ResourceWriters that save feedback, which lets ingestion write
+// QuestionnaireResponses as the feedback they give, checked against the survey version they answer and the
+// appointment they are about.
+type FeedbackWriter interface {
+	SavePatientFeedback(appointmentID string, feedback Feedback) (*Feedback, error)
+	GetSurvey(id string, version int) (*Survey, error)
+	GetAppointment(id string) (*Appointment, error)
+}
+
+// SurveyCanonical returns the canonical URL of the version of the survey with the id, which QuestionnaireResponses
+// answering it refer to.
+func SurveyCanonical(id string, version int) string {
+	return "Questionnaire/" + id + "|" + strconv.Itoa(version)
+}
+
+// Questionnaire returns the survey as a Questionnaire with the survey's id. The text of an item is the wording of
+// its question for no patient, doctor or diagnosis, see Question.Prompt.
+//
+// Returns an error if a condition of a question combines conditions in a way enableWhen cannot express: any of
+// conditions that test more than one answer.
+func (s Survey) Questionnaire() (Questionnaire, error) {
+	q := Questionnaire{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: s.ID, ResourceType: "Questionnaire"},
+		Version:           strconv.Itoa(s.Version),
+		Title:             s.Title,
+		Status:            "active",
+		Items:             make([]QuestionnaireItem, len(s.Questions)),
+	}
+	for i, question := range s.Questions {
+		text, err := question.Prompt(SurveyContext{})
+		if err != nil {
+			return Questionnaire{}, errors.Wrap(err, "question "+question.ID)
+		}
+		item := QuestionnaireItem{
+			LinkID:   question.ID,
+			Text:     text,
+			Required: !question.Optional,
+		}
+		if text != question.Text {
+			template := question.Text
+			item.Extensions = append(item.Extensions, Extension{URL: ExtensionTextTemplate, ValueString: &template})
+		}
+		switch question.Type {
+		case QuestionScale:
+			min, max := question.Min, question.Max
+			item.Type = "integer"
+			item.Extensions = append(item.Extensions,
+				Extension{URL: ExtensionMinValue, ValueInteger: &min},
+				Extension{URL: ExtensionMaxValue, ValueInteger: &max},
+			)
+		case QuestionYesNo:
+			item.Type = "boolean"
+		case QuestionText:
+			item.Type = "text"
+		case QuestionChoice, QuestionMultiChoice:
+			item.Type = "choice"
+			item.Repeats = question.Type == QuestionMultiChoice
+			for _, option := range question.Options {
+				item.AnswerOptions = append(item.AnswerOptions, QuestionnaireAnswerType{
+					ValueCoding: &Coding{Code: option.Value, Display: option.Label},
+				})
+			}
+		}
+		if question.Label != "" {
+			label := question.Label
+			item.Extensions = append(item.Extensions, Extension{URL: ExtensionAnswerLabel, ValueString: &label})
+		}
+		if question.When != nil {
+			item.EnableWhen, item.EnableBehavior, err = s.enableWhen(*question.When)
+			if err != nil {
+				return Questionnaire{}, errors.Wrap(err, "question "+question.ID)
+			}
+		}
+		q.Items[i] = item
+	}
+	return q, nil
+}
+
+// enableWhen returns the condition as the enableWhen of an item and their enableBehavior.
+func (s Survey) enableWhen(c Condition) ([]EnableWhen, string, error) {
+	if c.Question != "" {
+		enableWhen := s.testedAnswers(c)
+		if len(enableWhen) > 1 {
+			return enableWhen, "all", nil
+		}
+		return enableWhen, "", nil
+	}
+
+	conditions, behavior := c.All, "all"
+	if len(c.Any) > 0 {
+		conditions, behavior = c.Any, "any"
+	}
+	var enableWhen []EnableWhen
+	for _, condition := range conditions {
+		tested := s.testedAnswers(condition)
+		if condition.Question == "" || (behavior == "any" && len(tested) > 1) {
+			return nil, "", errors.New("condition combines conditions that enableWhen cannot express")
+		}
+		enableWhen = append(enableWhen, tested...)
+	}
+	return enableWhen, behavior, nil
+}
+
+// testedAnswers returns the enableWhen that all hold when the condition on a question does.
+func (s Survey) testedAnswers(c Condition) []EnableWhen {
+	var enableWhen []EnableWhen
+	if c.Equals != nil {
+		ew := EnableWhen{Question: c.Question, Operator: "="}
+		switch equals := *c.Equals; {
+		case equals.Number != nil:
+			ew.AnswerInteger = equals.Number
+		case equals.Bool != nil:
+			ew.AnswerBoolean = equals.Bool
+		case equals.Text != nil:
+			if q := s.Question(c.Question); q != nil && (q.Type == QuestionChoice || q.Type == QuestionMultiChoice) {
+				ew.AnswerCoding = &Coding{Code: *equals.Text}
+			} else {
+				ew.AnswerString = equals.Text
+			}
+		}
+		enableWhen = append(enableWhen, ew)
+	}
+	if c.Min != nil {
+		enableWhen = append(enableWhen, EnableWhen{Question: c.Question, Operator: ">=", AnswerInteger: c.Min})
+	}
+	if c.Max != nil {
+		enableWhen = append(enableWhen, EnableWhen{Question: c.Question, Operator: "<=", AnswerInteger: c.Max})
+	}
+	return enableWhen
+}
+
+// Survey returns the survey the questionnaire defines, with the questionnaire's id.
+//
+// Returns an error if the version is not a whole number, an item is of a type no question takes, such as a
+// group or a date, an integer item is not bounded by the minValue and maxValue extensions, an enableWhen compares
+// answers in a way a condition cannot, or the survey is not valid, see Survey.Validate.
+func (q Questionnaire) Survey() (Survey, error) {
+	version, err := strconv.Atoi(q.Version)
+	if err != nil {
+		return Survey{}, errors.Errorf("questionnaire %s version %q is not a whole number", q.ID(), q.Version)
+	}
+	s := Survey{ID: q.ID(), Version: version, Title: q.Title, Questions: make([]Question, len(q.Items))}
+	for i, item := range q.Items {
+		question, err := item.question()
+		if err != nil {
+			return Survey{}, errors.Wrap(err, "item "+item.LinkID)
+		}
+		s.Questions[i] = question
+	}
+	if err := s.Validate(); err != nil {
+		return Survey{}, errors.Wrap(err, "invalid survey "+s.ID)
+	}
+	return s, nil
+}
+
+func (item QuestionnaireItem) question() (Question, error) {
+	q := Question{ID: item.LinkID, Text: item.Text, Optional: !item.Required}
+	switch item.Type {
+	case "integer":
+		min, max := item.extension(ExtensionMinValue), item.extension(ExtensionMaxValue)
+		if min == nil || min.ValueInteger == nil || max == nil || max.ValueInteger == nil {
+			return Question{}, errors.New("integer item must have the minValue and maxValue extensions")
+		}
+		q.Type, q.Min, q.Max = QuestionScale, *min.ValueInteger, *max.ValueInteger
+	case "boolean":
+		q.Type = QuestionYesNo
+	case "string", "text":
+		q.Type = QuestionText
+	case "choice":
+		q.Type = QuestionChoice
+		if item.Repeats {
+			q.Type = QuestionMultiChoice
+		}
+		for _, option := range item.AnswerOptions {
+			switch {
+			case option.ValueCoding != nil:
+				q.Options = append(q.Options, Option{Value: option.ValueCoding.Code, Label: option.ValueCoding.Display})
+			case option.ValueString != nil:
+				q.Options = append(q.Options, Option{Value: *option.ValueString})
+			default:
+				return Question{}, errors.New("answer options must be codings or strings")
+			}
+		}
+	default:
+		return Question{}, errors.Errorf("type %q is not supported", item.Type)
+	}
+	if template := item.extension(ExtensionTextTemplate); template != nil && template.ValueString != nil {
+		q.Text = *template.ValueString
+	}
+	if label := item.extension(ExtensionAnswerLabel); label != nil && label.ValueString != nil {
+		q.Label = *label.ValueString
+	}
+
+	conditions := make([]Condition, len(item.EnableWhen))
+	for i, ew := range item.EnableWhen {
+		condition, err := ew.condition()
+		if err != nil {
+			return Question{}, err
+		}
+		conditions[i] = condition
+	}
+	switch {
+	case len(conditions) == 1:
+		q.When = &conditions[0]
+	case len(conditions) > 1 && item.EnableBehavior == "any":
+		q.When = &Condition{Any: conditions}
+	case len(conditions) > 1:
+		q.When = &Condition{All: conditions}
+	}
+	return q, nil
+}
+
+// extension returns the extension of the item with the URL, or nil if it has none.
+func (item QuestionnaireItem) extension(url string) *Extension {
+	return findExtension(item.Extensions, url)
+}
+
+func findExtension(extensions []Extension, url string) *Extension {
+	for i := range extensions {
+		if extensions[i].URL == url {
+			return &extensions[i]
+		}
+	}
+	return nil
+}
+
+func (ew EnableWhen) condition() (Condition, error) {
+	c := Condition{Question: ew.Question}
+	var equals Answer
+	switch {
+	case ew.AnswerInteger != nil:
+		equals.Number = ew.AnswerInteger
+	case ew.AnswerBoolean != nil:
+		equals.Bool = ew.AnswerBoolean
+	case ew.AnswerString != nil:
+		equals.Text = ew.AnswerString
+	case ew.AnswerCoding != nil:
+		equals.Text = &ew.AnswerCoding.Code
+	default:
+		return Condition{}, errors.Errorf("enableWhen on %s has no answer of a supported type", ew.Question)
+	}
+
+	switch {
+	case ew.Operator == "=":
+		c.Equals = &equals
+	case ew.Operator == "!=" && equals.Bool != nil:
+		not := !*equals.Bool
+		c.Equals = &Answer{Bool: &not}
+	case equals.Number != nil && (ew.Operator == ">=" || ew.Operator == ">"):
+		min := *equals.Number
+		if ew.Operator == ">" {
+			min++
+		}
+		c.Min = &min
+	case equals.Number != nil && (ew.Operator == "<=" || ew.Operator == "<"):
+		max := *equals.Number
+		if ew.Operator == "<" {
+			max--
+		}
+		c.Max = &max
+	default:
+		return Condition{}, errors.Errorf("enableWhen on %s: operator %q is not supported for its answer", ew.Question, ew.Operator)
+	}
+	return c, nil
+}
+
+// QuestionnaireResponse returns the feedback about the appointment as a completed QuestionnaireResponse with the
+// id of the feedback, answering the Questionnaire of survey, the survey version the feedback answers. Its answers
+// are items in the order of the questions; answers to questions the survey does not have follow, ordered by
+// question id.
+func (f Feedback) QuestionnaireResponse(appointment Appointment, survey Survey) QuestionnaireResponse {
+	r := QuestionnaireResponse{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: f.ID(), ResourceType: "QuestionnaireResponse"},
+		Questionnaire:     SurveyCanonical(f.Survey, f.SurveyVersion),
+		Status:            "completed",
+		BasedOn:           []Reference{{ResourceID: appointment.ID(), ResourceType: "Appointment"}},
+		Authored:          f.UpdatedAt,
+		Source:            f.Author,
+	}
+	if appointment.Subject.ResourceID != "" {
+		subject := appointment.Subject
+		r.Subject = &subject
+	}
+	if appointment.Actor.ResourceID != "" {
+		r.Extensions = append(r.Extensions, Extension{
+			URL:            ExtensionPractitioner,
+			ValueReference: &Reference{ResourceID: appointment.Actor.ResourceID, ResourceType: "Practitioner"},
+		})
+	}
+	if f.Diagnosis != nil {
+		r.Extensions = append(r.Extensions, Extension{
+			URL:            ExtensionDiagnosis,
+			ValueReference: &Reference{ResourceID: f.Diagnosis.ResourceID, ResourceType: "Condition"},
+		})
+	}
+	if f.Channel != "" {
+		channel := string(f.Channel)
+		r.Extensions = append(r.Extensions, Extension{URL: ExtensionChannel, ValueCode: &channel})
+	}
+
+	var ids []string
+	for _, q := range survey.Questions {
+		if _, ok := f.Answers[q.ID]; ok {
+			ids = append(ids, q.ID)
+		}
+	}
+	var others []string
+	for id := range f.Answers {
+		if survey.Question(id) == nil {
+			others = append(others, id)
+		}
+	}
+	sort.Strings(others)
+	for _, id := range append(ids, others...) {
+		r.Items = append(r.Items, QuestionnaireResponseItem{
+			LinkID:  id,
+			Answers: survey.Question(id).responseAnswers(f.Answers[id]),
+		})
+	}
+	return r
+}
+
+// responseAnswers returns a as the answers of a QuestionnaireResponse item. The choice of a question with
+// options, which q is if it is not nil, is a coding.
+func (q *Question) responseAnswers(a Answer) []QuestionnaireAnswerType {
+	coded := q != nil && (q.Type == QuestionChoice || q.Type == QuestionMultiChoice)
+	choice := func(value string) QuestionnaireAnswerType {
+		if !coded {
+			return QuestionnaireAnswerType{ValueString: &value}
+		}
+		coding := Coding{Code: value}
+		if option := q.option(value); option != nil {
+			coding.Display = option.Label
+		}
+		return QuestionnaireAnswerType{ValueCoding: &coding}
+	}
+
+	switch {
+	case a.Number != nil:
+		return []QuestionnaireAnswerType{{ValueInteger: a.Number}}
+	case a.Bool != nil:
+		return []QuestionnaireAnswerType{{ValueBoolean: a.Bool}}
+	case a.Text != nil:
+		return []QuestionnaireAnswerType{choice(*a.Text)}
+	default:
+		answers := make([]QuestionnaireAnswerType, len(a.Choices))
+		for i, value := range a.Choices {
+			answers[i] = choice(value)
+		}
+		return answers
+	}
+}
+
+// SurveyVersion returns the id and version of the survey the response answers, parsed from the canonical URL of
+// its questionnaire: the last segment of the URL is the id, and the version follows a "|".
+func (r QuestionnaireResponse) SurveyVersion() (string, int, error) {
+	canonical := r.Questionnaire
+	if i := strings.LastIndex(canonical, "/"); i >= 0 {
+		canonical = canonical[i+1:]
+	}
+	parts := strings.SplitN(canonical, "|", 2)
+	if parts[0] == "" || len(parts) < 2 {
+		return "", 0, errors.Errorf("questionnaire %q must name the survey id and version", r.Questionnaire)
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, errors.Errorf("questionnaire %q version is not a whole number", r.Questionnaire)
+	}
+	return parts[0], version, nil
+}
+
+// Appointment returns the reference to the appointment the response is based on, or nil if it has none.
+func (r QuestionnaireResponse) Appointment() *Reference {
+	for _, ref := range r.BasedOn {
+		if ref.ResourceType == "Appointment" && ref.ResourceID != "" {
+			return &ref
+		}
+	}
+	return nil
+}
+
+// Feedback returns the answers of the response as feedback with the response's id answering survey, the version
+// the response answers, submitted by the patient that is its source, if any, when it was authored, through the
+// channel of its extension.
+//
+// Returns an error if the channel is not a FeedbackChannel, an item answers a question the survey does not have,
+// has more than one answer to a question that is not multiChoice, or the feedback does not answer the survey, see
+// Survey.Check.
+func (r QuestionnaireResponse) Feedback(survey Survey) (Feedback, error) {
+	f := Feedback{
+		Survey:        survey.ID,
+		SurveyVersion: survey.Version,
+		Answers:       map[string]Answer{},
+		CreatedAt:     r.Authored,
+	}
+	if r.ID() != "" {
+		f.ResourceTypeAndID = ResourceTypeAndID{ResourceID: r.ID(), ResourceType: "Feedback"}
+	}
+	if channel := findExtension(r.Extensions, ExtensionChannel); channel != nil && channel.ValueCode != nil {
+		f.Channel = FeedbackChannel(*channel.ValueCode)
+		if !f.Channel.Valid() {
+			return Feedback{}, errors.Errorf("channel %q is not a feedback channel", f.Channel)
+		}
+	}
+	for _, item := range r.Items {
+		q := survey.Question(item.LinkID)
+		if q == nil {
+			return Feedback{}, errors.Errorf("survey %s has no question %s", survey.ID, item.LinkID)
+		}
+		if len(item.Answers) == 0 {
+			continue
+		}
+		if q.Type != QuestionMultiChoice && len(item.Answers) > 1 {
+			return Feedback{}, errors.Errorf("question %s has more than one answer", q.ID)
+		}
+
+		var a Answer
+		for _, answer := range item.Answers {
+			var text *string
+			switch {
+			case answer.ValueInteger != nil:
+				a.Number = answer.ValueInteger
+			case answer.ValueBoolean != nil:
+				a.Bool = answer.ValueBoolean
+			case answer.ValueString != nil:
+				text = answer.ValueString
+			case answer.ValueCoding != nil:
+				text = &answer.ValueCoding.Code
+			}
+			if text != nil && q.Type == QuestionMultiChoice {
+				a.Choices = append(a.Choices, *text)
+			} else if text != nil {
+				a.Text = text
+			}
+		}
+		f.Answers[q.ID] = a
+	}
+	if diagnosis := findExtension(r.Extensions, ExtensionDiagnosis); diagnosis != nil && diagnosis.ValueReference != nil {
+		ref := *diagnosis.ValueReference
+		f.Diagnosis = &ref
+	}
+	if r.Source != nil && r.Source.ResourceType == "Patient" {
+		source := *r.Source
+		f.Author = &source
+	}
+	return f, survey.Check(f)
+}
+
+// validateQuestionnaireResponse checks that the response names the survey version it answers and the
+// appointment it is about.
+func validateQuestionnaireResponse(r Resource) error {
+	response := r.(QuestionnaireResponse)
+	if _, _, err := response.SurveyVersion(); err != nil {
+		return err
+	}
+	if response.Appointment() == nil {
+		return errors.New("basedOn has no appointment")
+	}
+	return nil
+}
+
+// writeQuestionnaire writes the survey the questionnaire defines with w, a SurveyWriter, see PublishSurvey.
+// Writing the version of a survey that has been written already does nothing, unless its questions have changed.
+func writeQuestionnaire(r Resource, w ResourceWriter) error {
+	surveys, ok := w.(SurveyWriter)
+	if !ok {
+		return errors.New("writer does not save surveys")
+	}
+	survey, err := r.(Questionnaire).Survey()
+	if err != nil {
+		return err
+	}
+	return PublishSurvey(surveys, survey)
+}
+
+// writeQuestionnaireResponse writes the response as the feedback about its appointment with w, a
+// FeedbackWriter, checking it against the survey version it answers. The appointment must have ended, and the
+// diagnosis the feedback is about, if any, must be one of its diagnoses.
+func writeQuestionnaireResponse(r Resource, w ResourceWriter) error {
+	feedbackWriter, ok := w.(FeedbackWriter)
+	if !ok {
+		return errors.New("writer does not save feedback")
+	}
+	response := r.(QuestionnaireResponse)
+	appointmentID := response.Appointment().ResourceID
+	appointment, err := feedbackWriter.GetAppointment(appointmentID)
+	if err != nil {
+		return err
+	}
+	if appointment == nil {
+		return errors.Errorf("appointment %s not found", appointmentID)
+	}
+	if !appointment.Ended(time.Now()) {
+		return errors.Errorf("appointment %s has not ended", appointmentID)
+	}
+	id, version, err := response.SurveyVersion()
+	if err != nil {
+		return err
+	}
+	survey, err := LookupSurvey(feedbackWriter, id, version)
+	if err != nil {
+		return err
+	}
+	if survey == nil {
+		return errors.Errorf("survey %s version %d has not been saved", id, version)
+	}
+	feedback, err := response.Feedback(*survey)
+	if err != nil {
+		return err
+	}
+	if feedback.Diagnosis != nil && appointment.FindDiagnosis(feedback.Diagnosis.ResourceID) == nil {
+		return errors.Errorf("diagnosis %s is not of appointment %s", feedback.Diagnosis.ResourceID, appointmentID)
+	}
+	_, err = feedbackWriter.SavePatientFeedback(appointmentID, feedback)
+	return err
+}
@@ -0,0 +1,212 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+const branchingSurvey = `{
+	"id": "visit",
+	"version": 2,
+	"title": "Your visit",
+	"questions": [
+		{"id": "recommend", "type": "scale", "min": 1, "max": 10, "text": "Would you recommend Dr {{.Doctor}}?", "label": "Recommendation"},
+		{"id": "better", "type": "text", "text": "What could have been better?", "when": {"question": "recommend", "max": 6}},
+		{"id": "explained", "type": "yesNo", "text": "Was your care explained?"},
+		{"id": "unclear", "type": "multiChoice", "text": "Which part was unclear?", "options": [{"value": "diagnosis", "label": "The diagnosis"}, {"value": "medication"}], "when": {"question": "explained", "equals": false}},
+		{"id": "pharmacist", "type": "yesNo", "text": "Did you speak to a pharmacist?", "optional": true, "when": {"any": [{"question": "unclear", "equals": "medication"}, {"question": "recommend", "equals": 1}]}}
+	]
+}`
+
+func TestSurvey_Questionnaire(t *testing.T) {
+	for name, surveyJSON := range map[string]string{
+		"default":   "",
+		"branching": branchingSurvey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			survey, err := DefaultSurvey()
+			if surveyJSON != "" {
+				survey, err = ReadSurvey(strings.NewReader(surveyJSON))
+			}
+			require.NoError(t, err)
+
+			questionnaire, err := survey.Questionnaire()
+			require.NoError(t, err)
+			data, err := json.Marshal(questionnaire)
+			require.NoError(t, err)
+
+			// a questionnaire file is read as the survey it defines
+			read, err := ReadSurvey(strings.NewReader(string(data)))
+			require.NoError(t, err)
+			assert.Equal(t, survey, read)
+		})
+	}
+
+	survey, err := ReadSurvey(strings.NewReader(branchingSurvey))
+	require.NoError(t, err)
+	questionnaire, err := survey.Questionnaire()
+	require.NoError(t, err)
+	assert.Equal(t, "2", questionnaire.Version)
+	unclear := questionnaire.Items[3]
+	assert.Equal(t, "choice", unclear.Type)
+	assert.True(t, unclear.Repeats)
+	assert.True(t, unclear.Required)
+	require.Len(t, unclear.EnableWhen, 1)
+	assert.Equal(t, "=", unclear.EnableWhen[0].Operator)
+	assert.Equal(t, false, *unclear.EnableWhen[0].AnswerBoolean)
+	assert.Equal(t, "any", questionnaire.Items[4].EnableBehavior)
+	// the text is worded for no doctor, keeping the template
+	recommend := questionnaire.Items[0]
+	assert.Equal(t, "Would you recommend Dr ?", recommend.Text)
+	assert.Contains(t, recommend.Extensions, Extension{URL: ExtensionTextTemplate, ValueString: strPtr("Would you recommend Dr {{.Doctor}}?")})
+	assert.Empty(t, questionnaire.Items[1].Extensions)
+
+	// any of a range cannot be expressed with enableWhen
+	survey.Questions[4].When = &Condition{Any: []Condition{
+		{Question: "recommend", Min: intPtr(2), Max: intPtr(3)},
+		{Question: "explained", Equals: &Answer{Bool: boolPtr(false)}},
+	}}
+	_, err = survey.Questionnaire()
+	assert.EqualError(t, err, "question pharmacist: condition combines conditions that enableWhen cannot express")
+}
+
+func TestQuestionnaire_Survey(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(`{
+		"resourceType": "Questionnaire",
+		"id": "partner-visit",
+		"url": "http://partner.example.org/Questionnaire/partner-visit",
+		"version": "3",
+		"status": "active",
+		"item": [
+			{"linkId": "rating", "type": "integer", "text": "Rate your visit", "required": true, "extension": [
+				{"url": "http://hl7.org/fhir/StructureDefinition/minValue", "valueInteger": 0},
+				{"url": "http://hl7.org/fhir/StructureDefinition/maxValue", "valueInteger": 5}
+			]},
+			{"linkId": "why", "type": "string", "text": "Why so low?", "enableWhen": [{"question": "rating", "operator": "<", "answerInteger": 3}]},
+			{"linkId": "booked", "type": "choice", "text": "How did you book?", "answerOption": [{"valueString": "phone"}, {"valueString": "web"}]},
+			{"linkId": "seen", "type": "boolean", "text": "Were you seen on time?", "enableWhen": [
+				{"question": "booked", "operator": "=", "answerString": "web"},
+				{"question": "rating", "operator": ">", "answerInteger": 0}
+			], "enableBehavior": "all"}
+		]
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, "partner-visit", survey.ID)
+	assert.Equal(t, 3, survey.Version)
+	require.Len(t, survey.Questions, 4)
+	assert.Equal(t, Question{ID: "rating", Type: QuestionScale, Text: "Rate your visit", Min: 0, Max: 5}, survey.Questions[0])
+	assert.Equal(t, &Condition{Question: "rating", Max: intPtr(2)}, survey.Questions[1].When)
+	assert.True(t, survey.Questions[1].Optional)
+	assert.Equal(t, []Option{{Value: "phone"}, {Value: "web"}}, survey.Questions[2].Options)
+	assert.Equal(t, &Condition{All: []Condition{
+		{Question: "booked", Equals: &Answer{Text: strPtr("web")}},
+		{Question: "rating", Min: intPtr(1)},
+	}}, survey.Questions[3].When)
+
+	for name, tt := range map[string]struct {
+		Item  string
+		Error string
+	}{
+		"unsupported type": {
+			Item:  `{"linkId": "q", "type": "date", "text": "When?"}`,
+			Error: `item q: type "date" is not supported`,
+		},
+		"unbounded integer": {
+			Item:  `{"linkId": "q", "type": "integer", "text": "How many?"}`,
+			Error: "item q: integer item must have the minValue and maxValue extensions",
+		},
+		"unsupported operator": {
+			Item:  `{"linkId": "q", "type": "string", "text": "?", "enableWhen": [{"question": "q0", "operator": "exists", "answerBoolean": true}]}`,
+			Error: `item q: enableWhen on q0: operator "exists" is not supported for its answer`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadSurvey(strings.NewReader(`{"resourceType": "Questionnaire", "id": "s", "version": "1", "status": "active", "item": [
+				{"linkId": "q0", "type": "boolean", "text": "?"}, ` + tt.Item + `]}`))
+			assert.EqualError(t, err, tt.Error)
+		})
+	}
+	_, err = ReadSurvey(strings.NewReader(`{"resourceType": "Questionnaire", "id": "s", "version": "latest", "status": "active", "item": []}`))
+	assert.EqualError(t, err, `questionnaire s version "latest" is not a whole number`)
+}
+
+func TestFeedback_QuestionnaireResponse(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(branchingSurvey))
+	require.NoError(t, err)
+	appointment := Appointment{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: "a1", ResourceType: "Appointment"},
+		Subject:           Reference{ResourceID: "p1", ResourceType: "Patient"},
+		Actor:             Reference{ResourceID: "d1", ResourceType: "Doctor"},
+	}
+	authored := time.Date(2021, 3, 4, 9, 30, 0, 0, time.UTC)
+	feedback := Feedback{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: "f1", ResourceType: "Feedback"},
+		Author:            &Reference{ResourceID: "p1", ResourceType: "Patient"},
+		Channel:           FeedbackChannelWeb,
+		UpdatedAt:         &authored,
+		Survey:            "visit",
+		SurveyVersion:     2,
+		Diagnosis:         &Reference{ResourceID: "x1", ResourceType: "Diagnosis"},
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"recommend": 5, "better": "listen", "explained": false, "unclear": ["diagnosis", "medication"], "pharmacist": true}`), &feedback.Answers))
+
+	response := feedback.QuestionnaireResponse(appointment, survey)
+	data, err := json.Marshal(response)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"resourceType": "QuestionnaireResponse",
+		"id": "f1",
+		"extension": [
+			{"url": "https://github.com/scraymondjr/appointment/StructureDefinition/practitioner", "valueReference": {"reference": "Practitioner/d1"}},
+			{"url": "https://github.com/scraymondjr/appointment/StructureDefinition/diagnosis", "valueReference": {"reference": "Condition/x1"}},
+			{"url": "https://github.com/scraymondjr/appointment/StructureDefinition/feedback-channel", "valueCode": "web"}
+		],
+		"questionnaire": "Questionnaire/visit|2",
+		"status": "completed",
+		"basedOn": [{"reference": "Appointment/a1"}],
+		"subject": {"reference": "Patient/p1"},
+		"authored": "2021-03-04T09:30:00Z",
+		"source": {"reference": "Patient/p1"},
+		"item": [
+			{"linkId": "recommend", "answer": [{"valueInteger": 5}]},
+			{"linkId": "better", "answer": [{"valueString": "listen"}]},
+			{"linkId": "explained", "answer": [{"valueBoolean": false}]},
+			{"linkId": "unclear", "answer": [{"valueCoding": {"code": "diagnosis", "display": "The diagnosis"}}, {"valueCoding": {"code": "medication"}}]},
+			{"linkId": "pharmacist", "answer": [{"valueBoolean": true}]}
+		]
+	}`, string(data))
+
+	var read QuestionnaireResponse
+	require.NoError(t, json.Unmarshal(data, &read))
+	id, version, err := read.SurveyVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "visit", id)
+	assert.Equal(t, 2, version)
+	assert.Equal(t, &Reference{ResourceID: "a1", ResourceType: "Appointment"}, read.Appointment())
+	readFeedback, err := read.Feedback(survey)
+	require.NoError(t, err)
+	// the feedback keeps the id, and was created when the response was authored; the store sets when it was updated
+	feedback.CreatedAt, feedback.UpdatedAt = &authored, nil
+	assert.Equal(t, feedback, readFeedback)
+
+	read.Extensions[2].ValueCode = strPtr("fax")
+	_, err = read.Feedback(survey)
+	assert.EqualError(t, err, `channel "fax" is not a feedback channel`)
+	read.Extensions[2].ValueCode = strPtr("web")
+
+	// answers are checked against the survey
+	read.Items = read.Items[2:]
+	_, err = read.Feedback(survey)
+	assert.EqualError(t, err, "question recommend is not answered")
+}
+
+func intPtr(n int) *int       { return &n }
+func boolPtr(b bool) *bool    { return &b }
+func strPtr(s string) *string { return &s }
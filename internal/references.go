@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// references.go contains the validation of references between resources during ingestion
+
+// ReferenceMode selects how Ingest validates the references of a resource to other resources.
+//
+// A reference resolves if the resource it refers to appears earlier in the same ingestion, or has already been
+// written, which can only be checked if the writer implements ResourceLookup. A reference is invalid if it does
+// not resolve, is missing, or refers to a resource of the wrong type, such as an appointment actor referring to
+// a Patient.
+type ReferenceMode string
+
+const (
+	// ReferencesUnchecked writes resources without validating their references.
+	ReferencesUnchecked ReferenceMode = ""
+	// ReferencesLenient writes resources with invalid references, adding a warning to their report entry.
+	ReferencesLenient ReferenceMode = "lenient"
+	// ReferencesStrict fails resources with invalid references without writing them.
+	ReferencesStrict ReferenceMode = "strict"
+)
+
+// resourceKey identifies a resource across types.
+type resourceKey struct {
+	ResourceType string
+	ID           string
+}
+
+// ReferenceField is a reference of a resource along with the type of resource it must refer to.
+type ReferenceField struct {
+	Name         string
+	Reference    Reference
+	ExpectedType string
+}
+
+// referenceFields returns the references of r to other resources, see ResourceType.References.
+func referenceFields(r Resource) []ReferenceField {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.References == nil {
+		return nil
+	}
+	return rt.References(r)
+}
+
+// mapReferences returns r with fn applied to each of its references to other resources, see
+// ResourceType.MapReferences. Stops at the first error returned by fn.
+func mapReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.MapReferences == nil {
+		return r, nil
+	}
+	return rt.MapReferences(r, fn)
+}
+
+func appointmentReferences(r Resource) []ReferenceField {
+	appointment := r.(Appointment)
+	return []ReferenceField{
+		{Name: "subject", Reference: appointment.Subject, ExpectedType: "Patient"},
+		{Name: "actor", Reference: appointment.Actor, ExpectedType: "Doctor"},
+	}
+}
+
+func mapAppointmentReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	a := r.(Appointment)
+	if err := fn(&a.Subject); err != nil {
+		return nil, errors.Wrap(err, "problem resolving subject")
+	}
+	if err := fn(&a.Actor); err != nil {
+		return nil, errors.Wrap(err, "problem resolving actor")
+	}
+	if a.Location != nil {
+		location := *a.Location
+		if err := fn(&location); err != nil {
+			return nil, errors.Wrap(err, "problem resolving location")
+		}
+		a.Location = &location
+	}
+	if len(a.Participants) > 0 {
+		participants := make([]Participant, len(a.Participants))
+		copy(participants, a.Participants)
+		for i := range participants {
+			if err := fn(&participants[i].Actor); err != nil {
+				return nil, errors.Wrapf(err, "problem resolving participant %d", i)
+			}
+		}
+		a.Participants = participants
+	}
+	if a.Feedback != nil {
+		feedback := *a.Feedback
+		if err := fn(&feedback); err != nil {
+			return nil, errors.Wrap(err, "problem resolving feedback")
+		}
+		a.Feedback = &feedback
+	}
+	return a, nil
+}
+
+func diagnosisReferences(r Resource) []ReferenceField {
+	d := r.(Diagnosis)
+	// the appointment of a diagnosis read from a Condition is derived from its encounter
+	if d.Encounter != nil && d.Appointment == (Reference{}) {
+		return []ReferenceField{
+			{Name: "encounter", Reference: *d.Encounter, ExpectedType: "Encounter"},
+		}
+	}
+	return []ReferenceField{
+		{Name: "appointment", Reference: d.Appointment, ExpectedType: "Appointment"},
+	}
+}
+
+func mapDiagnosisReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	d := r.(Diagnosis)
+	if err := fn(&d.Appointment); err != nil {
+		return nil, errors.Wrap(err, "problem resolving appointment")
+	}
+	if d.Encounter != nil {
+		encounter := *d.Encounter
+		if err := fn(&encounter); err != nil {
+			return nil, errors.Wrap(err, "problem resolving encounter")
+		}
+		d.Encounter = &encounter
+	}
+	return d, nil
+}
+
+func encounterReferences(r Resource) []ReferenceField {
+	// an encounter need not be for an appointment, and its conditions usually follow it
+	if appointment := r.(Encounter).Appointment(); appointment != nil {
+		return []ReferenceField{
+			{Name: "appointment", Reference: *appointment, ExpectedType: "Appointment"},
+		}
+	}
+	return nil
+}
+
+func mapEncounterReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	e := r.(Encounter)
+	if err := fn(&e.Subject); err != nil {
+		return nil, errors.Wrap(err, "problem resolving subject")
+	}
+	for _, refs := range []struct {
+		name string
+		refs *[]Reference
+	}{
+		{"appointment", &e.Appointments},
+		{"basedOn", &e.BasedOn},
+	} {
+		if len(*refs.refs) == 0 {
+			continue
+		}
+		mapped := make([]Reference, len(*refs.refs))
+		copy(mapped, *refs.refs)
+		for i := range mapped {
+			if err := fn(&mapped[i]); err != nil {
+				return nil, errors.Wrapf(err, "problem resolving %s %d", refs.name, i)
+			}
+		}
+		*refs.refs = mapped
+	}
+	if len(e.Diagnoses) > 0 {
+		diagnoses := make([]EncounterDiagnosis, len(e.Diagnoses))
+		copy(diagnoses, e.Diagnoses)
+		for i := range diagnoses {
+			if err := fn(&diagnoses[i].Condition); err != nil {
+				return nil, errors.Wrapf(err, "problem resolving diagnosis %d", i)
+			}
+		}
+		e.Diagnoses = diagnoses
+	}
+	return e, nil
+}
+
+func practitionerRoleReferences(r Resource) []ReferenceField {
+	return []ReferenceField{
+		{Name: "practitioner", Reference: r.(PractitionerRole).Practitioner, ExpectedType: "Doctor"},
+	}
+}
+
+func mapPractitionerRoleReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	role := r.(PractitionerRole)
+	if err := fn(&role.Practitioner); err != nil {
+		return nil, errors.Wrap(err, "problem resolving practitioner")
+	}
+	return role, nil
+}
+
+func questionnaireResponseReferences(r Resource) []ReferenceField {
+	// the patient and practitioner of a response are those of its appointment
+	if appointment := r.(QuestionnaireResponse).Appointment(); appointment != nil {
+		return []ReferenceField{
+			{Name: "basedOn", Reference: *appointment, ExpectedType: "Appointment"},
+		}
+	}
+	return nil
+}
+
+func mapQuestionnaireResponseReferences(r Resource, fn func(*Reference) error) (Resource, error) {
+	qr := r.(QuestionnaireResponse)
+	if len(qr.BasedOn) > 0 {
+		basedOn := make([]Reference, len(qr.BasedOn))
+		copy(basedOn, qr.BasedOn)
+		for i := range basedOn {
+			if err := fn(&basedOn[i]); err != nil {
+				return nil, errors.Wrapf(err, "problem resolving basedOn %d", i)
+			}
+		}
+		qr.BasedOn = basedOn
+	}
+	if qr.Subject != nil {
+		subject := *qr.Subject
+		if err := fn(&subject); err != nil {
+			return nil, errors.Wrap(err, "problem resolving subject")
+		}
+		qr.Subject = &subject
+	}
+	if qr.Source != nil {
+		source := *qr.Source
+		if err := fn(&source); err != nil {
+			return nil, errors.Wrap(err, "problem resolving source")
+		}
+		qr.Source = &source
+	}
+	if len(qr.Extensions) > 0 {
+		extensions := make([]Extension, len(qr.Extensions))
+		copy(extensions, qr.Extensions)
+		for i := range extensions {
+			if extensions[i].ValueReference == nil {
+				continue
+			}
+			ref := *extensions[i].ValueReference
+			if err := fn(&ref); err != nil {
+				return nil, errors.Wrapf(err, "problem resolving extension %s", extensions[i].URL)
+			}
+			extensions[i].ValueReference = &ref
+		}
+		qr.Extensions = extensions
+	}
+	return qr, nil
+}
+
+// checkReferences validates the references of r according to the ReferenceMode. Returns the problems found as
+// warnings in lenient mode, or as an error in strict mode. Also returns an error if a reference could not be
+// looked up with w.
+func (in *ingester) checkReferences(r Resource, w ResourceWriter) ([]string, error) {
+	if in.opts.References == ReferencesUnchecked {
+		return nil, nil
+	}
+
+	var problems []string
+	for _, field := range referenceFields(r) {
+		problem, err := in.checkReference(field, w)
+		if err != nil {
+			return nil, err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) > 0 && in.opts.References == ReferencesStrict {
+		return nil, errors.Errorf("invalid references: %s", strings.Join(problems, "; "))
+	}
+	return problems, nil
+}
+
+// checkReference returns the problem with the reference, if any.
+func (in *ingester) checkReference(field ReferenceField, w ResourceWriter) (string, error) {
+	ref := field.Reference
+	if ref.ResourceID == "" {
+		return fmt.Sprintf("%s is missing", field.Name), nil
+	}
+	if ref.ResourceType != field.ExpectedType {
+		return fmt.Sprintf("%s refers to %s/%s, expected a %s", field.Name, ref.ResourceType, ref.ResourceID, field.ExpectedType), nil
+	}
+
+	in.mu.Lock()
+	ingested := in.ingested[resourceKey{ref.ResourceType, ref.ResourceID}]
+	in.mu.Unlock()
+	if ingested {
+		return "", nil
+	}
+	if lookup, ok := w.(ResourceLookup); ok {
+		exists, err := lookup.HasResource(ref.ResourceType, ref.ResourceID)
+		if err != nil {
+			return "", errors.Wrapf(err, "problem resolving %s %s/%s", field.Name, ref.ResourceType, ref.ResourceID)
+		}
+		if exists {
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("%s refers to %s/%s, which does not exist", field.Name, ref.ResourceType, ref.ResourceID), nil
+}
+
+// markIngested records that r has been written, so that later resources referring to it resolve. Caller must
+// hold in.mu.
+func (in *ingester) markIngested(r Resource) {
+	if in.opts.References == ReferencesUnchecked {
+		return
+	}
+	if in.ingested == nil {
+		in.ingested = map[resourceKey]bool{}
+	}
+	in.ingested[resourceKey{r.Type(), r.ID()}] = true
+}
+
+// unmarkIngested forgets r, written in a transaction that was rolled back. Caller must hold in.mu.
+func (in *ingester) unmarkIngested(r Resource) {
+	delete(in.ingested, resourceKey{r.Type(), r.ID()})
+}
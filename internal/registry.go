@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// registry.go contains the registry of the resource types that are ingested
+
+// ResourceType is a type of resource that ingestion reads and writes. The types of this package are registered
+// already; others, such as an Organization or a custom extension resource, are added with RegisterResourceType.
+type ResourceType struct {
+	// Name is the resourceType of the JSON resources read as this type.
+	Name string
+	// New returns a pointer to an empty resource, into which a JSON resource of the type is unmarshalled. The
+	// resource is validated and written under its Type, which may differ from Name, as a Practitioner is read
+	// as a Doctor.
+	New func() Resource
+	// Validate, if set, checks a resource of the type before its references are checked and it is written. A
+	// resource that is not valid fails.
+	Validate func(Resource) error
+	// Write writes a resource of the type with w. Types not known to ResourceWriter usually assert w to an
+	// interface of their own, implemented by the store and by the writer of its transactions. It is not set for a
+	// type with ReadAs.
+	Write func(r Resource, w ResourceWriter) error
+	// Tracked is whether stores implementing ResourceLookup know the type, so that its resources are reported
+	// as created or updated. Resources of other types are always reported as created.
+	Tracked bool
+	// ReadAs, if set, is the Name of the type the resources are read as, such as Doctor for Practitioner. They are
+	// then validated and written with the hooks of that type, so the type has no hooks of its own.
+	ReadAs string
+	// WithID, if set, returns a resource of the type with its id set, to assign ids to bundle entries without one
+	// and to write resources matched by identifier under the id they were matched to. Resources of a type without
+	// it keep their id.
+	WithID func(r Resource, id string) Resource
+	// Identifiers, if set, returns the identifiers of a resource of the type, by which resources arriving from
+	// other sources under other ids are matched to it, see identifiers.go.
+	Identifiers func(Resource) []Identifier
+	// References, if set, returns the references of a resource of the type that are validated, see ReferenceMode.
+	References func(Resource) []ReferenceField
+	// MapReferences, if set, returns a resource of the type with fn applied to each of its references, to resolve
+	// them to the ids of the resources they refer to. Stops at the first error returned by fn.
+	MapReferences func(r Resource, fn func(*Reference) error) (Resource, error)
+	// Tier orders the type by the references between types, from 0 to 4: a resource may refer to resources of a
+	// lower tier, which are written first when writing with several workers, see IngestWithReport.
+	Tier int
+}
+
+// registry holds the registered resource types by name.
+var registry = struct {
+	sync.RWMutex
+	types map[string]ResourceType
+}{
+	types: map[string]ResourceType{
+		"Bundle": {
+			Name: "Bundle",
+			New:  func() Resource { return &Bundle{} },
+			WithID: func(r Resource, id string) Resource {
+				b := r.(Bundle)
+				b.ResourceID = id
+				return b
+			},
+		},
+		"Patient": {
+			Name:    "Patient",
+			New:     func() Resource { return &Patient{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WritePatient(r.(Patient)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				p := r.(Patient)
+				p.ResourceID = id
+				return p
+			},
+			Identifiers: func(r Resource) []Identifier { return r.(Patient).Identifiers },
+		},
+		"Doctor": {
+			Name:    "Doctor",
+			New:     func() Resource { return &Doctor{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WriteDoctor(r.(Doctor)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				d := r.(Doctor)
+				d.ResourceID = id
+				return d
+			},
+			Identifiers: func(r Resource) []Identifier { return r.(Doctor).Identifiers },
+		},
+		"Practitioner": {
+			Name:   "Practitioner",
+			New:    func() Resource { return &Doctor{} },
+			ReadAs: "Doctor",
+		},
+		"PractitionerRole": {
+			Name:    "PractitionerRole",
+			New:     func() Resource { return &PractitionerRole{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WritePractitionerRole(r.(PractitionerRole)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				role := r.(PractitionerRole)
+				role.ResourceID = id
+				return role
+			},
+			References:    practitionerRoleReferences,
+			MapReferences: mapPractitionerRoleReferences,
+			Tier:          1,
+		},
+		"Appointment": {
+			Name:    "Appointment",
+			New:     func() Resource { return &Appointment{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WriteAppointment(r.(Appointment)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				a := r.(Appointment)
+				a.ResourceID = id
+				return a
+			},
+			References:    appointmentReferences,
+			MapReferences: mapAppointmentReferences,
+			Tier:          1,
+		},
+		"Diagnosis": {
+			Name:    "Diagnosis",
+			New:     func() Resource { return &Diagnosis{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WriteDiagnosis(r.(Diagnosis)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				d := r.(Diagnosis)
+				d.ResourceID = id
+				return d
+			},
+			References:    diagnosisReferences,
+			MapReferences: mapDiagnosisReferences,
+			Tier:          3,
+		},
+		"Condition": {
+			Name:   "Condition",
+			New:    func() Resource { return &Diagnosis{} },
+			ReadAs: "Diagnosis",
+		},
+		"Encounter": {
+			Name:    "Encounter",
+			New:     func() Resource { return &Encounter{} },
+			Write:   func(r Resource, w ResourceWriter) error { return w.WriteEncounter(r.(Encounter)) },
+			Tracked: true,
+			WithID: func(r Resource, id string) Resource {
+				e := r.(Encounter)
+				e.ResourceID = id
+				return e
+			},
+			References:    encounterReferences,
+			MapReferences: mapEncounterReferences,
+			Tier:          2,
+		},
+		"Questionnaire": {
+			Name: "Questionnaire",
+			New:  func() Resource { return &Questionnaire{} },
+			Validate: func(r Resource) error {
+				_, err := r.(Questionnaire).Survey()
+				return err
+			},
+			Write: writeQuestionnaire,
+			WithID: func(r Resource, id string) Resource {
+				q := r.(Questionnaire)
+				q.ResourceID = id
+				return q
+			},
+		},
+		"QuestionnaireResponse": {
+			Name:     "QuestionnaireResponse",
+			New:      func() Resource { return &QuestionnaireResponse{} },
+			Validate: validateQuestionnaireResponse,
+			Write:    writeQuestionnaireResponse,
+			WithID: func(r Resource, id string) Resource {
+				qr := r.(QuestionnaireResponse)
+				qr.ResourceID = id
+				return qr
+			},
+			References:    questionnaireResponseReferences,
+			MapReferences: mapQuestionnaireResponseReferences,
+			Tier:          4,
+		},
+	},
+}
+
+// RegisterResourceType registers rt, replacing the type registered under the same name, if any. Types are
+// usually registered from an init function, before anything is ingested.
+//
+// Returns an error if rt has no Name or New, has no Write unless it has ReadAs, has Write as well as ReadAs, or its
+// Tier is out of range.
+func RegisterResourceType(rt ResourceType) error {
+	if rt.Name == "" || rt.New == nil {
+		return errors.Errorf("resource type %q must have a name and factory", rt.Name)
+	}
+	if (rt.Write == nil) == (rt.ReadAs == "") {
+		return errors.Errorf("resource type %q must have either a writer or the type it is read as", rt.Name)
+	}
+	if rt.Tier < 0 || rt.Tier >= numDependencyTiers {
+		return errors.Errorf("resource type %q must have a tier from 0 to %d", rt.Name, numDependencyTiers-1)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	registry.types[rt.Name] = rt
+	return nil
+}
+
+// LookupResourceType returns the resource type registered under name.
+func LookupResourceType(name string) (ResourceType, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	rt, ok := registry.types[name]
+	return rt, ok
+}
+
+// validateResource checks r with the validator of its type, if any.
+func validateResource(r Resource) error {
+	rt, ok := LookupResourceType(r.Type())
+	if !ok || rt.Validate == nil {
+		return nil
+	}
+	return errors.Wrap(rt.Validate(r), "invalid "+r.Type())
+}
@@ -0,0 +1,40 @@
+package internal
+
+// Outcome of writing a resource during ingestion.
+type Outcome string
+
+const (
+	OutcomeCreated Outcome = "created"
+	OutcomeUpdated Outcome = "updated"
+	OutcomeFailed  Outcome = "failed"
+)
+
+// IngestReport is the outcome of every resource ingestion attempted to write, in input order.
+//
+// Resources written with a ResourceWriter that does not implement ResourceLookup are reported as created.
+type IngestReport struct {
+	Entries []EntryResult `json:"entries"`
+}
+
+// EntryResult is the outcome of writing one resource.
+type EntryResult struct {
+	// Index is the position of the resource in the input, counting the resources inside bundles.
+	Index        int     `json:"index"`
+	ResourceType string  `json:"resourceType"`
+	ID           string  `json:"id"`
+	Outcome      Outcome `json:"outcome"`
+	Error        string  `json:"error,omitempty"`
+	// Warnings are problems that did not prevent writing the resource, such as unresolved references.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Failed returns the entries that failed to be written.
+func (r IngestReport) Failed() []EntryResult {
+	var failed []EntryResult
+	for _, entry := range r.Entries {
+		if entry.Outcome == OutcomeFailed {
+			failed = append(failed, entry)
+		}
+	}
+	return failed
+}
@@ -3,8 +3,10 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -17,14 +19,67 @@ type Resource interface {
 type (
 	Bundle struct {
 		ResourceTypeAndID
-		Resources BundledResources `json:"entry"`
+		BundleType string           `json:"type"`
+		Resources  BundledResources `json:"entry"`
 	}
 	BundledResources []Resource
 
 	Patient struct {
 		ResourceTypeAndID
-		Name []Name `json:"name"` // just take first
-		// TODO all patient fields
+		Identifiers []Identifier     `json:"identifier,omitempty"`
+		Active      *bool            `json:"active,omitempty"`
+		Name        []Name           `json:"name"` // just take first
+		Telecom     []ContactPoint   `json:"telecom,omitempty"`
+		Gender      string           `json:"gender,omitempty"`    // male, female, other or unknown
+		BirthDate   string           `json:"birthDate,omitempty"` // YYYY, YYYY-MM or YYYY-MM-DD
+		Address     []Address        `json:"address,omitempty"`
+		Contacts    []PatientContact `json:"contact,omitempty"`
+	}
+
+	// ContactPoint is a way to reach a person, such as a phone number or an email address.
+	ContactPoint struct {
+		System string `json:"system,omitempty"` // phone, fax, email, pager, url, sms or other
+		Value  string `json:"value,omitempty"`
+		Use    string `json:"use,omitempty"` // home, work, temp, old or mobile
+		Rank   int    `json:"rank,omitempty"`
+	}
+
+	Address struct {
+		Use        string   `json:"use,omitempty"` // home, work, temp, old or billing
+		Text       string   `json:"text,omitempty"`
+		Line       []string `json:"line,omitempty"`
+		City       string   `json:"city,omitempty"`
+		State      string   `json:"state,omitempty"`
+		PostalCode string   `json:"postalCode,omitempty"`
+		Country    string   `json:"country,omitempty"`
+	}
+
+	// PatientContact is a person to contact about the patient, such as a relative or guardian.
+	PatientContact struct {
+		Relationship []CodeableConcept `json:"relationship,omitempty"`
+		Name         *Name             `json:"name,omitempty"`
+		Telecom      []ContactPoint    `json:"telecom,omitempty"`
+		Address      *Address          `json:"address,omitempty"`
+		Gender       string            `json:"gender,omitempty"`
+	}
+
+	// CodeableConcept is a concept given by codes from one or more terminologies, and by text.
+	CodeableConcept struct {
+		Coding []Coding `json:"coding,omitempty"`
+		Text   string   `json:"text,omitempty"`
+	}
+
+	Coding struct {
+		System  string `json:"system,omitempty"`
+		Code    string `json:"code,omitempty"`
+		Display string `json:"display,omitempty"`
+	}
+
+	// Identifier identifies a resource in another system, such as a patient by the medical record number of a
+	// hospital. The system is a URI naming the system, the value is unique within it.
+	Identifier struct {
+		System string `json:"system"`
+		Value  string `json:"value"`
 	}
 
 	Name struct {
@@ -33,32 +88,84 @@ type (
 		Given  []string `json:"given"` // just take first
 	}
 
+	// Doctor is read from a Doctor or a FHIR Practitioner resource, see practitioner.go.
 	Doctor struct {
 		ResourceTypeAndID
-		Name []Name `json:"name"` // just take first
+		Identifiers []Identifier `json:"identifier,omitempty"`
+		Name        []Name       `json:"name"` // just take first
+		// Roles are the roles of the doctor, ordered by id. They are written as separate resources referring to
+		// the doctor.
+		Roles []PractitionerRole `json:"-"`
 	}
 
 	Appointment struct {
 		ResourceTypeAndID
-		Status      string     `json:"status"`
-		Description string     `json:"-"` // TODO
-		Subject     Reference  `json:"subject"`
-		Actor       Reference  `json:"actor"`
-		Feedback    *Reference `json:"feedback"`
-		Diagnosis   Diagnosis  `json:"-"`
+		Status          string            `json:"status"`
+		Description     string            `json:"description,omitempty"`
+		AppointmentType []CodeableConcept `json:"type,omitempty"`
+		Period          Period            `json:"period"`
+		Location        *Reference        `json:"location,omitempty"`
+		Subject         Reference         `json:"subject"`
+		Actor           Reference         `json:"actor"`
+		Participants    []Participant     `json:"participant,omitempty"`
+		Feedback        *Reference        `json:"feedback,omitempty"`
+		// Diagnoses are the diagnoses made at the appointment, in rank order, see Diagnosis.Before. They are
+		// written as separate resources referring to the appointment, and marshalled as contained resources that
+		// the reasonReference of the appointment refers to.
+		Diagnoses []Diagnosis `json:"-"`
+	}
+
+	// Period is a span of time, open-ended if either end is unknown.
+	Period struct {
+		Start *time.Time `json:"start,omitempty"`
+		End   *time.Time `json:"end,omitempty"`
+	}
+
+	// Participant is a person or location taking part in an appointment.
+	Participant struct {
+		Type     []CodeableConcept `json:"type,omitempty"`
+		Actor    Reference         `json:"actor"`
+		Required string            `json:"required,omitempty"` // required, optional or information-only
+		Status   string            `json:"status,omitempty"`   // accepted, declined, tentative or needs-action
 	}
 
+	// Diagnosis is read from a Diagnosis or a FHIR Condition resource, see encounter.go.
 	Diagnosis struct {
 		ResourceTypeAndID
-		Status      string    `json:"status"`
-		Name        string    `json:"code"` // TODO
-		Appointment Reference `json:"appointment"`
+		Status      string          `json:"status"`
+		Code        CodeableConcept `json:"code"`
+		Appointment Reference       `json:"appointment"`
+		// Encounter is the encounter a diagnosis read from a Condition was made in, if any. The appointment and
+		// rank of such a diagnosis are derived from its encounter, see Encounter.Link.
+		Encounter *Reference `json:"encounter,omitempty"`
+		// Rank orders the diagnoses of an appointment: 1 for the primary diagnosis, 2 and up for secondary ones,
+		// 0 if unranked.
+		Rank int `json:"rank,omitempty"`
 	}
 
+	// Feedback is a patient's answers to a survey about an appointment, see survey.go. The stores assign its id
+	// when the feedback for an appointment is first saved, unless it has one, keeping it when the feedback is
+	// replaced, and set its appointment and times whenever it is saved; a CreatedAt given when it is first saved
+	// is kept.
 	Feedback struct {
-		Recommend int     `json:"recommend"`
-		Explained *bool   `json:"explained"`
-		Feeling   *string `json:"feeling"`
+		ResourceTypeAndID
+		Appointment Reference `json:"appointment"`
+		// Author is the patient who submitted the feedback, if known.
+		Author *Reference `json:"author,omitempty"`
+		// Channel is how the feedback was submitted, if known.
+		Channel FeedbackChannel `json:"channel,omitempty"`
+		// CreatedAt is when the feedback was first submitted, and UpdatedAt when it was last replaced. Feedback
+		// saved before the times were kept has neither.
+		CreatedAt *time.Time `json:"createdAt,omitempty"`
+		UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+		// Survey and SurveyVersion identify the version of the survey answered.
+		Survey        string `json:"survey"`
+		SurveyVersion int    `json:"surveyVersion,omitempty"`
+		// Answers are the answers to the questions of the survey by question id. Optional questions left
+		// unanswered have no answer.
+		Answers map[string]Answer `json:"answers"`
+		// Diagnosis is the diagnosis of the appointment the feedback is about, if any.
+		Diagnosis *Reference `json:"diagnosis,omitempty"`
 	}
 
 	ResourceTypeAndID struct {
@@ -66,7 +173,57 @@ type (
 		ResourceType string `json:"resourceType"`
 	}
 
-	Reference ResourceTypeAndID
+	// Reference refers to another resource by type and id. A reference decoded from a URL, such as the
+	// urn:uuid fullUrl of another entry in the same bundle, keeps the URL until it is resolved, see bundle.go.
+	// A conditional reference, such as "Patient?identifier=mrn|12345", has an Identifier instead of an id until
+	// it is resolved, see identifiers.go.
+	Reference struct {
+		ResourceID   string      `json:"id"`
+		ResourceType string      `json:"resourceType"`
+		URL          string      `json:"-"`
+		Identifier   *Identifier `json:"-"`
+	}
+)
+
+// canonicalType returns the resource type resourceType is mapped onto, such as Doctor for Practitioner, see
+// ResourceType.ReadAs.
+func canonicalType(resourceType string) string {
+	if rt, ok := LookupResourceType(resourceType); ok && rt.ReadAs != "" {
+		return rt.ReadAs
+	}
+	return resourceType
+}
+
+// FeedbackChannel is the way feedback was submitted.
+type FeedbackChannel string
+
+const (
+	FeedbackChannelCLI FeedbackChannel = "cli"
+	FeedbackChannelAPI FeedbackChannel = "api"
+	FeedbackChannelSMS FeedbackChannel = "sms"
+	FeedbackChannelWeb FeedbackChannel = "web"
+)
+
+// Valid returns whether c is one of the known channels.
+func (c FeedbackChannel) Valid() bool {
+	switch c {
+	case FeedbackChannelCLI, FeedbackChannelAPI, FeedbackChannelSMS, FeedbackChannelWeb:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrFeedbackIDTaken is the cause of the error saving feedback with an id of its own, for an appointment without
+// feedback, when the feedback about another appointment has that id.
+var ErrFeedbackIDTaken = errors.New("feedback id is taken by the feedback about another appointment")
+
+// Bundle types determining how the resources of a Bundle are written.
+const (
+	BundleTypeTransaction = "transaction"
+	BundleTypeBatch       = "batch"
+	// BundleTypeCollection is a bundle of resources exported together.
+	BundleTypeCollection = "collection"
 )
 
 func (r ResourceTypeAndID) Type() string {
@@ -77,57 +234,408 @@ func (r ResourceTypeAndID) ID() string {
 	return r.ResourceID
 }
 
+// MarshalJSON marshals the bundle, defaulting its resourceType to Bundle.
+func (b Bundle) MarshalJSON() ([]byte, error) {
+	type alias Bundle
+	bundle := alias(b)
+	bundle.ResourceType = typeOrDefault(b.ResourceType, "Bundle")
+	return json.Marshal(bundle)
+}
+
+// MarshalJSON marshals the resources as bundle entries, in the format read by UnmarshalJSON.
+func (bundled BundledResources) MarshalJSON() ([]byte, error) {
+	entries := make([]bundleEntry, len(bundled))
+	for i, resource := range bundled {
+		data, err := json.Marshal(resource)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem marshalling bundled resource at entry "+strconv.Itoa(i))
+		}
+		entries[i].Resource = data
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON unmarshals the resources of the bundle entries, assigning ids to the resources without one and
+// resolving the references between entries.
 func (bundled *BundledResources) UnmarshalJSON(data []byte) error {
-	var entries []map[string]json.RawMessage
+	var entries []bundleEntry
 	if err := json.Unmarshal(data, &entries); err != nil {
 		return errors.Wrap(err, "problem unmarshalling list of json objects")
 	}
 
+	var resolver bundleResolver
 	resources := make([]Resource, len(entries))
 	for i, entry := range entries {
-		resource, err := unmarshalResource(json.NewDecoder(bytes.NewReader(entry["resource"])))
+		resource, err := unmarshalResource(json.NewDecoder(bytes.NewReader(entry.Resource)))
 		if err != nil {
 			return errors.Wrap(err, "problem unmarshalling bundled resource at entry "+strconv.Itoa(i))
 		}
+		resources[i] = resolver.add(entry.FullURL, resource)
+	}
+	// resolve once every entry has been added, as an entry may refer to a later one
+	for i, resource := range resources {
+		resource, err := resolver.resolve(resource)
+		if err != nil {
+			return errors.Wrap(err, "problem resolving references of bundled resource at entry "+strconv.Itoa(i))
+		}
 		resources[i] = resource
 	}
 	*bundled = resources
 	return nil
 }
 
-// UnmarshalJSON unmarshals the code from the json data and sets that as the name.
-func (n *Diagnosis) UnmarshalJSON(data []byte) error {
-	var m map[string]interface{}
-	if err := json.Unmarshal(data, &m); err != nil {
+// UnmarshalJSON unmarshals the patient, taking entries of contact that are contact points, as some sources send
+// instead of telecom, as telecom.
+func (p *Patient) UnmarshalJSON(data []byte) error {
+	type alias Patient
+	var patient struct {
+		alias
+		Contacts []json.RawMessage `json:"contact"`
+	}
+	if err := json.Unmarshal(data, &patient); err != nil {
 		return err
 	}
+	*p = Patient(patient.alias)
+	p.Contacts = nil
 
-	// set name to first coding found in diagnosis
-	for _, coding := range m["code"].(map[string]interface{})["coding"].([]interface{}) {
-		n.Name = coding.(map[string]interface{})["name"].(string)
-		break
+	for i, data := range patient.Contacts {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return errors.Wrapf(err, "problem unmarshalling contact %d", i)
+		}
+		if _, ok := fields["system"]; ok {
+			var telecom ContactPoint
+			if err := json.Unmarshal(data, &telecom); err != nil {
+				return errors.Wrapf(err, "problem unmarshalling contact %d", i)
+			}
+			p.Telecom = append(p.Telecom, telecom)
+			continue
+		}
+		var contact PatientContact
+		if err := json.Unmarshal(data, &contact); err != nil {
+			return errors.Wrapf(err, "problem unmarshalling contact %d", i)
+		}
+		p.Contacts = append(p.Contacts, contact)
 	}
+	return nil
+}
 
-	delete(m, "code")
+// appointmentReason is an entry of the reasonReference of an Appointment. A reference to a contained resource is
+// its id prefixed with "#".
+type appointmentReason struct {
+	Reference string `json:"reference"`
+}
 
-	data, _ = json.Marshal(m)
+// MarshalJSON marshals the appointment in the format read by UnmarshalJSON, defaulting its resourceType to
+// Appointment and leaving out the period and references it does not have. Its diagnoses are contained resources,
+// in rank order, that its reasonReference refers to.
+func (a Appointment) MarshalJSON() ([]byte, error) {
+	type alias Appointment
+	appointment := struct {
+		alias
+		Period          *Period             `json:"period,omitempty"`
+		Subject         *Reference          `json:"subject,omitempty"`
+		Actor           *Reference          `json:"actor,omitempty"`
+		Contained       []Diagnosis         `json:"contained,omitempty"`
+		ReasonReference []appointmentReason `json:"reasonReference,omitempty"`
+	}{
+		alias:     alias(a),
+		Subject:   optionalReference(a.Subject),
+		Actor:     optionalReference(a.Actor),
+		Contained: a.Diagnoses,
+	}
+	appointment.ResourceType = typeOrDefault(a.ResourceType, "Appointment")
+	if a.Period != (Period{}) {
+		appointment.Period = &a.Period
+	}
+	for _, diagnosis := range a.Diagnoses {
+		appointment.ReasonReference = append(appointment.ReasonReference, appointmentReason{Reference: "#" + diagnosis.ID()})
+	}
+	return json.Marshal(appointment)
+}
 
-	type alias Diagnosis
-	if err := json.Unmarshal(data, (*alias)(n)); err != nil {
+// UnmarshalJSON unmarshals the appointment, taking the contained diagnoses its reasonReference refers to, in that
+// order, as its diagnoses. Other reasons are not kept.
+func (a *Appointment) UnmarshalJSON(data []byte) error {
+	type alias Appointment
+	var appointment struct {
+		alias
+		Contained       []json.RawMessage   `json:"contained"`
+		ReasonReference []appointmentReason `json:"reasonReference"`
+	}
+	if err := json.Unmarshal(data, &appointment); err != nil {
 		return err
 	}
+	*a = Appointment(appointment.alias)
+
+	contained := map[string]json.RawMessage{}
+	for i, data := range appointment.Contained {
+		var resource ResourceTypeAndID
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return errors.Wrapf(err, "problem unmarshalling contained resource %d", i)
+		}
+		if canonicalType(resource.ResourceType) == "Diagnosis" {
+			contained[resource.ResourceID] = data
+		}
+	}
+	for _, reason := range appointment.ReasonReference {
+		data, ok := contained[strings.TrimPrefix(reason.Reference, "#")]
+		if !ok || !strings.HasPrefix(reason.Reference, "#") {
+			continue
+		}
+		var diagnosis Diagnosis
+		if err := json.Unmarshal(data, &diagnosis); err != nil {
+			return errors.Wrapf(err, "problem unmarshalling diagnosis %s", reason.Reference)
+		}
+		a.Diagnoses = append(a.Diagnoses, diagnosis)
+	}
+	return nil
+}
+
+// MarshalJSON marshals the diagnosis in the format read by UnmarshalJSON, defaulting its resourceType to
+// Diagnosis and leaving out the appointment if it does not have one.
+func (d Diagnosis) MarshalJSON() ([]byte, error) {
+	type alias Diagnosis
+	diagnosis := struct {
+		alias
+		Appointment *Reference `json:"appointment,omitempty"`
+	}{
+		alias:       alias(d),
+		Appointment: optionalReference(d.Appointment),
+	}
+	diagnosis.ResourceType = typeOrDefault(d.ResourceType, "Diagnosis")
+	return json.Marshal(diagnosis)
+}
+
+// typeOrDefault returns resourceType, or def if it is empty.
+func typeOrDefault(resourceType, def string) string {
+	if resourceType == "" {
+		return def
+	}
+	return resourceType
+}
+
+// optionalReference returns a pointer to ref, or nil if it is the zero Reference, to leave out with omitempty.
+func optionalReference(ref Reference) *Reference {
+	if ref == (Reference{}) {
+		return nil
+	}
+	return &ref
+}
+
+// PrimaryDiagnosis returns the diagnosis of the appointment ranked 1, or its only diagnosis. Returns nil if the
+// appointment has no diagnosis, or several of which none is ranked primary.
+func (a Appointment) PrimaryDiagnosis() *Diagnosis {
+	for i := range a.Diagnoses {
+		if a.Diagnoses[i].Rank == 1 {
+			return &a.Diagnoses[i]
+		}
+	}
+	if len(a.Diagnoses) == 1 {
+		return &a.Diagnoses[0]
+	}
+	return nil
+}
+
+// FindDiagnosis returns the diagnosis of the appointment with the id, or nil if it has none.
+func (a Appointment) FindDiagnosis(id string) *Diagnosis {
+	for i := range a.Diagnoses {
+		if a.Diagnoses[i].ID() == id {
+			return &a.Diagnoses[i]
+		}
+	}
+	return nil
+}
+
+// Before returns whether the diagnosis ranks before other, ordering the diagnoses of an appointment. Unranked
+// diagnoses come last, and diagnoses of the same rank are ordered by id.
+func (d Diagnosis) Before(other Diagnosis) bool {
+	switch {
+	case d.Rank == other.Rank:
+		return d.ID() < other.ID()
+	case d.Rank == 0:
+		return false
+	case other.Rank == 0:
+		return true
+	default:
+		return d.Rank < other.Rank
+	}
+}
+
+// Name returns the name of the diagnosis, see CodeableConcept.Name.
+func (d Diagnosis) Name() string {
+	return d.Code.Name()
+}
+
+// Code systems of diagnoses.
+const (
+	CodeSystemICD10  = "http://hl7.org/fhir/sid/icd-10"
+	CodeSystemSNOMED = "http://snomed.info/sct"
+)
+
+// Name returns the text of the concept, or else the display, or code, of its first coding that has one.
+func (c CodeableConcept) Name() string {
+	if c.Text != "" {
+		return c.Text
+	}
+	for _, coding := range c.Coding {
+		if coding.Display != "" {
+			return coding.Display
+		}
+	}
+	for _, coding := range c.Coding {
+		if coding.Code != "" {
+			return coding.Code
+		}
+	}
+	return ""
+}
+
+// HasCoding returns whether the concept has a coding with the code in the system.
+func (c CodeableConcept) HasCoding(system, code string) bool {
+	for _, coding := range c.Coding {
+		if coding.System == system && coding.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON unmarshals the concept, tolerating shapes seen from sources that do not follow FHIR exactly: a
+// string is taken as the text of the concept, and a single coding object as a list of one coding.
+func (c *CodeableConcept) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = CodeableConcept{Text: text}
+		return nil
+	}
+
+	var concept struct {
+		Coding json.RawMessage `json:"coding"`
+		Text   string          `json:"text"`
+	}
+	if err := json.Unmarshal(data, &concept); err != nil {
+		return errors.Wrap(err, "problem unmarshalling CodeableConcept")
+	}
+	*c = CodeableConcept{Text: concept.Text}
+	if len(concept.Coding) == 0 || string(concept.Coding) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(concept.Coding, &c.Coding); err != nil {
+		var coding Coding
+		if err := json.Unmarshal(concept.Coding, &coding); err != nil {
+			return errors.Wrap(err, "problem unmarshalling coding of CodeableConcept")
+		}
+		c.Coding = []Coding{coding}
+	}
+	return nil
+}
 
+// UnmarshalJSON unmarshals the coding, taking name as the display if there is no display.
+func (c *Coding) UnmarshalJSON(data []byte) error {
+	type alias Coding
+	var coding struct {
+		alias
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &coding); err != nil {
+		return err
+	}
+	*c = Coding(coding.alias)
+	if c.Display == "" {
+		c.Display = coding.Name
+	}
 	return nil
 }
 
+// MarshalJSON marshals the reference in the format read by UnmarshalJSON: a literal reference
+// "{ResourceType}/{ResourceID}" if the id is known, else the URL or identifier it is to be resolved from.
+func (r Reference) MarshalJSON() ([]byte, error) {
+	switch {
+	case r.ResourceID != "":
+		return json.Marshal(map[string]string{"reference": r.ResourceType + "/" + r.ResourceID})
+	case r.URL != "":
+		return json.Marshal(map[string]string{"reference": r.URL})
+	case r.Identifier != nil:
+		return json.Marshal(map[string]interface{}{"type": r.ResourceType, "identifier": r.Identifier})
+	default:
+		return []byte(`{}`), nil
+	}
+}
+
+// UnmarshalJSON unmarshals the reference, taking the type of a resource mapped onto another type, such as
+// Practitioner, as the type it is mapped onto.
 func (r *Reference) UnmarshalJSON(data []byte) error {
+	if err := r.unmarshalJSON(data); err != nil {
+		return err
+	}
+	r.ResourceType = canonicalType(r.ResourceType)
+	return nil
+}
+
+func (r *Reference) unmarshalJSON(data []byte) error {
+	// an empty object or null is the zero Reference, as marshalled by MarshalJSON
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err == nil && len(fields) == 0 {
+		*r = Reference{}
+		return nil
+	}
+
 	var ref struct {
-		Reference string `json:"reference"`
+		Reference  string      `json:"reference"`
+		Type       string      `json:"type"`
+		Identifier *Identifier `json:"identifier"`
 	}
 	if err := json.Unmarshal(data, &ref); err != nil {
 		return err
 	}
 
+	// a logical reference identifies the resource by an identifier instead of a literal reference
+	if ref.Reference == "" && ref.Identifier != nil {
+		if ref.Type == "" {
+			return errors.Errorf("unknown reference format: identifier %s without a type", ref.Identifier)
+		}
+		*r = Reference{
+			ResourceType: ref.Type,
+			Identifier:   ref.Identifier,
+		}
+		return nil
+	}
+
+	// a urn:uuid or urn:oid reference can only be resolved to the bundle entry with that fullUrl
+	if strings.HasPrefix(ref.Reference, "urn:") {
+		*r = Reference{URL: ref.Reference}
+		return nil
+	}
+	// an absolute URL refers to a bundle entry with that fullUrl, or else to the resource at the end of its path
+	if u, err := url.Parse(ref.Reference); err == nil && u.IsAbs() {
+		resourceType, id, ok := resourceFromPath(u.Path)
+		if !ok {
+			return errors.Errorf(`unknown reference format for value "%s": expected a URL ending in {ResourceType}/{ResourceID}`, ref.Reference)
+		}
+		*r = Reference{
+			ResourceID:   id,
+			ResourceType: resourceType,
+			URL:          ref.Reference,
+		}
+		return nil
+	}
+
+	// a conditional reference, "{ResourceType}?identifier={system}|{value}", refers to the resource with the
+	// identifier
+	if i := strings.Index(ref.Reference, "?"); i >= 0 {
+		query, err := url.ParseQuery(ref.Reference[i+1:])
+		if err != nil || len(query) != 1 || len(query["identifier"]) != 1 || i == 0 {
+			return errors.Errorf(`unknown reference format for value "%s": expected {ResourceType}?identifier={system}|{value}`, ref.Reference)
+		}
+		identifier := ParseIdentifier(query.Get("identifier"))
+		*r = Reference{
+			ResourceType: ref.Reference[:i],
+			Identifier:   &identifier,
+		}
+		return nil
+	}
+
 	// expect reference format of "{ResourceType}/{ResourceID}"
 	parts := strings.SplitN(ref.Reference, "/", 2)
 	if len(parts) != 2 {
@@ -141,3 +649,70 @@ func (r *Reference) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// resourceFromPath returns the type and id of the resource at the end of a URL path such as
+// "/fhir/Patient/123" or "/fhir/Patient/123/_history/2".
+func resourceFromPath(path string) (resourceType, id string, ok bool) {
+	if i := strings.Index(path, "/_history/"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) < 2 || segments[len(segments)-2] == "" || segments[len(segments)-1] == "" {
+		return "", "", false
+	}
+	return segments[len(segments)-2], segments[len(segments)-1], true
+}
+
+// appointment statuses of appointments that did not take place
+var calledOffStatuses = map[string]bool{
+	"proposed":         true,
+	"pending":          true,
+	"booked":           true,
+	"cancelled":        true,
+	"noshow":           true,
+	"entered-in-error": true,
+	"waitlist":         true,
+}
+
+// Ended returns whether the appointment took place and was over by now: its period ended by now and its status
+// is not one of an appointment that did not take place, or, if its end is unknown, its status is finished or
+// fulfilled.
+func (a Appointment) Ended(now time.Time) bool {
+	if a.Period.End != nil {
+		return !a.Period.End.After(now) && !calledOffStatuses[a.Status]
+	}
+	return a.Status == "finished" || a.Status == "fulfilled"
+}
+
+// Before returns whether the appointment starts before other, ordering appointments chronologically. Appointments
+// without a start come last, and appointments starting at the same time are ordered by id.
+func (a Appointment) Before(other Appointment) bool {
+	switch {
+	case a.Period.Start == nil && other.Period.Start == nil:
+	case a.Period.Start == nil:
+		return false
+	case other.Period.Start == nil:
+		return true
+	case !a.Period.Start.Equal(*other.Period.Start):
+		return a.Period.Start.Before(*other.Period.Start)
+	}
+	return a.ID() < other.ID()
+}
+
+// ParseIdentifier parses an identifier in the FHIR token format "{system}|{value}". A token without "|" is a
+// value without a system.
+func ParseIdentifier(token string) Identifier {
+	i := strings.Index(token, "|")
+	if i < 0 {
+		return Identifier{Value: token}
+	}
+	return Identifier{
+		System: token[:i],
+		Value:  token[i+1:],
+	}
+}
+
+// String formats the identifier in the FHIR token format "{system}|{value}", see ParseIdentifier.
+func (i Identifier) String() string {
+	return i.System + "|" + i.Value
+}
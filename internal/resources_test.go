@@ -0,0 +1,273 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+func TestAppointment_Ended(t *testing.T) {
+	now := time.Date(2021, 4, 2, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Minute), now.Add(time.Minute)
+
+	for name, tt := range map[string]struct {
+		Appointment Appointment
+		Expected    bool
+	}{
+		"ended": {
+			Appointment: Appointment{Status: "fulfilled", Period: Period{End: &before}},
+			Expected:    true,
+		},
+		"ends now": {
+			Appointment: Appointment{Status: "arrived", Period: Period{End: &now}},
+			Expected:    true,
+		},
+		"not ended": {
+			Appointment: Appointment{Status: "booked", Period: Period{End: &after}},
+		},
+		"cancelled": {
+			Appointment: Appointment{Status: "cancelled", Period: Period{End: &before}},
+		},
+		"no show": {
+			Appointment: Appointment{Status: "noshow", Period: Period{End: &before}},
+		},
+		"finished without end": {
+			Appointment: Appointment{Status: "finished"},
+			Expected:    true,
+		},
+		"booked without end": {
+			Appointment: Appointment{Status: "booked"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.Expected, tt.Appointment.Ended(now))
+		})
+	}
+}
+
+func TestAppointment_Before(t *testing.T) {
+	early := time.Date(2021, 4, 2, 11, 30, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+	newAppointment := func(id string, start *time.Time) Appointment {
+		return Appointment{
+			ResourceTypeAndID: ResourceTypeAndID{ResourceID: id, ResourceType: "Appointment"},
+			Period:            Period{Start: start},
+		}
+	}
+
+	assert.True(t, newAppointment("b", &early).Before(newAppointment("a", &late)))
+	assert.True(t, newAppointment("a", &early).Before(newAppointment("b", &early)))
+	assert.True(t, newAppointment("b", &late).Before(newAppointment("a", nil)))
+	assert.False(t, newAppointment("a", nil).Before(newAppointment("b", &late)))
+	assert.True(t, newAppointment("a", nil).Before(newAppointment("b", nil)))
+}
+
+func TestAppointment_PrimaryDiagnosis(t *testing.T) {
+	newDiagnosis := func(id string, rank int) Diagnosis {
+		return Diagnosis{
+			ResourceTypeAndID: ResourceTypeAndID{ResourceID: id, ResourceType: "Diagnosis"},
+			Rank:              rank,
+		}
+	}
+
+	assert.Nil(t, Appointment{}.PrimaryDiagnosis())
+	assert.Equal(t, "a", Appointment{Diagnoses: []Diagnosis{newDiagnosis("a", 0)}}.PrimaryDiagnosis().ID())
+	assert.Equal(t, "b", Appointment{Diagnoses: []Diagnosis{newDiagnosis("a", 2), newDiagnosis("b", 1)}}.PrimaryDiagnosis().ID())
+	assert.Nil(t, Appointment{Diagnoses: []Diagnosis{newDiagnosis("a", 0), newDiagnosis("b", 2)}}.PrimaryDiagnosis())
+}
+
+func TestDiagnosis_Before(t *testing.T) {
+	newDiagnosis := func(id string, rank int) Diagnosis {
+		return Diagnosis{
+			ResourceTypeAndID: ResourceTypeAndID{ResourceID: id, ResourceType: "Diagnosis"},
+			Rank:              rank,
+		}
+	}
+
+	assert.True(t, newDiagnosis("b", 1).Before(newDiagnosis("a", 2)))
+	assert.True(t, newDiagnosis("a", 2).Before(newDiagnosis("b", 2)))
+	assert.True(t, newDiagnosis("b", 3).Before(newDiagnosis("a", 0)))
+	assert.False(t, newDiagnosis("a", 0).Before(newDiagnosis("b", 3)))
+	assert.True(t, newDiagnosis("a", 0).Before(newDiagnosis("b", 0)))
+}
+
+func TestDiagnosis_UnmarshalJSON(t *testing.T) {
+	for name, tt := range map[string]struct {
+		InputJSON     string
+		ExpectedCode  CodeableConcept
+		ExpectedName  string
+		ExpectedError bool
+	}{
+		"multiple codings": {
+			InputJSON: `{"code": {"coding": [
+				{"system": "http://hl7.org/fhir/sid/icd-10", "code": "E11.9", "display": "Type 2 diabetes mellitus without complications"},
+				{"system": "http://snomed.info/sct", "code": "44054006"}
+			]}}`,
+			ExpectedCode: CodeableConcept{Coding: []Coding{
+				{System: CodeSystemICD10, Code: "E11.9", Display: "Type 2 diabetes mellitus without complications"},
+				{System: CodeSystemSNOMED, Code: "44054006"},
+			}},
+			ExpectedName: "Type 2 diabetes mellitus without complications",
+		},
+		"text": {
+			InputJSON:    `{"code": {"text": "Diabetes", "coding": [{"system": "http://snomed.info/sct", "code": "73211009", "display": "Diabetes mellitus"}]}}`,
+			ExpectedCode: CodeableConcept{Text: "Diabetes", Coding: []Coding{{System: CodeSystemSNOMED, Code: "73211009", Display: "Diabetes mellitus"}}},
+			ExpectedName: "Diabetes",
+		},
+		"name instead of display": {
+			InputJSON:    `{"code": {"coding": [{"system": "http://hl7.org/fhir/sid/icd-10", "code": "E10-E14.9", "name": "Diabetes without complications"}]}}`,
+			ExpectedCode: CodeableConcept{Coding: []Coding{{System: CodeSystemICD10, Code: "E10-E14.9", Display: "Diabetes without complications"}}},
+			ExpectedName: "Diabetes without complications",
+		},
+		"single coding object": {
+			InputJSON:    `{"code": {"coding": {"system": "http://hl7.org/fhir/sid/icd-10", "code": "E11.9"}}}`,
+			ExpectedCode: CodeableConcept{Coding: []Coding{{System: CodeSystemICD10, Code: "E11.9"}}},
+			ExpectedName: "E11.9",
+		},
+		"code as string": {
+			InputJSON:    `{"code": "Diabetes"}`,
+			ExpectedCode: CodeableConcept{Text: "Diabetes"},
+			ExpectedName: "Diabetes",
+		},
+		"no code": {
+			InputJSON: `{"status": "final"}`,
+		},
+		"no coding": {
+			InputJSON: `{"code": {}}`,
+		},
+		"coding of the wrong type": {
+			InputJSON:     `{"code": {"coding": 12}}`,
+			ExpectedError: true,
+		},
+		"code of the wrong type": {
+			InputJSON:     `{"code": 12}`,
+			ExpectedError: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var diagnosis Diagnosis
+			err := json.Unmarshal([]byte(tt.InputJSON), &diagnosis)
+			if tt.ExpectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ExpectedCode, diagnosis.Code)
+			assert.Equal(t, tt.ExpectedName, diagnosis.Name())
+		})
+	}
+}
+
+func TestReference_MarshalJSON(t *testing.T) {
+	for name, ref := range map[string]Reference{
+		"literal":      {ResourceID: "123", ResourceType: "Patient"},
+		"bundle entry": {URL: "urn:uuid:6739ec3e-93bd-11eb-a8b3-0242ac130003"},
+		"logical":      {ResourceType: "Patient", Identifier: &Identifier{System: "urn:mrn", Value: "12345"}},
+		"empty":        {},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(ref)
+			require.NoError(t, err)
+			var actual Reference
+			require.NoError(t, json.Unmarshal(data, &actual))
+			assert.Equal(t, ref, actual)
+		})
+	}
+}
+
+func TestAppointment_MarshalJSON(t *testing.T) {
+	start := time.Date(2021, 4, 2, 11, 30, 0, 0, time.UTC)
+	end := start.Add(30 * time.Minute)
+	appointment := Appointment{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: "appointment", ResourceType: "Appointment"},
+		Status:            "finished",
+		Description:       "Follow-up",
+		AppointmentType:   []CodeableConcept{{Text: "Endocrinologist visit"}},
+		Period:            Period{Start: &start, End: &end},
+		Location:          &Reference{ResourceID: "clinic", ResourceType: "Location"},
+		Subject:           Reference{ResourceID: "patient", ResourceType: "Patient"},
+		Actor:             Reference{ResourceID: "doctor", ResourceType: "Doctor"},
+		Participants: []Participant{
+			{Actor: Reference{ResourceID: "doctor", ResourceType: "Doctor"}, Required: "required", Status: "accepted"},
+		},
+		Feedback: &Reference{ResourceID: "feedback", ResourceType: "Feedback"},
+		Diagnoses: []Diagnosis{{
+			ResourceTypeAndID: ResourceTypeAndID{ResourceID: "diagnosis", ResourceType: "Diagnosis"},
+			Status:            "final",
+			Code:              CodeableConcept{Coding: []Coding{{System: CodeSystemICD10, Code: "E11.9"}}, Text: "Diabetes"},
+			Appointment:       Reference{ResourceID: "appointment", ResourceType: "Appointment"},
+			Rank:              1,
+		}},
+	}
+
+	data, err := json.Marshal(appointment)
+	require.NoError(t, err)
+	var actual Appointment
+	require.NoError(t, json.Unmarshal(data, &actual))
+	assert.Equal(t, appointment, actual)
+
+	// diagnoses are contained resources the reasonReference refers to
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.NotContains(t, fields, "diagnoses")
+	assert.JSONEq(t, `[{"reference": "#diagnosis"}]`, string(fields["reasonReference"]))
+	require.Contains(t, fields, "contained")
+
+	// as are contained conditions, while other reasons are not kept
+	require.NoError(t, json.Unmarshal([]byte(`{"resourceType": "Appointment", "id": "a1", "status": "finished",
+		"contained": [{"resourceType": "Condition", "id": "c1", "code": {"text": "Diabetes"}}],
+		"reasonReference": [{"reference": "Condition/c2"}, {"reference": "#c1"}]}`), &actual))
+	require.Len(t, actual.Diagnoses, 1)
+	assert.Equal(t, "c1", actual.Diagnoses[0].ID())
+	assert.Equal(t, "Diabetes", actual.Diagnoses[0].Name())
+
+	// an appointment without a period or references leaves them out, and defaults its resourceType
+	data, err = json.Marshal(Appointment{Status: "proposed"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceType": "Appointment", "id": "", "status": "proposed"}`, string(data))
+	var empty Appointment
+	require.NoError(t, json.Unmarshal(data, &empty))
+	assert.Equal(t, Appointment{ResourceTypeAndID: ResourceTypeAndID{ResourceType: "Appointment"}, Status: "proposed"}, empty)
+}
+
+func TestBundle_MarshalJSON(t *testing.T) {
+	bundle := Bundle{
+		ResourceTypeAndID: ResourceTypeAndID{ResourceID: "bundle", ResourceType: "Bundle"},
+		BundleType:        BundleTypeTransaction,
+		Resources: BundledResources{
+			Patient{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "patient", ResourceType: "Patient"},
+				Name:              []Name{{Family: "Tenderson", Given: []string{"Tendo"}}},
+			},
+			Appointment{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "appointment", ResourceType: "Appointment"},
+				Status:            "finished",
+				Subject:           Reference{ResourceID: "patient", ResourceType: "Patient"},
+			},
+			Diagnosis{
+				ResourceTypeAndID: ResourceTypeAndID{ResourceID: "diagnosis", ResourceType: "Diagnosis"},
+				Status:            "final",
+				Code:              CodeableConcept{Text: "Diabetes"},
+				Appointment:       Reference{ResourceID: "appointment", ResourceType: "Appointment"},
+			},
+		},
+	}
+
+	data, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	var entries struct {
+		Entry []map[string]json.RawMessage `json:"entry"`
+	}
+	require.NoError(t, json.Unmarshal(data, &entries))
+	require.Len(t, entries.Entry, 3)
+	assert.Contains(t, entries.Entry[0], "resource")
+
+	var actual Bundle
+	require.NoError(t, json.Unmarshal(data, &actual))
+	assert.Equal(t, bundle, actual)
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// stream.go contains the decoding of a stream of JSON resources for ingestion
+
+// ingest writes every JSON document decoded from decoder with w.
+func (in *ingester) ingest(decoder *json.Decoder, w ResourceWriter) error {
+	for {
+		err := in.ingestDocument(decoder, w)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ingestDocument decodes and writes the next JSON document of decoder. Returns io.EOF if there are no more
+// documents, or another error if ingestion must stop.
+//
+// The fields of the document are decoded one at a time, so that the entries of a bundle can be written as they
+// are decoded instead of after decoding the whole bundle.
+func (in *ingester) ingestDocument(decoder *json.Decoder, w ResourceWriter) error {
+	tok, err := decoder.Token()
+	if err == io.EOF {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "problem decoding JSON object")
+	}
+	if tok != json.Delim('{') {
+		return errors.Errorf("problem decoding JSON object: found %v", tok)
+	}
+
+	fields := map[string]json.RawMessage{}
+	streamed := false
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			return errors.Wrap(err, "problem decoding JSON object")
+		}
+		key := tok.(string) // object keys are always strings
+
+		if bundleType, ok := streamableBundleType(fields); ok && key == "entry" {
+			if err := in.streamEntries(decoder, bundleType, w); err != nil {
+				return err
+			}
+			streamed = true
+			continue
+		}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return errors.Wrap(err, "problem decoding JSON object")
+		}
+		fields[key] = value
+	}
+	if _, err := decoder.Token(); err != nil {
+		return errors.Wrap(err, "problem decoding JSON object")
+	}
+
+	if streamed {
+		return nil
+	}
+
+	// a top-level resource is not in a bundle, so only its absolute URL references resolve
+	var resolver bundleResolver
+	resource, err := resourceFromFields(fields)
+	if err == nil {
+		resource, err = resolver.resolve(resource)
+	}
+	if err != nil {
+		err = in.decodeFailure(fields, err)
+	} else {
+		err = in.write(resource, w, "")
+	}
+	if in.stop("", err) {
+		return err
+	}
+	return nil
+}
+
+// streamableBundleType returns the type of the bundle whose fields, up to its entries, are fields, and whether
+// the entries can be written as they are decoded. They can if the bundle's type is known and is not a
+// transaction.
+func streamableBundleType(fields map[string]json.RawMessage) (string, bool) {
+	var resourceType, bundleType string
+	if err := json.Unmarshal(fields["resourceType"], &resourceType); err != nil || resourceType != "Bundle" {
+		return "", false
+	}
+	if err := json.Unmarshal(fields["type"], &bundleType); err != nil || bundleType == BundleTypeTransaction {
+		return "", false
+	}
+	return bundleType, true
+}
+
+// streamEntries decodes and writes each entry of the entry array of a bundle of type bundleType, which is the
+// next value of decoder.
+//
+// An entry is written before the entries after it are decoded, unless it refers to a later entry by fullUrl, or
+// to an entry deferred that way. Such entries are held until every entry has been decoded, and then written
+// after the entries they refer to, see dependencyOrder.
+func (in *ingester) streamEntries(decoder *json.Decoder, bundleType string, w ResourceWriter) error {
+	tok, err := decoder.Token()
+	if err != nil {
+		return errors.Wrap(err, "problem decoding bundle entries")
+	}
+	if tok == nil {
+		return nil // "entry": null
+	}
+	if tok != json.Delim('[') {
+		return errors.Errorf("problem decoding bundle entries: expected list, found %v", tok)
+	}
+
+	var (
+		resolver     bundleResolver
+		deferred     []streamedEntry
+		deferredKeys = map[resourceKey]bool{}
+	)
+	for i := 0; decoder.More(); i++ {
+		var entry bundleEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return errors.Wrapf(err, "problem decoding bundled resource at entry %d", i)
+		}
+
+		resource, err := unmarshalResource(json.NewDecoder(bytes.NewReader(entry.Resource)))
+		if err == nil {
+			resource = resolver.add(entry.FullURL, resource)
+			if resolver.refersForward(resource, deferredKeys) {
+				deferred = append(deferred, streamedEntry{i, entry.Resource, resource})
+				deferredKeys[resourceKey{resource.Type(), resource.ID()}] = true
+				continue
+			}
+			resource, err = resolver.resolve(resource)
+		}
+		if err := in.writeStreamed(streamedEntry{i, entry.Resource, resource}, err, bundleType, w); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return errors.Wrap(err, "problem decoding bundle entries")
+	}
+
+	var resolved []Resource
+	for _, entry := range deferred {
+		resource, err := resolver.resolve(entry.resource)
+		if err != nil {
+			if err := in.writeStreamed(entry, err, bundleType, w); err != nil {
+				return err
+			}
+			continue
+		}
+		resolved = append(resolved, resource)
+	}
+	for _, resource := range dependencyOrder(resolved) {
+		if err := in.write(resource, w, bundleType); in.stop(bundleType, err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamedEntry is an entry of a streamed bundle, with the JSON and the resource unmarshalled from it.
+type streamedEntry struct {
+	index    int
+	data     json.RawMessage
+	resource Resource
+}
+
+// writeStreamed writes the resource of entry, an entry of a bundle of type bundleType, or records that it failed
+// with err, the failure to unmarshal it or resolve its references. Returns an error if ingestion must stop.
+func (in *ingester) writeStreamed(entry streamedEntry, err error, bundleType string, w ResourceWriter) error {
+	if err != nil {
+		var fields map[string]json.RawMessage
+		_ = json.Unmarshal(entry.data, &fields) // best effort, to report the type and id of the entry
+		err = in.decodeFailure(fields, errors.Wrapf(err, "problem unmarshalling bundled resource at entry %d", entry.index))
+	} else {
+		err = in.write(entry.resource, w, bundleType)
+	}
+	if in.stop(bundleType, err) {
+		return err
+	}
+	return nil
+}
+
+// decodeFailure records that the resource with fields could not be created from its JSON and returns err.
+func (in *ingester) decodeFailure(fields map[string]json.RawMessage, err error) error {
+	var resourceType, id string
+	_ = json.Unmarshal(fields["resourceType"], &resourceType)
+	_ = json.Unmarshal(fields["id"], &id)
+	in.record(resourceType, id, OutcomeFailed, err)
+	return err
+}
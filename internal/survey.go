@@ -0,0 +1,745 @@
+package internal
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// survey.go contains the definition of the feedback survey and the checking of answers against it
+
+type (
+	// Survey defines the questions patients answer about an appointment. It is read from JSON, see ReadSurvey,
+	// so the questions can change without a release; DefaultSurvey is used when none is configured.
+	//
+	// A version of a survey is immutable once feedback may have answered it: changed questions are given a new
+	// Version, so that feedback is always shown with the questions it answered.
+	Survey struct {
+		ID        string     `json:"id"`
+		Version   int        `json:"version"`
+		Title     string     `json:"title,omitempty"`
+		Questions []Question `json:"questions"`
+	}
+
+	// Question is a question of a survey.
+	Question struct {
+		// ID identifies the answer to the question in Feedback.Answers.
+		ID   string       `json:"id"`
+		Type QuestionType `json:"type"`
+		// Text is the wording of the question, a text/template executed with a SurveyContext.
+		Text string `json:"text"`
+		// Label, if set, is the wording the answer is shown with once submitted, a template like Text.
+		Label string `json:"label,omitempty"`
+		// Min and Max bound the answer to a scale question.
+		Min int `json:"min,omitempty"`
+		Max int `json:"max,omitempty"`
+		// Options are the answers to choose from for a choice or multiChoice question.
+		Options []Option `json:"options,omitempty"`
+		// Optional questions may be left unanswered.
+		Optional bool `json:"optional,omitempty"`
+		// When, if set, is the condition on the answers to earlier questions for the question to be asked.
+		// Questions that are not asked must be left unanswered.
+		When *Condition `json:"when,omitempty"`
+	}
+
+	// Condition is a rule on the answers to earlier questions of a survey. It either tests the answer to
+	// Question, with Equals or with Min and Max, or combines the conditions of All or Any. A condition on a
+	// question that is not answered does not hold.
+	Condition struct {
+		Question string `json:"question,omitempty"`
+		// Equals holds when the answer is equal to it; for a multiChoice question, when the option value it
+		// names is chosen.
+		Equals *Answer `json:"equals,omitempty"`
+		// Min and Max hold when the answer to a scale question is at least Min, and at most Max.
+		Min *int `json:"min,omitempty"`
+		Max *int `json:"max,omitempty"`
+		// All holds when all of its conditions hold, and Any when any of them does.
+		All []Condition `json:"all,omitempty"`
+		Any []Condition `json:"any,omitempty"`
+	}
+
+	// Option is an answer to choose from. Value is stored as the answer; Label, if set, is shown instead.
+	Option struct {
+		Value string `json:"value"`
+		Label string `json:"label,omitempty"`
+	}
+
+	// SurveyContext is the data the wording of questions is executed with. Diagnosis is "" when the feedback is
+	// about no diagnosis.
+	SurveyContext struct {
+		Patient   string // given name
+		Doctor    string // family name
+		Diagnosis string
+	}
+
+	// Answer is the answer to a question: Number for a scale question, Bool for a yes/no question, Text for a
+	// text or choice question and Choices for a multiChoice question. The zero Answer is no answer. It is
+	// written as the bare JSON value.
+	Answer struct {
+		Number  *int
+		Bool    *bool
+		Text    *string
+		Choices []string
+	}
+)
+
+// QuestionType is the kind of answer a question takes.
+type QuestionType string
+
+const (
+	// QuestionScale is answered with a whole number from Min to Max.
+	QuestionScale QuestionType = "scale"
+	// QuestionYesNo is answered with true or false.
+	QuestionYesNo QuestionType = "yesNo"
+	// QuestionText is answered with free text.
+	QuestionText QuestionType = "text"
+	// QuestionChoice is answered with the value of one of the options.
+	QuestionChoice QuestionType = "choice"
+	// QuestionMultiChoice is answered with the values of any of the options.
+	QuestionMultiChoice QuestionType = "multiChoice"
+)
+
+// DefaultSurveyID is the id of DefaultSurvey, whose first version feedback given before surveys were
+// configurable answers.
+const DefaultSurveyID = "appointment-feedback"
+
+//go:embed default_survey.json
+var defaultSurveyJSON []byte
+
+// DefaultSurvey returns the survey used when none is configured: whether the patient would recommend the
+// doctor, whether the doctor explained the diagnosis, and how the patient feels about it.
+//
+// Returns an error if the embedded definition is not valid, see ReadSurvey.
+func DefaultSurvey() (Survey, error) {
+	survey, err := ReadSurvey(bytes.NewReader(defaultSurveyJSON))
+	return survey, errors.Wrap(err, "problem reading default survey")
+}
+
+// SurveyReader reads saved survey versions, see SurveyWriter.
+type SurveyReader interface {
+	GetSurvey(id string, version int) (*Survey, error)
+}
+
+// PublishSurvey saves the version of the survey to answer with surveys, so that feedback answering it can be shown
+// with its questions after the survey has changed.
+//
+// Returns an error if a different definition has been saved under the same id and version: a published version
+// is immutable, and changed questions must be given a new version.
+func PublishSurvey(surveys SurveyWriter, survey Survey) error {
+	if err := surveys.SaveSurvey(survey); err != nil {
+		return errors.Wrapf(err, "problem saving survey %s version %d", survey.ID, survey.Version)
+	}
+	saved, err := surveys.GetSurvey(survey.ID, survey.Version)
+	if err != nil {
+		return errors.Wrapf(err, "problem reading survey %s version %d", survey.ID, survey.Version)
+	}
+	if saved == nil {
+		return errors.Errorf("survey %s version %d was not saved", survey.ID, survey.Version)
+	}
+	// compare as JSON, the form the stores save surveys in
+	savedJSON, _ := json.Marshal(saved)
+	surveyJSON, _ := json.Marshal(survey)
+	if !bytes.Equal(savedJSON, surveyJSON) {
+		return errors.Errorf("survey %s version %d has changed since it was published: give the changed survey a new version",
+			survey.ID, survey.Version)
+	}
+	return nil
+}
+
+// LookupSurvey returns the version of the survey that feedback answered, read with surveys, or nil if it has not
+// been published. The default survey, answered by feedback given before surveys were configurable, is always
+// found.
+func LookupSurvey(surveys SurveyReader, id string, version int) (*Survey, error) {
+	survey, err := surveys.GetSurvey(id, version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem reading survey %s version %d", id, version)
+	}
+	if survey == nil && id == DefaultSurveyID {
+		defaultSurvey, err := DefaultSurvey()
+		if err != nil {
+			return nil, err
+		}
+		if defaultSurvey.Version == version {
+			survey = &defaultSurvey
+		}
+	}
+	return survey, nil
+}
+
+// ReadSurvey reads a survey definition from JSON, or from a FHIR Questionnaire resource, see
+// Questionnaire.Survey.
+//
+// Returns an error if the JSON of a definition has unknown fields or the definition is not valid, see
+// Survey.Validate.
+func ReadSurvey(reader io.Reader) (Survey, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return Survey{}, errors.Wrap(err, "problem reading survey")
+	}
+	var resource ResourceTypeAndID
+	if err := json.Unmarshal(data, &resource); err == nil && resource.ResourceType == "Questionnaire" {
+		var questionnaire Questionnaire
+		if err := json.Unmarshal(data, &questionnaire); err != nil {
+			return Survey{}, errors.Wrap(err, "problem decoding questionnaire")
+		}
+		return questionnaire.Survey()
+	}
+
+	var survey Survey
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&survey); err != nil {
+		return Survey{}, errors.Wrap(err, "problem decoding survey")
+	}
+	if err := survey.Validate(); err != nil {
+		return Survey{}, errors.Wrap(err, "invalid survey "+survey.ID)
+	}
+	return survey, nil
+}
+
+// Validate returns an error if the survey has no id, version or questions, or a question has no or a duplicate
+// id, an unknown type, a scale whose Min is not below its Max, no or duplicate options for a choice, wording
+// that is not a valid template, or a condition that is not valid, see Condition.validate.
+func (s Survey) Validate() error {
+	if s.ID == "" {
+		return errors.New("survey id is missing")
+	}
+	if s.Version < 1 {
+		return errors.New("survey version is missing")
+	}
+	if len(s.Questions) == 0 {
+		return errors.New("survey has no questions")
+	}
+	ids := map[string]bool{}
+	for i, q := range s.Questions {
+		if q.ID == "" {
+			return errors.Errorf("question %d has no id", i+1)
+		}
+		if ids[q.ID] {
+			return errors.Errorf("question id %s is not unique", q.ID)
+		}
+		ids[q.ID] = true
+		if err := q.validate(); err != nil {
+			return errors.Wrap(err, "question "+q.ID)
+		}
+		if q.When != nil {
+			if err := q.When.validate(Survey{Questions: s.Questions[:i]}); err != nil {
+				return errors.Wrap(err, "question "+q.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns an error if the condition does not test exactly one of a question, All or Any, tests a
+// question that is not one of the earlier ones, or tests it with neither or both of Equals and Min and Max, Min
+// and Max of a question that is not a scale, or Equals that is not an answer the question takes.
+func (c Condition) validate(earlier Survey) error {
+	combined := 0
+	for _, conditions := range [][]Condition{c.All, c.Any} {
+		if len(conditions) > 0 {
+			combined++
+		}
+		for _, condition := range conditions {
+			if err := condition.validate(earlier); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Question != "" {
+		combined++
+	}
+	if combined != 1 {
+		return errors.New("condition must test a question, or combine conditions with all or any")
+	}
+	if c.Question == "" {
+		return nil
+	}
+
+	q := earlier.Question(c.Question)
+	if q == nil {
+		return errors.Errorf("condition on %s, which is not an earlier question", c.Question)
+	}
+	bounded := c.Min != nil || c.Max != nil
+	switch {
+	case c.Equals == nil && !bounded:
+		return errors.Errorf("condition on %s has no equals, min or max", q.ID)
+	case c.Equals != nil && bounded:
+		return errors.Errorf("condition on %s has both equals and min or max", q.ID)
+	case bounded && q.Type != QuestionScale:
+		return errors.Errorf("condition on %s: min and max only test scale questions", q.ID)
+	case c.Equals != nil && q.Type == QuestionMultiChoice:
+		if c.Equals.Text == nil || q.option(*c.Equals.Text) == nil {
+			return errors.Errorf("condition on %s: equals must be one of %s", q.ID, q.optionValues())
+		}
+	case c.Equals != nil:
+		if err := q.Check(*c.Equals); err != nil {
+			return errors.Wrapf(err, "condition on %s: equals is not an answer", q.ID)
+		}
+	}
+	return nil
+}
+
+// Holds returns whether the condition holds for the answers.
+func (c Condition) Holds(answers map[string]Answer) bool {
+	switch {
+	case len(c.All) > 0:
+		for _, condition := range c.All {
+			if !condition.Holds(answers) {
+				return false
+			}
+		}
+		return true
+	case len(c.Any) > 0:
+		for _, condition := range c.Any {
+			if condition.Holds(answers) {
+				return true
+			}
+		}
+		return false
+	}
+
+	a := answers[c.Question]
+	if a.IsZero() {
+		return false
+	}
+	if c.Equals != nil {
+		if a.Choices != nil {
+			return c.Equals.Text != nil && contains(a.Choices, *c.Equals.Text)
+		}
+		return a.equal(*c.Equals)
+	}
+	return a.Number != nil && (c.Min == nil || *a.Number >= *c.Min) && (c.Max == nil || *a.Number <= *c.Max)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Asked returns whether the question is asked given the answers to earlier questions: it has no condition, or
+// its condition holds.
+func (q Question) Asked(answers map[string]Answer) bool {
+	return q.When == nil || q.When.Holds(answers)
+}
+
+// NextQuestion returns the index of the first question from index i on that is asked given the answers, or the
+// number of questions if there is none.
+func (s Survey) NextQuestion(i int, answers map[string]Answer) int {
+	for ; i < len(s.Questions); i++ {
+		if s.Questions[i].Asked(answers) {
+			break
+		}
+	}
+	return i
+}
+
+func (q Question) validate() error {
+	switch q.Type {
+	case QuestionScale:
+		if q.Min >= q.Max {
+			return errors.Errorf("min %d is not below max %d", q.Min, q.Max)
+		}
+	case QuestionYesNo, QuestionText:
+	case QuestionChoice, QuestionMultiChoice:
+		if len(q.Options) == 0 {
+			return errors.New("has no options")
+		}
+		values := map[string]bool{}
+		for _, option := range q.Options {
+			if values[option.Value] {
+				return errors.Errorf("option %q is not unique", option.Value)
+			}
+			values[option.Value] = true
+		}
+	default:
+		return errors.Errorf("unknown type %q", q.Type)
+	}
+	if q.Text == "" {
+		return errors.New("text is missing")
+	}
+	// execute the wording with and without a diagnosis, as templates may branch on it
+	for _, ctx := range []SurveyContext{{}, {Diagnosis: "diagnosis"}} {
+		if _, err := q.Prompt(ctx); err != nil {
+			return err
+		}
+		if _, err := q.AnswerLabel(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Question returns the question of the survey with the id, or nil if it has none.
+func (s Survey) Question(id string) *Question {
+	for i := range s.Questions {
+		if s.Questions[i].ID == id {
+			return &s.Questions[i]
+		}
+	}
+	return nil
+}
+
+// Check returns an error if the feedback does not answer the survey: it is for another survey or version,
+// answers a question the survey does not have or does not ask given the other answers, leaves a question that is
+// asked and not optional unanswered, or answers a question with an answer it does not take.
+func (s Survey) Check(f Feedback) error {
+	if !s.AnsweredBy(f) {
+		return errors.Errorf("feedback answers survey %q version %d, not %q version %d",
+			f.Survey, f.SurveyVersion, s.ID, s.Version)
+	}
+	ids := make([]string, 0, len(f.Answers))
+	for id := range f.Answers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if s.Question(id) == nil {
+			return errors.Errorf("survey %s has no question %s", s.ID, id)
+		}
+	}
+	for _, q := range s.Questions {
+		if !q.Asked(f.Answers) {
+			if !f.Answers[q.ID].IsZero() {
+				return errors.Errorf("question %s is not asked given the other answers", q.ID)
+			}
+			continue
+		}
+		if err := q.Check(f.Answers[q.ID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnsweredBy returns whether the feedback answers this version of the survey.
+func (s Survey) AnsweredBy(f Feedback) bool {
+	return f.Survey == s.ID && f.SurveyVersion == s.Version
+}
+
+// NewSurveyContext returns the context to word the questions of a survey about an appointment with the doctor,
+// and the diagnosis if not nil. Names that are not known are left empty.
+func NewSurveyContext(patient *Patient, doctor *Doctor, diagnosis *Diagnosis) SurveyContext {
+	var ctx SurveyContext
+	if patient != nil && len(patient.Name) > 0 && len(patient.Name[0].Given) > 0 {
+		ctx.Patient = patient.Name[0].Given[0]
+	}
+	if doctor != nil && len(doctor.Name) > 0 {
+		ctx.Doctor = doctor.Name[0].Family
+	}
+	if diagnosis != nil {
+		ctx.Diagnosis = diagnosis.Name()
+	}
+	return ctx
+}
+
+// Prompt returns the wording of the question.
+func (q Question) Prompt(ctx SurveyContext) (string, error) {
+	return execute(q.ID, q.Text, ctx)
+}
+
+// AnswerLabel returns the wording the answer to the question is shown with, its Label if set or else its Text.
+func (q Question) AnswerLabel(ctx SurveyContext) (string, error) {
+	if q.Label == "" {
+		return q.Prompt(ctx)
+	}
+	return execute(q.ID, q.Label, ctx)
+}
+
+func execute(name, text string, ctx SurveyContext) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "problem parsing wording")
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		return "", errors.Wrap(err, "problem executing wording")
+	}
+	return buf.String(), nil
+}
+
+// Check returns an error if a is not an answer the question takes.
+func (q Question) Check(a Answer) error {
+	if a.IsZero() {
+		if q.Optional {
+			return nil
+		}
+		return errors.Errorf("question %s is not answered", q.ID)
+	}
+	switch q.Type {
+	case QuestionScale:
+		if a.Number == nil || *a.Number < q.Min || *a.Number > q.Max {
+			return errors.Errorf("answer to %s must be a number from %d to %d", q.ID, q.Min, q.Max)
+		}
+	case QuestionYesNo:
+		if a.Bool == nil {
+			return errors.Errorf("answer to %s must be true or false", q.ID)
+		}
+	case QuestionText:
+		if a.Text == nil {
+			return errors.Errorf("answer to %s must be text", q.ID)
+		}
+	case QuestionChoice:
+		if a.Text == nil || q.option(*a.Text) == nil {
+			return errors.Errorf("answer to %s must be one of %s", q.ID, q.optionValues())
+		}
+	case QuestionMultiChoice:
+		if a.Choices == nil {
+			return errors.Errorf("answer to %s must be a list of values of %s", q.ID, q.optionValues())
+		}
+		chosen := map[string]bool{}
+		for _, choice := range a.Choices {
+			if q.option(choice) == nil || chosen[choice] {
+				return errors.Errorf("answer to %s must be distinct values of %s", q.ID, q.optionValues())
+			}
+			chosen[choice] = true
+		}
+	}
+	return nil
+}
+
+func (q Question) option(value string) *Option {
+	for i := range q.Options {
+		if q.Options[i].Value == value {
+			return &q.Options[i]
+		}
+	}
+	return nil
+}
+
+func (q Question) optionValues() string {
+	values := make([]string, len(q.Options))
+	for i, option := range q.Options {
+		values[i] = option.Value
+	}
+	return strings.Join(values, ", ")
+}
+
+// ParseAnswer parses the answer to the question as typed by a patient: a number for a scale, yes or no, the
+// number or value of an option, or a comma-separated list of those for a multiChoice question. Empty input is no
+// answer. Returns an error, worded for the patient, if in is not an answer the question takes.
+func (q Question) ParseAnswer(in string) (Answer, error) {
+	in = strings.TrimSpace(in)
+	if in == "" {
+		if q.Optional {
+			return Answer{}, nil
+		}
+		return Answer{}, errors.New("Please enter an answer.")
+	}
+	var a Answer
+	switch q.Type {
+	case QuestionScale:
+		n, err := strconv.Atoi(in)
+		if err != nil || n < q.Min || n > q.Max {
+			return Answer{}, errors.Errorf("Please enter a value between %d-%d.", q.Min, q.Max)
+		}
+		a.Number = &n
+	case QuestionYesNo:
+		var yes bool
+		switch strings.ToLower(in) {
+		case "yes", "y", "true":
+			yes = true
+		case "no", "n", "false":
+		default:
+			return Answer{}, errors.New("Please answer Yes or No.")
+		}
+		a.Bool = &yes
+	case QuestionText:
+		a.Text = &in
+	case QuestionChoice:
+		value, err := q.parseOption(in)
+		if err != nil {
+			return Answer{}, err
+		}
+		a.Text = &value
+	case QuestionMultiChoice:
+		a.Choices = []string{}
+		for _, choice := range strings.Split(in, ",") {
+			value, err := q.parseOption(strings.TrimSpace(choice))
+			if err != nil {
+				return Answer{}, err
+			}
+			a.Choices = append(a.Choices, value)
+		}
+	}
+	return a, q.Check(a)
+}
+
+// parseOption returns the value of the option numbered or valued in.
+func (q Question) parseOption(in string) (string, error) {
+	if n, err := strconv.Atoi(in); err == nil && n >= 1 && n <= len(q.Options) {
+		return q.Options[n-1].Value, nil
+	}
+	if option := q.option(in); option != nil {
+		return option.Value, nil
+	}
+	return "", errors.Errorf("Please enter a value between 1-%d.", len(q.Options))
+}
+
+// FormatAnswer returns the answer to the question as shown to a patient.
+func (q Question) FormatAnswer(a Answer) string {
+	switch {
+	case a.Number != nil:
+		return strconv.Itoa(*a.Number)
+	case a.Bool != nil:
+		if *a.Bool {
+			return "Yes"
+		}
+		return "No"
+	case a.Text != nil:
+		return q.optionLabel(*a.Text)
+	case a.Choices != nil:
+		labels := make([]string, len(a.Choices))
+		for i, choice := range a.Choices {
+			labels[i] = q.optionLabel(choice)
+		}
+		return strings.Join(labels, ", ")
+	default:
+		return ""
+	}
+}
+
+// optionLabel returns the label of the option with the value, or the value if it has no label or is free text.
+func (q Question) optionLabel(value string) string {
+	if option := q.option(value); option != nil && option.Label != "" {
+		return option.Label
+	}
+	return value
+}
+
+// IsZero returns whether a is no answer.
+func (a Answer) IsZero() bool {
+	return a.Number == nil && a.Bool == nil && a.Text == nil && a.Choices == nil
+}
+
+// equal returns whether a and b are the same answer.
+func (a Answer) equal(b Answer) bool {
+	switch {
+	case a.Number != nil && b.Number != nil:
+		return *a.Number == *b.Number
+	case a.Bool != nil && b.Bool != nil:
+		return *a.Bool == *b.Bool
+	case a.Text != nil && b.Text != nil:
+		return *a.Text == *b.Text
+	case a.Choices != nil && b.Choices != nil:
+		if len(a.Choices) != len(b.Choices) {
+			return false
+		}
+		for i := range a.Choices {
+			if a.Choices[i] != b.Choices[i] {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.IsZero() && b.IsZero()
+	}
+}
+
+// MarshalJSON marshals the answer as the bare value, or null if there is none.
+func (a Answer) MarshalJSON() ([]byte, error) {
+	switch {
+	case a.Number != nil:
+		return json.Marshal(*a.Number)
+	case a.Bool != nil:
+		return json.Marshal(*a.Bool)
+	case a.Text != nil:
+		return json.Marshal(*a.Text)
+	case a.Choices != nil:
+		return json.Marshal(a.Choices)
+	default:
+		return []byte("null"), nil
+	}
+}
+
+// UnmarshalJSON unmarshals the answer from a whole number, boolean, string, list of strings or null.
+func (a *Answer) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return err
+	}
+	*a = Answer{}
+	switch v := v.(type) {
+	case nil:
+	case json.Number:
+		n, err := strconv.Atoi(v.String())
+		if err != nil {
+			return errors.Errorf("answer %s is not a whole number", v)
+		}
+		a.Number = &n
+	case bool:
+		a.Bool = &v
+	case string:
+		a.Text = &v
+	case []interface{}:
+		a.Choices = make([]string, len(v))
+		for i, choice := range v {
+			s, ok := choice.(string)
+			if !ok {
+				return errors.Errorf("answer choice %v is not a string", choice)
+			}
+			a.Choices[i] = s
+		}
+	default:
+		return errors.New("answer must be a number, boolean, string or list of strings")
+	}
+	return nil
+}
+
+// UnmarshalJSON unmarshals the feedback. Feedback in the format from before surveys were configurable, with
+// recommend, explained and feeling fields, is read as answers to the default survey.
+func (f *Feedback) UnmarshalJSON(data []byte) error {
+	type alias Feedback
+	var feedback struct {
+		alias
+		Recommend *int    `json:"recommend"`
+		Explained *bool   `json:"explained"`
+		Feeling   *string `json:"feeling"`
+	}
+	if err := json.Unmarshal(data, &feedback); err != nil {
+		return err
+	}
+	*f = Feedback(feedback.alias)
+	if f.Survey == "" && f.Answers == nil && (feedback.Recommend != nil || feedback.Explained != nil || feedback.Feeling != nil) {
+		f.Survey = DefaultSurveyID
+		f.SurveyVersion = 1
+		f.Answers = map[string]Answer{
+			"recommend": {Number: feedback.Recommend},
+			"explained": {Bool: feedback.Explained},
+			"feeling":   {Text: feedback.Feeling},
+		}
+		for id, answer := range f.Answers {
+			if answer.IsZero() {
+				delete(f.Answers, id)
+			}
+		}
+	}
+	return nil
+}
+
+// LegacyFeedback returns feedback stored before surveys were configurable as answers to the first version of
+// the default survey.
+func LegacyFeedback(recommend int, explained bool, feeling string) Feedback {
+	return Feedback{
+		Survey:        DefaultSurveyID,
+		SurveyVersion: 1,
+		Answers: map[string]Answer{
+			"recommend": {Number: &recommend},
+			"explained": {Bool: &explained},
+			"feeling":   {Text: &feeling},
+		},
+	}
+}
@@ -0,0 +1,272 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	. "github.com/scraymondjr/appointment/internal"
+)
+
+const testSurvey = `{
+	"id": "visit",
+	"version": 2,
+	"questions": [
+		{"id": "rating", "type": "scale", "min": 0, "max": 5, "text": "How was your visit with Dr {{.Doctor}}?"},
+		{"id": "again", "type": "yesNo", "text": "Would you come again?"},
+		{"id": "channel", "type": "choice", "text": "How did you book?", "options": [{"value": "phone", "label": "By phone"}, {"value": "web"}]},
+		{"id": "topics", "type": "multiChoice", "text": "What did you discuss?", "options": [{"value": "diet"}, {"value": "medication"}, {"value": "exercise"}]},
+		{"id": "comment", "type": "text", "text": "Anything else{{if .Diagnosis}} about {{.Diagnosis}}{{end}}?", "optional": true}
+	]
+}`
+
+func TestReadSurvey(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(testSurvey))
+	require.NoError(t, err)
+	assert.Len(t, survey.Questions, 5)
+
+	text, err := survey.Question("comment").Prompt(SurveyContext{Diagnosis: "Hypertension"})
+	require.NoError(t, err)
+	assert.Equal(t, "Anything else about Hypertension?", text)
+	assert.Nil(t, survey.Question("unknown"))
+
+	for name, tt := range map[string]struct {
+		JSON  string
+		Error string
+	}{
+		"unknown field": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "text", "text": "?", "hint": "!"}]}`,
+			Error: `problem decoding survey: json: unknown field "hint"`,
+		},
+		"no version": {
+			JSON:  `{"id": "s", "questions": [{"id": "q", "type": "text", "text": "?"}]}`,
+			Error: "invalid survey s: survey version is missing",
+		},
+		"no questions": {
+			JSON:  `{"id": "s", "version": 1, "questions": []}`,
+			Error: "invalid survey s: survey has no questions",
+		},
+		"duplicate question": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "text", "text": "?"}, {"id": "q", "type": "text", "text": "?"}]}`,
+			Error: "invalid survey s: question id q is not unique",
+		},
+		"empty scale": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "scale", "min": 5, "max": 5, "text": "?"}]}`,
+			Error: "invalid survey s: question q: min 5 is not below max 5",
+		},
+		"choice without options": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "choice", "text": "?"}]}`,
+			Error: "invalid survey s: question q: has no options",
+		},
+		"condition on later question": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "text", "text": "?", "when": {"question": "r", "equals": "x"}}, {"id": "r", "type": "text", "text": "?"}]}`,
+			Error: "invalid survey s: question q: condition on r, which is not an earlier question",
+		},
+		"condition without test": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "yesNo", "text": "?"}, {"id": "r", "type": "text", "text": "?", "when": {"question": "q"}}]}`,
+			Error: "invalid survey s: question r: condition on q has no equals, min or max",
+		},
+		"condition bounds not scale": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "yesNo", "text": "?"}, {"id": "r", "type": "text", "text": "?", "when": {"question": "q", "max": 1}}]}`,
+			Error: "invalid survey s: question r: condition on q: min and max only test scale questions",
+		},
+		"condition equals not an answer": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "yesNo", "text": "?"}, {"id": "r", "type": "text", "text": "?", "when": {"question": "q", "equals": "no"}}]}`,
+			Error: "invalid survey s: question r: condition on q: equals is not an answer: answer to q must be true or false",
+		},
+		"condition both question and any": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "yesNo", "text": "?"}, {"id": "r", "type": "text", "text": "?", "when": {"question": "q", "equals": true, "any": [{"question": "q", "equals": false}]}}]}`,
+			Error: "invalid survey s: question r: condition must test a question, or combine conditions with all or any",
+		},
+		"unknown template field": {
+			JSON:  `{"id": "s", "version": 1, "questions": [{"id": "q", "type": "text", "text": "Hi {{.Nurse}}"}]}`,
+			Error: "invalid survey s: question q: problem executing wording",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadSurvey(strings.NewReader(tt.JSON))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.Error)
+		})
+	}
+}
+
+func TestDefaultSurvey(t *testing.T) {
+	// the embedded definition is valid, so the default survey is always available
+	survey, err := DefaultSurvey()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultSurveyID, survey.ID)
+
+	ctx := SurveyContext{Patient: "Tendo", Doctor: "Careful", Diagnosis: "Diabetes"}
+	text, err := survey.Question("explained").Prompt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Thank you. You were diagnosed with Diabetes. Did Dr Careful explain how to manage this diagnosis in a way you could understand?", text)
+	ctx.Diagnosis = ""
+	label, err := survey.Question("explained").AnswerLabel(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "Dr Careful explained your care to you", label)
+
+	// feedback in the format from before surveys were configurable answers the default survey
+	var feedback Feedback
+	require.NoError(t, json.Unmarshal([]byte(`{"recommend": 9, "explained": true, "feeling": "fine"}`), &feedback))
+	assert.Equal(t, LegacyFeedback(9, true, "fine"), feedback)
+	assert.NoError(t, survey.Check(feedback))
+}
+
+func TestSurvey_Check(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(testSurvey))
+	require.NoError(t, err)
+
+	for name, tt := range map[string]struct {
+		Answers string
+		Error   string
+	}{
+		"valid": {
+			Answers: `{"rating": 0, "again": false, "channel": "web", "topics": ["diet", "exercise"]}`,
+		},
+		"optional answered": {
+			Answers: `{"rating": 5, "again": true, "channel": "phone", "topics": [], "comment": "thanks"}`,
+		},
+		"unknown question": {
+			Answers: `{"rating": 5, "again": true, "channel": "phone", "topics": [], "mood": "good"}`,
+			Error:   "survey visit has no question mood",
+		},
+		"unanswered": {
+			Answers: `{"rating": 5, "channel": "phone", "topics": []}`,
+			Error:   "question again is not answered",
+		},
+		"out of range": {
+			Answers: `{"rating": 6, "again": true, "channel": "phone", "topics": []}`,
+			Error:   "answer to rating must be a number from 0 to 5",
+		},
+		"wrong type": {
+			Answers: `{"rating": 5, "again": "yes", "channel": "phone", "topics": []}`,
+			Error:   "answer to again must be true or false",
+		},
+		"unknown option": {
+			Answers: `{"rating": 5, "again": true, "channel": "fax", "topics": []}`,
+			Error:   "answer to channel must be one of phone, web",
+		},
+		"repeated option": {
+			Answers: `{"rating": 5, "again": true, "channel": "web", "topics": ["diet", "diet"]}`,
+			Error:   "answer to topics must be distinct values of diet, medication, exercise",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			feedback := Feedback{Survey: "visit", SurveyVersion: 2}
+			require.NoError(t, json.Unmarshal([]byte(tt.Answers), &feedback.Answers))
+
+			err := survey.Check(feedback)
+			if tt.Error == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.Error)
+			}
+		})
+	}
+
+	assert.EqualError(t, survey.Check(Feedback{Survey: DefaultSurveyID, SurveyVersion: 1}), `feedback answers survey "appointment-feedback" version 1, not "visit" version 2`)
+	assert.EqualError(t, survey.Check(Feedback{Survey: "visit", SurveyVersion: 1}), `feedback answers survey "visit" version 1, not "visit" version 2`)
+}
+
+func TestSurvey_Branching(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(`{
+		"id": "branching",
+		"version": 1,
+		"questions": [
+			{"id": "recommend", "type": "scale", "min": 1, "max": 10, "text": "Would you recommend Dr {{.Doctor}}?"},
+			{"id": "better", "type": "text", "text": "What could Dr {{.Doctor}} have done better?", "when": {"question": "recommend", "max": 6}},
+			{"id": "explained", "type": "yesNo", "text": "Was your care explained?"},
+			{"id": "unclear", "type": "multiChoice", "text": "Which part was unclear?", "options": [{"value": "diagnosis"}, {"value": "medication"}], "when": {"question": "explained", "equals": false}},
+			{"id": "pharmacist", "type": "yesNo", "text": "Did you speak to a pharmacist?", "when": {"any": [{"question": "unclear", "equals": "medication"}, {"question": "recommend", "min": 1, "max": 2}]}}
+		]
+	}`))
+	require.NoError(t, err)
+
+	// the questions asked for the answers in order, as the CLI asks them
+	asked := func(answers string) []string {
+		var a map[string]Answer
+		require.NoError(t, json.Unmarshal([]byte(answers), &a))
+		var ids []string
+		for i := survey.NextQuestion(0, a); i < len(survey.Questions); i = survey.NextQuestion(i+1, a) {
+			ids = append(ids, survey.Questions[i].ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"recommend", "explained"}, asked(`{"recommend": 9, "explained": true}`))
+	assert.Equal(t, []string{"recommend", "better", "explained"}, asked(`{"recommend": 6, "explained": true}`))
+	assert.Equal(t, []string{"recommend", "explained", "unclear"}, asked(`{"recommend": 8, "explained": false, "unclear": ["diagnosis"]}`))
+	assert.Equal(t, []string{"recommend", "explained", "unclear", "pharmacist"}, asked(`{"recommend": 8, "explained": false, "unclear": ["diagnosis", "medication"]}`))
+	assert.Equal(t, []string{"recommend", "better", "explained", "pharmacist"}, asked(`{"recommend": 2, "explained": true}`))
+
+	for name, tt := range map[string]struct {
+		Answers string
+		Error   string
+	}{
+		"branch not taken":  {Answers: `{"recommend": 9, "explained": true}`},
+		"branches taken":    {Answers: `{"recommend": 4, "better": "listen", "explained": false, "unclear": ["medication"], "pharmacist": false}`},
+		"branch unanswered": {Answers: `{"recommend": 4, "explained": true}`, Error: "question better is not answered"},
+		"branch not asked":  {Answers: `{"recommend": 9, "better": "nothing", "explained": true}`, Error: "question better is not asked given the other answers"},
+		"nested not asked":  {Answers: `{"recommend": 8, "explained": false, "unclear": ["diagnosis"], "pharmacist": true}`, Error: "question pharmacist is not asked given the other answers"},
+		"nested unanswered": {Answers: `{"recommend": 8, "explained": false, "unclear": ["medication"]}`, Error: "question pharmacist is not answered"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			feedback := Feedback{Survey: "branching", SurveyVersion: 1}
+			require.NoError(t, json.Unmarshal([]byte(tt.Answers), &feedback.Answers))
+
+			err := survey.Check(feedback)
+			if tt.Error == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.Error)
+			}
+		})
+	}
+}
+
+func TestQuestion_ParseAnswer(t *testing.T) {
+	survey, err := ReadSurvey(strings.NewReader(testSurvey))
+	require.NoError(t, err)
+
+	for name, tt := range map[string]struct {
+		Question  string
+		In        string
+		Expected  string // the answer as JSON
+		Formatted string
+		Error     string
+	}{
+		"scale":              {Question: "rating", In: "4", Expected: `4`, Formatted: "4"},
+		"scale out of range": {Question: "rating", In: "9", Error: "Please enter a value between 0-5."},
+		"yes":                {Question: "again", In: "Yes", Expected: `true`, Formatted: "Yes"},
+		"no":                 {Question: "again", In: "n", Expected: `false`, Formatted: "No"},
+		"not yes or no":      {Question: "again", In: "maybe", Error: "Please answer Yes or No."},
+		"choice by number":   {Question: "channel", In: "1", Expected: `"phone"`, Formatted: "By phone"},
+		"choice by value":    {Question: "channel", In: "web", Expected: `"web"`, Formatted: "web"},
+		"multiple choices":   {Question: "topics", In: "3, medication", Expected: `["exercise","medication"]`, Formatted: "exercise, medication"},
+		"unknown choice":     {Question: "topics", In: "1, 4", Error: "Please enter a value between 1-3."},
+		"required":           {Question: "rating", In: " ", Error: "Please enter an answer."},
+		"optional skipped":   {Question: "comment", In: "", Expected: `null`},
+		"text":               {Question: "comment", In: " all good ", Expected: `"all good"`, Formatted: "all good"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q := survey.Question(tt.Question)
+			answer, err := q.ParseAnswer(tt.In)
+			if tt.Error != "" {
+				assert.EqualError(t, err, tt.Error)
+				return
+			}
+			require.NoError(t, err)
+			data, err := json.Marshal(answer)
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.Expected, string(data))
+			assert.Equal(t, tt.Formatted, q.FormatAnswer(answer))
+
+			var decoded Answer
+			require.NoError(t, json.Unmarshal(data, &decoded))
+			assert.Equal(t, answer, decoded)
+		})
+	}
+}